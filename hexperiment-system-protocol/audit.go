@@ -0,0 +1,550 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Audit event kinds
+const (
+	auditHTTP      = "http"
+	auditWSConnect = "ws_connect"
+	auditWSMessage = "ws_message"
+)
+
+// Audit outcomes
+const (
+	auditSuccess      = "success"
+	auditUnauthorized = "unauthorized"
+	auditForbidden    = "forbidden"
+	auditRateLimited  = "rate_limited"
+	auditError        = "error"
+)
+
+// Without AUDIT_LOG_FILE only this many recent events are kept, in memory
+const maxAuditMemoryEvents = 10000
+
+// Query results are capped at this many events
+const (
+	defaultAuditQueryLimit = 100
+	maxAuditQueryLimit     = 1000
+)
+
+// AuditEvent is one line of the audit log. With hash chaining, Hash covers
+// the event including Prev, the hash of the event before it.
+type AuditEvent struct {
+	Seq         int64     `json:"seq"`
+	Time        time.Time `json:"time"`
+	Actor       string    `json:"actor"`
+	KeyID       string    `json:"keyId,omitempty"`
+	AuthMethod  string    `json:"authMethod,omitempty"`
+	RemoteIP    string    `json:"remoteIp,omitempty"`
+	Kind        string    `json:"kind"`
+	Method      string    `json:"method,omitempty"`
+	Route       string    `json:"route,omitempty"`
+	Path        string    `json:"path,omitempty"`
+	MessageType string    `json:"messageType,omitempty"`
+	Status      int       `json:"status,omitempty"`
+	Outcome     string    `json:"outcome"`
+	LatencyMs   float64   `json:"latencyMs"`
+	Detail      string    `json:"detail,omitempty"`
+	Prev        string    `json:"prev,omitempty"`
+	Hash        string    `json:"hash,omitempty"`
+}
+
+// AuditQuery filters events; zero fields match everything
+type AuditQuery struct {
+	Since   time.Time
+	Until   time.Time
+	Actor   string
+	Kind    string
+	Outcome string
+	Limit   int
+}
+
+func (q AuditQuery) matches(e AuditEvent) bool {
+	return (q.Since.IsZero() || !e.Time.Before(q.Since)) &&
+		(q.Until.IsZero() || e.Time.Before(q.Until)) &&
+		(q.Actor == "" || e.Actor == q.Actor || e.KeyID == q.Actor) &&
+		(q.Kind == "" || e.Kind == q.Kind) &&
+		(q.Outcome == "" || e.Outcome == q.Outcome)
+}
+
+// AuditVerification is the result of checking a hash-chained log
+type AuditVerification struct {
+	Events   int    `json:"events"`
+	Chained  int    `json:"chained"`
+	Valid    bool   `json:"valid"`
+	BrokenAt int64  `json:"brokenAt,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// AuditLog is an append-only JSON-lines log, kept in memory when it has no
+// file
+type AuditLog struct {
+	mu     sync.Mutex
+	path   string
+	file   *os.File
+	chain  bool
+	seq    int64
+	last   string
+	recent []AuditEvent
+	// size is the length of the complete events written to the file, so
+	// readers can scan it without holding the writer lock
+	size int64
+}
+
+var auditLog = &AuditLog{}
+
+// loadAuditLog opens AUDIT_LOG_FILE; AUDIT_LOG_CHAIN=true hash-chains events
+func loadAuditLog() {
+	chain, _ := strconv.ParseBool(os.Getenv("AUDIT_LOG_CHAIN"))
+	path := os.Getenv("AUDIT_LOG_FILE")
+	l, err := OpenAuditLog(path, chain)
+	if err != nil {
+		// Falling back to memory would restart sequence numbers and the
+		// hash chain, and drop events, without anyone noticing
+		log.Fatalf("❌ Failed to open audit log %s: %v", path, err)
+	}
+	auditLog = l
+}
+
+// OpenAuditLog opens or creates a log file, continuing its sequence numbers
+// and hash chain
+func OpenAuditLog(path string, chain bool) (*AuditLog, error) {
+	l := &AuditLog{path: path, chain: chain}
+	if path == "" {
+		return l, nil
+	}
+	dropped, err := truncateTornAuditLine(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if dropped > 0 {
+		log.Printf("⚠️ Dropped %d bytes of an incomplete final event from audit log %s", dropped, path)
+	}
+	err = scanAuditFile(path, -1, func(e AuditEvent) bool {
+		l.seq, l.last = e.Seq, e.Hash
+		return true
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	l.file, err = os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	info, err := l.file.Stat()
+	if err != nil {
+		l.file.Close()
+		return nil, err
+	}
+	l.size = info.Size()
+	return l, nil
+}
+
+// truncateTornAuditLine removes a final line cut short by a crash mid-write,
+// returning how many bytes were dropped. Every complete event ends in a
+// newline.
+func truncateTornAuditLine(path string) (int64, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0600)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	size := info.Size()
+	buf := make([]byte, 64*1024)
+	for end := size; end > 0; {
+		start := end - int64(len(buf))
+		if start < 0 {
+			start = 0
+		}
+		chunk := buf[:end-start]
+		if _, err := f.ReadAt(chunk, start); err != nil {
+			return 0, err
+		}
+		if i := bytes.LastIndexByte(chunk, '\n'); i >= 0 {
+			keep := start + int64(i) + 1
+			if keep == size {
+				return 0, nil
+			}
+			return size - keep, f.Truncate(keep)
+		}
+		end = start
+	}
+	// No complete event at all
+	return size, f.Truncate(0)
+}
+
+// scanAuditFile calls fn for every event in the first limit bytes of a log
+// file (all of it when limit is negative) until fn returns false
+func scanAuditFile(path string, limit int64, fn func(AuditEvent) bool) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if limit >= 0 {
+		r = io.LimitReader(f, limit)
+	}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var e AuditEvent
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return fmt.Errorf("line %d: %v", line, err)
+		}
+		if !fn(e) {
+			return nil
+		}
+	}
+	return scanner.Err()
+}
+
+// hashAuditEvent hashes an event's JSON without its own hash
+func hashAuditEvent(e AuditEvent) string {
+	e.Hash = ""
+	data, _ := json.Marshal(e)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Record appends an event, assigning its sequence number and hash
+func (l *AuditLog) Record(e AuditEvent) {
+	e.Time = e.Time.UTC()
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	e.LatencyMs = math.Round(e.LatencyMs*1000) / 1000
+	if e.Actor == "" {
+		e.Actor = "anonymous"
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.seq++
+	e.Seq = l.seq
+	if l.chain {
+		e.Prev = l.last
+		e.Hash = hashAuditEvent(e)
+		l.last = e.Hash
+	}
+	if l.file == nil {
+		l.recent = append(l.recent, e)
+		if len(l.recent) > maxAuditMemoryEvents {
+			l.recent = l.recent[len(l.recent)-maxAuditMemoryEvents:]
+		}
+		return
+	}
+	data, err := json.Marshal(e)
+	if err == nil {
+		var n int
+		n, err = l.file.Write(append(data, '\n'))
+		l.size += int64(n)
+		// Remove a partial write so the next event starts on its own line
+		if err != nil && n > 0 && l.file.Truncate(l.size-int64(n)) == nil {
+			l.size -= int64(n)
+		}
+	}
+	if err != nil {
+		log.Printf("⚠️ Failed to write audit event %d: %v", e.Seq, err)
+	}
+}
+
+// Query returns the latest events matching a query, oldest first
+func (l *AuditLog) Query(q AuditQuery) ([]AuditEvent, error) {
+	if q.Limit <= 0 {
+		q.Limit = defaultAuditQueryLimit
+	}
+	if q.Limit > maxAuditQueryLimit {
+		q.Limit = maxAuditQueryLimit
+	}
+	matched := []AuditEvent{}
+	keep := func(e AuditEvent) bool {
+		if q.matches(e) {
+			matched = append(matched, e)
+			if len(matched) > q.Limit {
+				matched = matched[1:]
+			}
+		}
+		return true
+	}
+
+	recent, size, inMemory := l.snapshot()
+	if inMemory {
+		for _, e := range recent {
+			keep(e)
+		}
+		return matched, nil
+	}
+	return matched, scanAuditFile(l.path, size, keep)
+}
+
+// snapshot returns what readers may scan without the lock: a copy of the
+// in-memory events, or the length of the file's complete events. Records
+// added later are not seen.
+func (l *AuditLog) snapshot() ([]AuditEvent, int64, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return append([]AuditEvent(nil), l.recent...), 0, true
+	}
+	return nil, l.size, false
+}
+
+// Verify recomputes the hash chain. Events written without chaining are
+// counted but not checked.
+func (l *AuditLog) Verify() (AuditVerification, error) {
+	var v AuditVerification
+	previous := ""
+	check := func(e AuditEvent) bool {
+		v.Events++
+		if e.Hash != "" {
+			v.Chained++
+			if e.Prev != previous {
+				v.BrokenAt, v.Error = e.Seq, "previous hash does not match"
+				return false
+			}
+			if hashAuditEvent(e) != e.Hash {
+				v.BrokenAt, v.Error = e.Seq, "event hash does not match its contents"
+				return false
+			}
+		}
+		previous = e.Hash
+		return true
+	}
+
+	recent, size, inMemory := l.snapshot()
+	if inMemory {
+		// Older events may have been dropped from memory; start the chain at
+		// the oldest one kept
+		if len(recent) > 0 {
+			previous = recent[0].Prev
+		}
+		for _, e := range recent {
+			if !check(e) {
+				break
+			}
+		}
+	} else if err := scanAuditFile(l.path, size, check); err != nil {
+		return v, err
+	}
+	v.Valid = v.Error == ""
+	return v, nil
+}
+
+// auditOutcome classifies an HTTP status
+func auditOutcome(status int) string {
+	switch {
+	case status == http.StatusUnauthorized:
+		return auditUnauthorized
+	case status == http.StatusForbidden:
+		return auditForbidden
+	case status == http.StatusTooManyRequests:
+		return auditRateLimited
+	case status >= 400:
+		return auditError
+	}
+	return auditSuccess
+}
+
+// setIdentity fills the actor fields of an event
+func (e *AuditEvent) setIdentity(identity *Identity) {
+	if identity == nil {
+		return
+	}
+	e.Actor, e.KeyID, e.AuthMethod = identity.Subject, identity.KeyID, identity.Method
+}
+
+// auditRequest is shared through the request context, so requireScope can
+// report the caller to auditMiddleware
+type auditRequest struct {
+	identity *Identity
+}
+
+type auditRequestKey struct{}
+
+// noteAuditIdentity records the authenticated caller of a request
+func noteAuditIdentity(r *http.Request, identity *Identity) {
+	if a, ok := r.Context().Value(auditRequestKey{}).(*auditRequest); ok {
+		a.identity = identity
+	}
+}
+
+// auditResponseWriter captures the status of a response. It passes through
+// Hijack so WebSocket upgrades still work.
+type auditResponseWriter struct {
+	http.ResponseWriter
+	status   int
+	hijacked bool
+}
+
+func (w *auditResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *auditResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *auditResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("response does not support hijacking")
+	}
+	w.hijacked = true
+	return hijacker.Hijack()
+}
+
+func (w *auditResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// auditedRoute reports whether every request to a route is audited, not
+// only mutating or rejected ones
+func auditedRoute(route string) bool {
+	return strings.HasPrefix(route, "/api/admin/") || strings.HasPrefix(route, "/api/proxy/") || route == "/api/github" || route == "/api/huggingface"
+}
+
+// auditMiddleware records mutating requests, rejected requests and every
+// call to admin and proxy routes. WebSocket sessions audit themselves.
+func auditMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		audit := &auditRequest{}
+		recorder := &auditResponseWriter{ResponseWriter: w}
+		next.ServeHTTP(recorder, r.WithContext(context.WithValue(r.Context(), auditRequestKey{}, audit)))
+		if recorder.hijacked {
+			return
+		}
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+
+		route := r.URL.Path
+		if current := mux.CurrentRoute(r); current != nil {
+			if template, err := current.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+		mutating := r.Method != "GET" && r.Method != "HEAD" && r.Method != "OPTIONS"
+		// The static file server sees every stray URL; leave those out
+		if route == "/" || (!mutating && recorder.status < 400 && !auditedRoute(route)) {
+			return
+		}
+
+		event := AuditEvent{
+			Time:      start,
+			RemoteIP:  rateLimits.clientIP(r),
+			Kind:      auditHTTP,
+			Method:    r.Method,
+			Route:     route,
+			Path:      r.URL.Path,
+			Status:    recorder.status,
+			Outcome:   auditOutcome(recorder.status),
+			LatencyMs: float64(time.Since(start).Microseconds()) / 1000,
+		}
+		event.setIdentity(audit.identity)
+		auditLog.Record(event)
+	})
+}
+
+// auditWebSocket records a WebSocket connection or message
+func auditWebSocket(r *http.Request, identity *Identity, kind, messageType, outcome string, start time.Time, detail string) {
+	event := AuditEvent{
+		Time:        start,
+		RemoteIP:    rateLimits.clientIP(r),
+		Kind:        kind,
+		Route:       "/ws",
+		MessageType: messageType,
+		Outcome:     outcome,
+		LatencyMs:   float64(time.Since(start).Microseconds()) / 1000,
+		Detail:      detail,
+	}
+	event.setIdentity(identity)
+	auditLog.Record(event)
+}
+
+// Audit query handler: events filtered by since/until (RFC 3339), actor
+// (subject or key ID), kind and outcome, newest `limit` events oldest first
+func adminAuditHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	query := r.URL.Query()
+	q := AuditQuery{
+		Actor:   query.Get("actor"),
+		Kind:    query.Get("kind"),
+		Outcome: query.Get("outcome"),
+	}
+	for name, target := range map[string]*time.Time{"since": &q.Since, "until": &q.Until} {
+		if value := query.Get(name); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				http.Error(w, name+" must be an RFC 3339 time", http.StatusBadRequest)
+				return
+			}
+			*target = t
+		}
+	}
+	if value := query.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit <= 0 {
+			http.Error(w, "limit must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		q.Limit = limit
+	}
+
+	events, err := auditLog.Query(q)
+	if err != nil {
+		http.Error(w, "Failed to read audit log: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"events": events,
+		"count":  len(events),
+	})
+}
+
+// Audit verification handler: recomputes the hash chain
+func adminAuditVerifyHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	verification, err := auditLog.Verify()
+	if err != nil {
+		http.Error(w, "Failed to read audit log: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(verification)
+}
@@ -0,0 +1,496 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha512" // SHA-384 and SHA-512 for RS384/RS512/ES384/ES512
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Accepted clock skew when checking exp and nbf
+const jwtLeeway = time.Minute
+
+// JWKS sources are re-read this often unless JWKS_REFRESH says otherwise
+const defaultJWKSRefresh = 15 * time.Minute
+
+// A token with an unknown kid triggers at most one early JWKS refresh per
+// interval, so garbage tokens cannot hammer the identity provider
+const jwksMissRefresh = 30 * time.Second
+
+// Largest JWKS document accepted
+const maxJWKSBytes = 1 << 20
+
+// jwtAlgorithms maps the accepted signature algorithms to their hashes.
+// "none" and the HMAC algorithms are deliberately absent.
+var jwtAlgorithms = map[string]crypto.Hash{
+	"RS256": crypto.SHA256,
+	"RS384": crypto.SHA384,
+	"RS512": crypto.SHA512,
+	"ES256": crypto.SHA256,
+	"ES384": crypto.SHA384,
+	"ES512": crypto.SHA512,
+}
+
+// Curves for the ECDSA algorithms
+var jwtCurves = map[string]elliptic.Curve{
+	"ES256": elliptic.P256(),
+	"ES384": elliptic.P384(),
+	"ES512": elliptic.P521(),
+}
+
+// jwk is one verification key from a JWKS
+type jwk struct {
+	kid string
+	alg string
+	key crypto.PublicKey
+}
+
+// JWTVerifier validates bearer tokens against the keys of a JWKS file or URL
+// and maps their claims to API scopes
+type JWTVerifier struct {
+	mu       sync.RWMutex
+	source   string
+	remote   bool
+	keys     []jwk
+	fetched  time.Time
+	lastMiss time.Time
+	client   *http.Client
+
+	issuer   string
+	audience string
+	// scopeClaim is an extra claim, such as "roles", read besides the
+	// standard scope, scp and scopes claims
+	scopeClaim string
+	// scopeMap translates claim values to scopes; values that already are
+	// scopes need no entry
+	scopeMap map[string][]string
+}
+
+// Configured from JWKS_URL or JWKS_FILE; nil disables bearer tokens
+var jwtVerifier *JWTVerifier
+
+// loadJWTVerifier enables bearer token authentication when a JWKS is
+// configured. JWKS_FILE can point at a local stand-in for an identity
+// provider's JWKS endpoint.
+func loadJWTVerifier() {
+	source, remote := os.Getenv("JWKS_URL"), true
+	if source == "" {
+		source, remote = os.Getenv("JWKS_FILE"), false
+	}
+	if source == "" {
+		return
+	}
+
+	verifier := &JWTVerifier{
+		source:     source,
+		remote:     remote,
+		client:     &http.Client{Timeout: 10 * time.Second},
+		issuer:     os.Getenv("JWT_ISSUER"),
+		audience:   os.Getenv("JWT_AUDIENCE"),
+		scopeClaim: os.Getenv("JWT_SCOPE_CLAIM"),
+	}
+	if mapping := os.Getenv("JWT_SCOPE_MAP"); mapping != "" {
+		if err := json.Unmarshal([]byte(mapping), &verifier.scopeMap); err != nil {
+			log.Printf("⚠️ Ignoring invalid JWT_SCOPE_MAP: %v", err)
+		}
+		for value, scopes := range verifier.scopeMap {
+			for _, scope := range scopes {
+				if !validScope(scope) {
+					log.Printf("⚠️ JWT_SCOPE_MAP entry %q grants unknown scope %q", value, scope)
+				}
+			}
+		}
+	}
+	if err := verifier.Refresh(); err != nil {
+		// Keep the verifier: bearer tokens are rejected until a refresh works
+		log.Printf("⚠️ Failed to load JWKS from %s: %v", source, err)
+	}
+
+	refresh := defaultJWKSRefresh
+	if value := os.Getenv("JWKS_REFRESH"); value != "" {
+		if d, err := time.ParseDuration(value); err == nil && d > 0 {
+			refresh = d
+		} else {
+			log.Printf("⚠️ Ignoring invalid JWKS_REFRESH %q", value)
+		}
+	}
+	go func() {
+		for range time.Tick(refresh) {
+			if err := verifier.Refresh(); err != nil {
+				log.Printf("⚠️ JWKS refresh from %s failed: %v", source, err)
+			}
+		}
+	}()
+
+	jwtVerifier = verifier
+	log.Printf("🔑 Bearer token authentication enabled (%d keys from %s)", verifier.keyCount(), source)
+}
+
+func (v *JWTVerifier) keyCount() int {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	return len(v.keys)
+}
+
+// Refresh re-reads the JWKS. On failure the previous keys stay in use.
+func (v *JWTVerifier) Refresh() error {
+	var data []byte
+	if v.remote {
+		resp, err := v.client.Get(v.source)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("JWKS endpoint returned %s", resp.Status)
+		}
+		data, err = io.ReadAll(io.LimitReader(resp.Body, maxJWKSBytes))
+		if err != nil {
+			return err
+		}
+	} else {
+		var err error
+		data, err = os.ReadFile(v.source)
+		if err != nil {
+			return err
+		}
+	}
+
+	keys, err := parseJWKS(data)
+	if err != nil {
+		return err
+	}
+	v.mu.Lock()
+	v.keys = keys
+	v.fetched = time.Now()
+	v.mu.Unlock()
+	return nil
+}
+
+// parseJWKS reads the RSA and EC signing keys of a JWKS document. Keys of
+// other types or for encryption are skipped.
+func parseJWKS(data []byte) ([]jwk, error) {
+	var document struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Alg string `json:"alg"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &document); err != nil {
+		return nil, fmt.Errorf("invalid JWKS: %v", err)
+	}
+
+	var keys []jwk
+	for i, k := range document.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		var key crypto.PublicKey
+		var err error
+		switch k.Kty {
+		case "RSA":
+			key, err = parseRSAJWK(k.N, k.E)
+		case "EC":
+			key, err = parseECJWK(k.Crv, k.X, k.Y)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("JWKS key %d (kid %q): %v", i, k.Kid, err)
+		}
+		keys = append(keys, jwk{kid: k.Kid, alg: k.Alg, key: key})
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("JWKS has no usable signing keys")
+	}
+	return keys, nil
+}
+
+func decodeJWKInt(field, value string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil || len(b) == 0 {
+		return nil, fmt.Errorf("invalid %s", field)
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+func parseRSAJWK(n, e string) (*rsa.PublicKey, error) {
+	modulus, err := decodeJWKInt("n", n)
+	if err != nil {
+		return nil, err
+	}
+	exponent, err := decodeJWKInt("e", e)
+	if err != nil {
+		return nil, err
+	}
+	if modulus.BitLen() < 2048 {
+		return nil, fmt.Errorf("RSA key of %d bits is too short", modulus.BitLen())
+	}
+	if !exponent.IsInt64() || exponent.Int64() < 3 || exponent.Int64() > 1<<31-1 {
+		return nil, errors.New("invalid RSA exponent")
+	}
+	return &rsa.PublicKey{N: modulus, E: int(exponent.Int64())}, nil
+}
+
+func parseECJWK(crv, x, y string) (*ecdsa.PublicKey, error) {
+	var curve elliptic.Curve
+	switch crv {
+	case "P-256":
+		curve = elliptic.P256()
+	case "P-384":
+		curve = elliptic.P384()
+	case "P-521":
+		curve = elliptic.P521()
+	default:
+		return nil, fmt.Errorf("unsupported curve %q", crv)
+	}
+	px, err := decodeJWKInt("x", x)
+	if err != nil {
+		return nil, err
+	}
+	py, err := decodeJWKInt("y", y)
+	if err != nil {
+		return nil, err
+	}
+	if !curve.IsOnCurve(px, py) {
+		return nil, errors.New("point is not on the curve")
+	}
+	return &ecdsa.PublicKey{Curve: curve, X: px, Y: py}, nil
+}
+
+// candidates returns the keys that may have signed a token with the given
+// header. An unknown kid triggers one early refresh, in case the identity
+// provider rotated its keys.
+func (v *JWTVerifier) candidates(kid, alg string) []jwk {
+	match := func() []jwk {
+		v.mu.RLock()
+		defer v.mu.RUnlock()
+		var found []jwk
+		for _, k := range v.keys {
+			if (kid == "" || k.kid == kid) && (k.alg == "" || k.alg == alg) {
+				found = append(found, k)
+			}
+		}
+		return found
+	}
+	found := match()
+	if len(found) > 0 || kid == "" {
+		return found
+	}
+
+	v.mu.Lock()
+	due := time.Since(v.lastMiss) >= jwksMissRefresh
+	if due {
+		v.lastMiss = time.Now()
+	}
+	v.mu.Unlock()
+	if !due {
+		return nil
+	}
+	if err := v.Refresh(); err != nil {
+		log.Printf("⚠️ JWKS refresh for unknown kid %q failed: %v", kid, err)
+		return nil
+	}
+	return match()
+}
+
+// verifySignature checks a JWS signature with one key
+func verifySignature(key crypto.PublicKey, alg string, signed, signature []byte) bool {
+	hash := jwtAlgorithms[alg]
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if !strings.HasPrefix(alg, "RS") {
+			return false
+		}
+		return rsa.VerifyPKCS1v15(k, hash, digest, signature) == nil
+	case *ecdsa.PublicKey:
+		if jwtCurves[alg] != k.Curve {
+			return false
+		}
+		// JWS encodes ECDSA signatures as the fixed-size r || s
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		return ecdsa.Verify(k, digest, r, s)
+	}
+	return false
+}
+
+// Verify checks a compact JWT's signature and registered claims and returns
+// the identity it carries
+func (v *JWTVerifier) Verify(token string) (*Identity, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("invalid header: %v", err)
+	}
+	if _, ok := jwtAlgorithms[header.Alg]; !ok {
+		return nil, fmt.Errorf("unsupported algorithm %q", header.Alg)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("invalid signature encoding")
+	}
+
+	signed := []byte(parts[0] + "." + parts[1])
+	verified := false
+	for _, k := range v.candidates(header.Kid, header.Alg) {
+		if verifySignature(k.key, header.Alg, signed, signature) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, errors.New("signature verification failed")
+	}
+
+	var claims map[string]interface{}
+	if err := decodeJWTSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("invalid claims: %v", err)
+	}
+	if err := v.checkClaims(claims, time.Now()); err != nil {
+		return nil, err
+	}
+
+	subject, _ := claims["sub"].(string)
+	if subject == "" {
+		subject = "jwt"
+	}
+	return &Identity{
+		Subject: subject,
+		KeyID:   header.Kid,
+		Method:  "jwt",
+		Scopes:  v.scopes(claims),
+	}, nil
+}
+
+func decodeJWTSegment(segment string, target interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, target)
+}
+
+// checkClaims validates exp (required), nbf, and the configured issuer and
+// audience
+func (v *JWTVerifier) checkClaims(claims map[string]interface{}, now time.Time) error {
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return errors.New("token has no exp claim")
+	}
+	if now.Add(-jwtLeeway).After(time.Unix(int64(exp), 0)) {
+		return errors.New("token expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(jwtLeeway).Before(time.Unix(int64(nbf), 0)) {
+		return errors.New("token not valid yet")
+	}
+	if v.issuer != "" {
+		if iss, _ := claims["iss"].(string); iss != v.issuer {
+			return fmt.Errorf("unexpected issuer %q", iss)
+		}
+	}
+	if v.audience != "" && !containsClaimValue(claims["aud"], v.audience) {
+		return errors.New("token is not for this audience")
+	}
+	return nil
+}
+
+// claimValues reads a claim that is either a space-separated string or an
+// array of strings
+func claimValues(claim interface{}) []string {
+	switch c := claim.(type) {
+	case string:
+		return strings.Fields(c)
+	case []interface{}:
+		values := make([]string, 0, len(c))
+		for _, item := range c {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+func containsClaimValue(claim interface{}, want string) bool {
+	for _, value := range claimValues(claim) {
+		if value == want {
+			return true
+		}
+	}
+	return false
+}
+
+// scopes maps the token's scope claims to API scopes. Values are taken from
+// "scope", "scp", "scopes" and the configured JWT_SCOPE_CLAIM, translated by
+// JWT_SCOPE_MAP, and dropped if they are not known scopes.
+func (v *JWTVerifier) scopes(claims map[string]interface{}) []string {
+	names := []string{"scope", "scp", "scopes"}
+	if v.scopeClaim != "" {
+		names = append(names, v.scopeClaim)
+	}
+	seen := make(map[string]bool)
+	scopes := []string{}
+	add := func(scope string) {
+		if validScope(scope) && !seen[scope] {
+			seen[scope] = true
+			scopes = append(scopes, scope)
+		}
+	}
+	for _, name := range names {
+		for _, value := range claimValues(claims[name]) {
+			if mapped, ok := v.scopeMap[value]; ok {
+				for _, scope := range mapped {
+					add(scope)
+				}
+				continue
+			}
+			add(value)
+		}
+	}
+	return scopes
+}
+
+// presentedBearerToken reads a token from "Authorization: Bearer" or, for
+// WebSocket clients that cannot set headers, the access_token query parameter
+func presentedBearerToken(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return r.URL.Query().Get("access_token")
+}
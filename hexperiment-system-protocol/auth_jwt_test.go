@@ -0,0 +1,161 @@
+package main
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testJWTIssuer   = "https://issuer.test"
+	testJWTAudience = "hexperiment-test"
+	testJWTKid      = "test-key"
+)
+
+// testJWKS serves one RSA key as a JWKS and returns a verifier for it
+func testJWKS(t *testing.T) (*rsa.PrivateKey, *JWTVerifier) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwks, _ := json.Marshal(map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": testJWTKid,
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}},
+	})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(jwks)
+	}))
+	t.Cleanup(server.Close)
+
+	v := &JWTVerifier{
+		source:   server.URL,
+		remote:   true,
+		client:   server.Client(),
+		issuer:   testJWTIssuer,
+		audience: testJWTAudience,
+	}
+	if err := v.Refresh(); err != nil {
+		t.Fatalf("Refresh: %v", err)
+	}
+	return key, v
+}
+
+func testClaims() map[string]interface{} {
+	return map[string]interface{}{
+		"sub":   "tester",
+		"iss":   testJWTIssuer,
+		"aud":   testJWTAudience,
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"scope": "protocol:read",
+	}
+}
+
+func jwtSegment(t *testing.T, value interface{}) string {
+	t.Helper()
+	data, err := json.Marshal(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// signRS256 builds a token signed with the JWKS key
+func signRS256(t *testing.T, key *rsa.PrivateKey, claims map[string]interface{}) string {
+	t.Helper()
+	signed := jwtSegment(t, map[string]string{"alg": "RS256", "kid": testJWTKid, "typ": "JWT"}) + "." + jwtSegment(t, claims)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestJWTVerifyAcceptsValidToken(t *testing.T) {
+	key, v := testJWKS(t)
+	identity, err := v.Verify(signRS256(t, key, testClaims()))
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if identity.Subject != "tester" || identity.Method != "jwt" || identity.KeyID != testJWTKid {
+		t.Errorf("identity = %+v", identity)
+	}
+	if !identity.hasScope(scopeProtocolRead) {
+		t.Errorf("scopes = %v, want %s", identity.Scopes, scopeProtocolRead)
+	}
+}
+
+func TestJWTVerifyRejectsUnsignedAndHMACTokens(t *testing.T) {
+	key, v := testJWKS(t)
+	payload := jwtSegment(t, testClaims())
+
+	none := jwtSegment(t, map[string]string{"alg": "none", "typ": "JWT"}) + "." + payload + "."
+	if _, err := v.Verify(none); err == nil {
+		t.Error(`alg "none" token accepted`)
+	}
+
+	// The classic confusion attack: HMAC keyed with the public RSA key
+	signed := jwtSegment(t, map[string]string{"alg": "HS256", "kid": testJWTKid, "typ": "JWT"}) + "." + payload
+	mac := hmac.New(sha256.New, key.PublicKey.N.Bytes())
+	mac.Write([]byte(signed))
+	hs256 := signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+	if _, err := v.Verify(hs256); err == nil {
+		t.Error("HS256 token accepted")
+	}
+
+	// A valid signature moved onto other claims
+	valid := strings.Split(signRS256(t, key, testClaims()), ".")
+	claims := testClaims()
+	claims["scope"] = scopeAdmin
+	tampered := valid[0] + "." + jwtSegment(t, claims) + "." + valid[2]
+	if _, err := v.Verify(tampered); err == nil {
+		t.Error("tampered token accepted")
+	}
+}
+
+func TestJWTVerifyRejectsBadClaims(t *testing.T) {
+	key, v := testJWKS(t)
+	tests := []struct {
+		name   string
+		change func(map[string]interface{})
+	}{
+		{"expired", func(c map[string]interface{}) { c["exp"] = time.Now().Add(-time.Hour).Unix() }},
+		{"no exp", func(c map[string]interface{}) { delete(c, "exp") }},
+		{"wrong audience", func(c map[string]interface{}) { c["aud"] = "someone-else" }},
+		{"wrong issuer", func(c map[string]interface{}) { c["iss"] = "https://evil.test" }},
+		{"missing issuer", func(c map[string]interface{}) { delete(c, "iss") }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := testClaims()
+			tt.change(claims)
+			if _, err := v.Verify(signRS256(t, key, claims)); err == nil {
+				t.Errorf("%s token accepted", tt.name)
+			}
+		})
+	}
+
+	// Audiences may also be a list
+	claims := testClaims()
+	claims["aud"] = []string{"other", testJWTAudience}
+	if _, err := v.Verify(signRS256(t, key, claims)); err != nil {
+		t.Errorf("token with audience list rejected: %v", err)
+	}
+}
@@ -0,0 +1,574 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// API scopes. "admin" grants every scope and "persona:*" every persona scope.
+const (
+	scopeAdmin             = "admin"
+	scopeProtocolRead      = "protocol:read"
+	scopeProtocolBroadcast = "protocol:broadcast"
+	scopePersonaRead       = "persona:read"
+	scopePersonaWrite      = "persona:write"
+	scopeLMStudioChat      = "lmstudio:chat"
+	scopeJobsRead          = "jobs:read"
+	scopeJobsWrite         = "jobs:write"
+	scopeFlupsRead         = "flups:read"
+	scopeFlupsWrite        = "flups:write"
+	scopeProxyGitHub       = "proxy:github"
+	scopeProxyHuggingFace  = "proxy:huggingface"
+)
+
+var knownScopes = []string{
+	scopeAdmin, scopeProtocolRead, scopeProtocolBroadcast, scopePersonaRead, scopePersonaWrite,
+	scopeLMStudioChat, scopeJobsRead, scopeJobsWrite, scopeFlupsRead, scopeFlupsWrite,
+	scopeProxyGitHub, scopeProxyHuggingFace,
+}
+
+// Prefix of generated keys, so leaked keys are easy to recognize
+const apiKeyPrefix = "hxp_"
+
+// Rotated keys stay valid this long unless the request says otherwise
+const defaultRotationGrace = 24 * time.Hour
+
+// APIKey is a stored key. Only the SHA-256 hash of the secret is kept.
+type APIKey struct {
+	ID          string     `json:"id"`
+	Name        string     `json:"name"`
+	Prefix      string     `json:"prefix"`
+	Hash        string     `json:"hash"`
+	Scopes      []string   `json:"scopes"`
+	Created     time.Time  `json:"created"`
+	Expires     *time.Time `json:"expires,omitempty"`
+	Revoked     *time.Time `json:"revoked,omitempty"`
+	LastUsed    *time.Time `json:"lastUsed,omitempty"`
+	RotatedFrom string     `json:"rotatedFrom,omitempty"`
+}
+
+// active reports whether the key can be used at the given time
+func (k *APIKey) active(now time.Time) bool {
+	if k.Revoked != nil {
+		return false
+	}
+	return k.Expires == nil || now.Before(*k.Expires)
+}
+
+// public returns the key without its hash for API responses
+func (k *APIKey) public() map[string]interface{} {
+	return map[string]interface{}{
+		"id":          k.ID,
+		"name":        k.Name,
+		"prefix":      k.Prefix,
+		"scopes":      k.Scopes,
+		"created":     k.Created,
+		"expires":     k.Expires,
+		"revoked":     k.Revoked,
+		"lastUsed":    k.LastUsed,
+		"rotatedFrom": k.RotatedFrom,
+		"active":      k.active(time.Now()),
+	}
+}
+
+// Identity is the authenticated caller of a request
+type Identity struct {
+	Subject string   `json:"subject"`
+	KeyID   string   `json:"keyId,omitempty"`
+	Method  string   `json:"method"`
+	Scopes  []string `json:"scopes"`
+}
+
+// hasScope reports whether the identity grants a scope, directly, through
+// admin, or through a "group:*" wildcard
+func (id *Identity) hasScope(scope string) bool {
+	for _, s := range id.Scopes {
+		if s == scope || s == scopeAdmin {
+			return true
+		}
+		if strings.HasSuffix(s, ":*") && strings.HasPrefix(scope, strings.TrimSuffix(s, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+type identityContextKey struct{}
+
+// identityFromContext returns the caller attached by requireScope, if any
+func identityFromContext(ctx context.Context) (*Identity, bool) {
+	id, ok := ctx.Value(identityContextKey{}).(*Identity)
+	return id, ok
+}
+
+// KeyStore holds hashed API keys, persisted to a JSON file when it has a path
+type KeyStore struct {
+	mu     sync.RWMutex
+	path   string
+	keys   map[string]*APIKey
+	byHash map[string]*APIKey
+}
+
+var apiKeys = NewKeyStore("")
+
+// NewKeyStore creates an empty store; see Load
+func NewKeyStore(path string) *KeyStore {
+	return &KeyStore{path: path, keys: make(map[string]*APIKey), byHash: make(map[string]*APIKey)}
+}
+
+// loadAPIKeys opens API_KEYS_FILE and registers the legacy API_KEY as an
+// admin key named "env", so existing deployments keep working
+func loadAPIKeys() {
+	store := NewKeyStore(os.Getenv("API_KEYS_FILE"))
+	if err := store.Load(); err != nil {
+		log.Printf("⚠️ Failed to load API keys from %s: %v", store.path, err)
+	}
+	// The store is not shared yet, so no locking is needed
+	if legacy := os.Getenv("API_KEY"); legacy != "" {
+		store.addLocked(&APIKey{
+			ID:      "env",
+			Name:    "API_KEY",
+			Prefix:  keyDisplayPrefix(legacy),
+			Hash:    hashAPIKey(legacy),
+			Scopes:  []string{scopeAdmin},
+			Created: time.Now(),
+		})
+	}
+	apiKeys = store
+	if authOpen() {
+		log.Println("[SECURITY WARNING] No API keys, JWKS or client certificate identities configured. All requests are allowed. Set API_KEY, API_KEYS_FILE or JWKS_URL in production!")
+	}
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// keyDisplayPrefix is the part of a generated key safe to show in listings
+func keyDisplayPrefix(key string) string {
+	if strings.HasPrefix(key, apiKeyPrefix) && len(key) > len(apiKeyPrefix)+4 {
+		return key[:len(apiKeyPrefix)+4]
+	}
+	return ""
+}
+
+func generateSecret(bytes int) (string, error) {
+	b := make([]byte, bytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Load reads the key file; a missing file is an empty store
+func (s *KeyStore) Load() error {
+	if s.path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var keys []*APIKey
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, k := range keys {
+		s.addLocked(k)
+	}
+	return nil
+}
+
+func (s *KeyStore) addLocked(k *APIKey) {
+	s.keys[k.ID] = k
+	s.byHash[k.Hash] = k
+}
+
+// saveLocked writes every persisted key; the "env" key comes from the
+// environment and is never written
+func (s *KeyStore) saveLocked() error {
+	if s.path == "" {
+		return nil
+	}
+	keys := make([]*APIKey, 0, len(s.keys))
+	for _, k := range s.keys {
+		if k.ID != "env" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Created.Before(keys[j].Created) })
+	data, err := json.MarshalIndent(keys, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// Count returns the number of keys, including revoked and expired ones
+func (s *KeyStore) Count() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.keys)
+}
+
+// Create adds a key and returns it with its secret, which is not stored
+func (s *KeyStore) Create(name string, scopes []string, expires *time.Time) (*APIKey, string, error) {
+	if name == "" {
+		return nil, "", fmt.Errorf("name is required")
+	}
+	if len(scopes) == 0 {
+		return nil, "", fmt.Errorf("at least one scope is required")
+	}
+	for _, scope := range scopes {
+		if !validScope(scope) {
+			return nil, "", fmt.Errorf("unknown scope %q", scope)
+		}
+	}
+	random, err := generateSecret(32)
+	if err != nil {
+		return nil, "", err
+	}
+	secret := apiKeyPrefix + random
+	key := &APIKey{
+		ID:      fmt.Sprintf("key-%d", time.Now().UnixNano()),
+		Name:    name,
+		Prefix:  keyDisplayPrefix(secret),
+		Hash:    hashAPIKey(secret),
+		Scopes:  append([]string(nil), scopes...),
+		Created: time.Now(),
+		Expires: expires,
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.addLocked(key)
+	if err := s.saveLocked(); err != nil {
+		delete(s.keys, key.ID)
+		delete(s.byHash, key.Hash)
+		return nil, "", err
+	}
+	copied := *key
+	return &copied, secret, nil
+}
+
+func validScope(scope string) bool {
+	for _, known := range knownScopes {
+		if scope == known || (strings.HasSuffix(scope, ":*") && strings.HasPrefix(known, strings.TrimSuffix(scope, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+// List returns copies of all keys, oldest first
+func (s *KeyStore) List() []APIKey {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	keys := make([]APIKey, 0, len(s.keys))
+	for _, k := range s.keys {
+		keys = append(keys, *k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Created.Before(keys[j].Created) })
+	return keys
+}
+
+// Revoke disables a key immediately
+func (s *KeyStore) Revoke(id string) (*APIKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k, ok := s.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("key not found")
+	}
+	if id == "env" {
+		return nil, fmt.Errorf("the API_KEY key is managed through the environment")
+	}
+	if k.Revoked == nil {
+		now := time.Now()
+		k.Revoked = &now
+	}
+	copied := *k
+	return &copied, s.saveLocked()
+}
+
+// Rotate issues a replacement with the same name and scopes. The old key
+// keeps working for the grace period so clients can switch without downtime.
+func (s *KeyStore) Rotate(id string, grace time.Duration) (*APIKey, string, error) {
+	if id == "env" {
+		return nil, "", fmt.Errorf("the API_KEY key is managed through the environment")
+	}
+	s.mu.RLock()
+	old, ok := s.keys[id]
+	var current APIKey
+	if ok {
+		current = *old
+	}
+	s.mu.RUnlock()
+	if !ok {
+		return nil, "", fmt.Errorf("key not found")
+	}
+	if !current.active(time.Now()) {
+		return nil, "", fmt.Errorf("key is revoked or expired")
+	}
+
+	// The replacement gets the same lifetime the old key was issued with
+	var expires *time.Time
+	if current.Expires != nil {
+		next := time.Now().Add(current.Expires.Sub(current.Created))
+		expires = &next
+	}
+	key, secret, err := s.Create(current.Name, current.Scopes, expires)
+	if err != nil {
+		return nil, "", err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys[key.ID].RotatedFrom = id
+	key.RotatedFrom = id
+	cutoff := time.Now().Add(grace)
+	if old.Expires == nil || cutoff.Before(*old.Expires) {
+		old.Expires = &cutoff
+	}
+	return key, secret, s.saveLocked()
+}
+
+// Authenticate returns the identity for a presented secret
+func (s *KeyStore) Authenticate(secret string) (*Identity, bool) {
+	hash := hashAPIKey(secret)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k, ok := s.byHash[hash]
+	if !ok || !k.active(time.Now()) {
+		return nil, false
+	}
+	now := time.Now()
+	k.LastUsed = &now
+	return &Identity{
+		Subject: k.Name,
+		KeyID:   k.ID,
+		Method:  "api_key",
+		Scopes:  append([]string(nil), k.Scopes...),
+	}, true
+}
+
+// presentedAPIKey reads the key from X-API-Key or the api_key query parameter
+func presentedAPIKey(r *http.Request) string {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+	return r.URL.Query().Get("api_key")
+}
+
+// authOpen reports whether no credentials are configured at all
+func authOpen() bool {
+	return apiKeys.Count() == 0 && jwtVerifier == nil && len(clientCertRules) == 0
+}
+
+// authenticate identifies the caller of a request from a bearer token, an
+// API key or a client certificate. Without any configured keys or JWKS every request is allowed as an
+// anonymous admin, as before API keys were required.
+func authenticate(r *http.Request) (*Identity, bool) {
+	if authOpen() {
+		return &Identity{Subject: "anonymous", Method: "none", Scopes: []string{scopeAdmin}}, true
+	}
+	if jwtVerifier != nil {
+		if token := presentedBearerToken(r); token != "" {
+			return verifyBearerToken(token)
+		}
+	}
+	key := presentedAPIKey(r)
+	if key == "" {
+		// Explicit credentials take precedence over a client certificate
+		return clientCertIdentity(r)
+	}
+	return apiKeys.Authenticate(key)
+}
+
+// authenticateCredential checks a credential of unknown kind, as sent in a
+// WebSocket subprotocol or auth message: a JWT if bearer tokens are enabled
+// and it has three segments, otherwise an API key
+func authenticateCredential(credential string) (*Identity, bool) {
+	if authOpen() {
+		return &Identity{Subject: "anonymous", Method: "none", Scopes: []string{scopeAdmin}}, true
+	}
+	if credential == "" {
+		return nil, false
+	}
+	if jwtVerifier != nil && strings.Count(credential, ".") == 2 {
+		return verifyBearerToken(credential)
+	}
+	return apiKeys.Authenticate(credential)
+}
+
+func verifyBearerToken(token string) (*Identity, bool) {
+	identity, err := jwtVerifier.Verify(token)
+	if err != nil {
+		log.Printf("🔑 Rejected bearer token: %v", err)
+		return nil, false
+	}
+	return identity, true
+}
+
+// --- Security: scope-checking authentication middleware ---
+func requireScope(scope string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !rateLimits.allowIP(w, r) {
+			return
+		}
+		identity, ok := authenticate(r)
+		noteAuditIdentity(r, identity)
+		if !ok {
+			w.Header().Set("Content-Type", "application/json")
+			if jwtVerifier != nil {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="hexperiment"`)
+			}
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"error":"Unauthorized: missing or invalid credentials"}`))
+			return
+		}
+		if !identity.hasScope(scope) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"error": "Forbidden: missing scope " + scope,
+			})
+			return
+		}
+		if !rateLimits.allowKey(w, r, identity) {
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), identityContextKey{}, identity)))
+	})
+}
+
+// Key list handler
+func adminKeyListHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	keys := apiKeys.List()
+	listed := make([]map[string]interface{}, len(keys))
+	for i := range keys {
+		listed[i] = keys[i].public()
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"count":  len(listed),
+		"keys":   listed,
+		"scopes": knownScopes,
+	})
+}
+
+// Key create handler: returns the secret once; only its hash is stored
+func adminKeyCreateHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var request struct {
+		Name      string     `json:"name"`
+		Scopes    []string   `json:"scopes"`
+		ExpiresIn string     `json:"expiresIn"`
+		ExpiresAt *time.Time `json:"expiresAt"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	expires := request.ExpiresAt
+	if request.ExpiresIn != "" {
+		d, err := time.ParseDuration(request.ExpiresIn)
+		if err != nil || d <= 0 {
+			http.Error(w, "expiresIn must be a positive duration such as 720h", http.StatusBadRequest)
+			return
+		}
+		at := time.Now().Add(d)
+		expires = &at
+	}
+
+	key, secret, err := apiKeys.Create(request.Name, request.Scopes, expires)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Printf("🔑 API key %s (%s) created with scopes %v", key.ID, key.Name, key.Scopes)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"key":     key.public(),
+		"secret":  secret,
+	})
+}
+
+// Key revoke handler
+func adminKeyRevokeHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	key, err := apiKeys.Revoke(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	log.Printf("🛑 API key %s (%s) revoked", key.ID, key.Name)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"key":     key.public(),
+	})
+}
+
+// Key rotate handler: issues a replacement and lets the old key expire after
+// graceSeconds (default 24h; 0 expires it immediately)
+func adminKeyRotateHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var request struct {
+		GraceSeconds *int `json:"graceSeconds"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+	}
+	grace := defaultRotationGrace
+	if request.GraceSeconds != nil {
+		if *request.GraceSeconds < 0 {
+			http.Error(w, "graceSeconds must not be negative", http.StatusBadRequest)
+			return
+		}
+		grace = time.Duration(*request.GraceSeconds) * time.Second
+	}
+
+	id := mux.Vars(r)["id"]
+	key, secret, err := apiKeys.Rotate(id, grace)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Printf("🔑 API key %s rotated to %s; old key valid for %s", id, key.ID, grace)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"key":     key.public(),
+		"secret":  secret,
+	})
+}
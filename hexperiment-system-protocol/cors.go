@@ -0,0 +1,310 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// CORSRule is the cross-origin policy for a group of routes. Origins are
+// exact ("https://app.example.com"), "*", or patterns with one wildcard
+// label ("https://*.example.com"). In route rules, omitted fields inherit
+// the default rule; an empty origin list allows no cross-origin callers.
+type CORSRule struct {
+	Origins       []string `json:"origins"`
+	Methods       []string `json:"methods"`
+	Headers       []string `json:"headers"`
+	ExposeHeaders []string `json:"exposeHeaders"`
+	Credentials   *bool    `json:"credentials"`
+	// MaxAge is how many seconds browsers may cache a preflight
+	MaxAge *int `json:"maxAge"`
+}
+
+// CORSConfig is read from the JSON file named by CORS_POLICY. Routes are
+// keyed by path prefix; the longest matching prefix wins. The rule for
+// "/ws" also decides which origins may open WebSockets.
+type CORSConfig struct {
+	Default CORSRule            `json:"default"`
+	Routes  map[string]CORSRule `json:"routes"`
+}
+
+func corsBool(b bool) *bool { return &b }
+func corsInt(i int) *int    { return &i }
+
+var defaultCORSRule = CORSRule{
+	Origins:       []string{"*"},
+	Methods:       []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
+	Headers:       []string{"Content-Type", "Authorization", "X-API-Key"},
+	ExposeHeaders: []string{"Retry-After"},
+	Credentials:   corsBool(false),
+	MaxAge:        corsInt(600),
+}
+
+// CORSPolicy answers preflights and decorates responses for cross-origin
+// requests
+type CORSPolicy struct {
+	rules map[string]CORSRule
+	// prefixes of rules, longest first
+	prefixes []string
+}
+
+var corsPolicy, _ = NewCORSPolicy(CORSConfig{Default: defaultCORSRule})
+
+// loadCORSConfig reads CORS_POLICY. Without it, the older CORS_ALLOW_ORIGIN
+// and WEBSOCKET_ALLOWED_ORIGINS comma-separated lists are honoured.
+func loadCORSConfig() CORSConfig {
+	config := CORSConfig{Default: defaultCORSRule, Routes: map[string]CORSRule{}}
+	if path := os.Getenv("CORS_POLICY"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			log.Printf("⚠️ Failed to read CORS policy: %v", err)
+			return config
+		}
+		var custom CORSConfig
+		if err := json.Unmarshal(data, &custom); err != nil {
+			log.Printf("⚠️ Invalid CORS policy: %v", err)
+			return config
+		}
+		return custom
+	}
+
+	if origins := splitList(os.Getenv("CORS_ALLOW_ORIGIN")); origins != nil {
+		config.Default.Origins = origins
+	}
+	if origins := splitList(os.Getenv("WEBSOCKET_ALLOWED_ORIGINS")); origins != nil {
+		config.Routes["/ws"] = CORSRule{Origins: origins}
+	}
+	return config
+}
+
+// splitList splits a comma-separated setting, dropping empty entries
+func splitList(list string) []string {
+	var origins []string
+	for _, origin := range strings.Split(list, ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			origins = append(origins, origin)
+		}
+	}
+	return origins
+}
+
+// NewCORSPolicy validates a config, filling unset default fields from the
+// built-in defaults and unset route fields from the config's default
+func NewCORSPolicy(config CORSConfig) (*CORSPolicy, error) {
+	base := inheritCORSRule(config.Default, defaultCORSRule)
+	if err := base.validate(); err != nil {
+		return nil, fmt.Errorf("default: %v", err)
+	}
+	policy := &CORSPolicy{rules: map[string]CORSRule{"/": base}, prefixes: []string{"/"}}
+	for prefix, rule := range config.Routes {
+		if !strings.HasPrefix(prefix, "/") {
+			return nil, fmt.Errorf("route %q must start with /", prefix)
+		}
+		rule = inheritCORSRule(rule, base)
+		if err := rule.validate(); err != nil {
+			return nil, fmt.Errorf("route %s: %v", prefix, err)
+		}
+		if _, exists := policy.rules[prefix]; !exists {
+			policy.prefixes = append(policy.prefixes, prefix)
+		}
+		policy.rules[prefix] = rule
+	}
+	// Longest prefix first
+	for i := 1; i < len(policy.prefixes); i++ {
+		for j := i; j > 0 && len(policy.prefixes[j]) > len(policy.prefixes[j-1]); j-- {
+			policy.prefixes[j], policy.prefixes[j-1] = policy.prefixes[j-1], policy.prefixes[j]
+		}
+	}
+	return policy, nil
+}
+
+func inheritCORSRule(rule, parent CORSRule) CORSRule {
+	if rule.Origins == nil {
+		rule.Origins = parent.Origins
+	}
+	if rule.Methods == nil {
+		rule.Methods = parent.Methods
+	}
+	if rule.Headers == nil {
+		rule.Headers = parent.Headers
+	}
+	if rule.ExposeHeaders == nil {
+		rule.ExposeHeaders = parent.ExposeHeaders
+	}
+	if rule.Credentials == nil {
+		rule.Credentials = parent.Credentials
+	}
+	if rule.MaxAge == nil {
+		rule.MaxAge = parent.MaxAge
+	}
+	return rule
+}
+
+func (rule CORSRule) validate() error {
+	for _, origin := range rule.Origins {
+		if origin == "*" {
+			if rule.credentials() {
+				// Browsers reject credentialed responses for "*", and
+				// reflecting any origin with credentials is unsafe
+				return fmt.Errorf(`credentials cannot be allowed for origin "*"`)
+			}
+			continue
+		}
+		if strings.Count(origin, "*") > 1 {
+			return fmt.Errorf("origin pattern %q has more than one wildcard", origin)
+		}
+		if origin != "null" && !strings.Contains(origin, "://") {
+			return fmt.Errorf("origin %q needs a scheme, e.g. https://", origin)
+		}
+	}
+	return nil
+}
+
+func (rule CORSRule) credentials() bool {
+	return rule.Credentials != nil && *rule.Credentials
+}
+
+// wildcard reports whether any origin may call without credentials
+func (rule CORSRule) wildcard() bool {
+	return contains(rule.Origins, "*")
+}
+
+// allows reports whether an origin matches the rule
+func (rule CORSRule) allows(origin string) bool {
+	origin = strings.ToLower(origin)
+	for _, allowed := range rule.Origins {
+		allowed = strings.ToLower(allowed)
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+		if star := strings.Index(allowed, "*"); star >= 0 {
+			prefix, suffix := allowed[:star], allowed[star+1:]
+			if len(origin) > len(prefix)+len(suffix) && strings.HasPrefix(origin, prefix) && strings.HasSuffix(origin, suffix) {
+				// The wildcard covers subdomain labels only, never a port or path
+				if middle := origin[len(prefix) : len(origin)-len(suffix)]; !strings.ContainsAny(middle, "/:@") {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// rule returns the rule of the longest prefix matching a path
+func (p *CORSPolicy) rule(path string) CORSRule {
+	for _, prefix := range p.prefixes {
+		if strings.HasPrefix(path, prefix) {
+			return p.rules[prefix]
+		}
+	}
+	return p.rules["/"]
+}
+
+// Handler applies the policy in front of a handler. It must wrap the router
+// rather than run as route middleware, so preflights for routes that do not
+// accept OPTIONS are still answered.
+func (p *CORSPolicy) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rule := p.rule(r.URL.Path)
+		origin := r.Header.Get("Origin")
+		preflight := r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != ""
+
+		// Responses differ by origin unless every origin gets "*"
+		if !rule.wildcard() || rule.credentials() {
+			w.Header().Add("Vary", "Origin")
+		}
+		if preflight {
+			w.Header().Add("Vary", "Access-Control-Request-Method")
+			w.Header().Add("Vary", "Access-Control-Request-Headers")
+		}
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !rule.allows(origin) {
+			if preflight {
+				http.Error(w, "CORS origin not allowed", http.StatusForbidden)
+				return
+			}
+			// The browser hides the response without CORS headers
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if rule.wildcard() && !rule.credentials() {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		} else {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+		if rule.credentials() {
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		}
+
+		if !preflight {
+			if len(rule.ExposeHeaders) > 0 {
+				w.Header().Set("Access-Control-Expose-Headers", strings.Join(rule.ExposeHeaders, ", "))
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		method := r.Header.Get("Access-Control-Request-Method")
+		if !containsFold(rule.Methods, method) {
+			http.Error(w, "CORS method not allowed", http.StatusForbidden)
+			return
+		}
+		for _, header := range strings.Split(r.Header.Get("Access-Control-Request-Headers"), ",") {
+			if header = strings.TrimSpace(header); header != "" && !containsFold(rule.Headers, header) {
+				http.Error(w, "CORS header not allowed: "+header, http.StatusForbidden)
+				return
+			}
+		}
+		w.Header().Set("Access-Control-Allow-Methods", strings.Join(rule.Methods, ", "))
+		w.Header().Set("Access-Control-Allow-Headers", strings.Join(rule.Headers, ", "))
+		if rule.MaxAge != nil && *rule.MaxAge > 0 {
+			w.Header().Set("Access-Control-Max-Age", strconv.Itoa(*rule.MaxAge))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// CheckOrigin decides whether a WebSocket handshake may proceed. Non-browser
+// clients send no Origin and same-origin pages are always allowed.
+func (p *CORSPolicy) CheckOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	if p.rule(r.URL.Path).allows(origin) {
+		return true
+	}
+	log.Printf("[WebSocket] Rejected connection from origin: %s", origin)
+	return false
+}
+
+// loadCORSPolicy installs the configured policy, keeping the defaults if it
+// is invalid
+func loadCORSPolicy() {
+	policy, err := NewCORSPolicy(loadCORSConfig())
+	if err != nil {
+		log.Printf("⚠️ Invalid CORS policy: %v", err)
+		return
+	}
+	corsPolicy = policy
+	if policy.rule("/ws").wildcard() {
+		log.Println("[WebSocket] WARNING: Allowing all origins. Set WEBSOCKET_ALLOWED_ORIGINS or CORS_POLICY in production!")
+	}
+}
+
+// --- Security: CORS Middleware for cross-container and browser security ---
+func corsMiddleware(next http.Handler) http.Handler {
+	return corsPolicy.Handler(next)
+}
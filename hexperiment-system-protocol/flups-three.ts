@@ -1,25 +1,56 @@
 // Place this in an HTML file with three.js loaded
-const vertices = [
-  { x: 1, y: 1, z: 0, label: 'flup-plus' },
-  { x: -1, y: 1, z: 0, label: 'flup-minus' },
-  { x: 0, y: -1, z: 1, label: 'cflup-n' },
-];
-
-const edges = [
-  [0, 1],
-  [1, 2],
-  [2, 0],
-];
+// The lattice is served by the protocol server from flups.ini
+
+// Credentials for servers with API keys or JWKS configured: an API key or
+// token from window.HXP_TOKEN, <meta name="hxp-token">, or ?token= (removed
+// from the address bar once read). Without one the server must be open.
+const pageParams = new URLSearchParams(location.search);
+const token: string | null =
+  (window as any).HXP_TOKEN ??
+  document.querySelector('meta[name="hxp-token"]')?.getAttribute('content') ??
+  pageParams.get('token');
+if (pageParams.has('token')) {
+  pageParams.delete('token');
+  const query = pageParams.toString();
+  history.replaceState(null, '', location.pathname + (query ? `?${query}` : '') + location.hash);
+}
+
+// JWTs go in Authorization; the server reads API keys from X-API-Key
+function authHeaders(): Record<string, string> {
+  if (!token) return {};
+  return token.split('.').length === 3 ? { Authorization: `Bearer ${token}` } : { 'X-API-Key': token };
+}
+
+async function api(path: string) {
+  const response = await fetch(path, { headers: authHeaders() });
+  if (!response.ok) throw new Error(`${path}: ${response.status} ${response.statusText}`);
+  return response.json();
+}
+
+const graph = await api('/api/flups/graph');
+
+const vertices = graph.vertices.map((v) => ({ x: v.x, y: v.y, z: v.z, label: v.id }));
+const index = new Map(vertices.map((v, i) => [v.label, i]));
+const edges = graph.edges.map(([a, b]) => [index.get(a), index.get(b)]);
 
 // ...initialize three.js scene...
 
+const stateColors = {
+  idle: 0x00ff00,
+  active: 0xffaa00,
+  received: 0x00aaff,
+  processed: 0xff00ff,
+};
+
+const spheres = new Map();
 vertices.forEach((v) => {
   const sphere = new THREE.Mesh(
     new THREE.SphereGeometry(0.1),
-    new THREE.MeshBasicMaterial({ color: 0x00ff00 }),
+    new THREE.MeshBasicMaterial({ color: stateColors.idle }),
   );
   sphere.position.set(v.x, v.y, v.z);
   scene.add(sphere);
+  spheres.set(v.label, sphere);
   // Optionally add labels
 });
 
@@ -31,3 +62,28 @@ edges.forEach(([i, j]) => {
   const line = new THREE.Line(geometry, new THREE.LineBasicMaterial({ color: 0xffffff }));
   scene.add(line);
 });
+
+// Apply a simulation frame: colour nodes by state and scale them by energy
+function showFrame(frame) {
+  frame.nodes.forEach((n) => {
+    const sphere = spheres.get(n.id);
+    if (!sphere) return;
+    sphere.material.color.setHex(stateColors[n.state] ?? stateColors.idle);
+    sphere.scale.setScalar(1 + Math.sqrt(Math.max(n.energy, 0)));
+  });
+}
+
+// Start from the latest recorded time slice, then follow the live run
+const recorded = await api('/api/flups/sim/history');
+if (recorded.frames?.length) showFrame(recorded.frames[recorded.frames.length - 1]);
+
+const ws = new WebSocket(`${location.protocol === 'https:' ? 'wss' : 'ws'}://${location.host}/ws`);
+// Authenticate with the first message rather than the URL, which ends up
+// in access logs
+ws.onopen = () => {
+  if (token) ws.send(JSON.stringify({ type: 'auth', data: { token } }));
+};
+ws.onmessage = (event) => {
+  const message = JSON.parse(event.data);
+  if (message.type === 'flups_frame') showFrame(message.data);
+};
@@ -0,0 +1,251 @@
+package flups
+
+import (
+	"fmt"
+	"sort"
+)
+
+// PathAnalysis quantifies the efficiency claims of flups-hexagonal-mirror.md
+// for a graph: neighbour counts come from Metrics, hop counts from the
+// distribution of shortest path lengths, and parallelism from Throughput.
+type PathAnalysis struct {
+	Metrics Metrics `json:"metrics"`
+	// HopDistribution counts unordered node pairs by shortest path length
+	HopDistribution map[int]int `json:"hopDistribution"`
+	UnreachablePair int         `json:"unreachablePairs"`
+	AverageHops     float64     `json:"averageHops"`
+	// CellDiameters is the longest shortest path inside each lattice cell,
+	// using only edges within the cell
+	CellDiameters map[string]int `json:"cellDiameters,omitempty"`
+	Throughput    Throughput     `json:"throughput"`
+}
+
+// Throughput is how many transfers can happen in one action cycle if every
+// node sends at most once and receives at most once along its edges: a
+// maximum matching of senders to receivers. A triangle manages 3, one
+// mirrored hexagon 6.
+type Throughput struct {
+	Transfers int        `json:"transfers"`
+	PerNode   float64    `json:"perNode"`
+	Schedule  []Transfer `json:"schedule"`
+}
+
+// Transfer is one sender-receiver pair of a throughput schedule
+type Transfer struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// Flow is the result of a max-flow computation between two nodes. Every
+// edge carries Capacity in each direction.
+type Flow struct {
+	Source   string     `json:"source"`
+	Sink     string     `json:"sink"`
+	Capacity float64    `json:"capacity"`
+	Value    float64    `json:"value"`
+	Edges    []EdgeFlow `json:"edges"`
+	// MinCut lists the saturated edges separating source from sink
+	MinCut []Edge `json:"minCut"`
+}
+
+// EdgeFlow is the net flow along an edge in the direction From -> To
+type EdgeFlow struct {
+	From string  `json:"from"`
+	To   string  `json:"to"`
+	Flow float64 `json:"flow"`
+}
+
+// AnalyzePaths computes the path statistics and throughput of a graph
+func AnalyzePaths(g *Graph) PathAnalysis {
+	adj := g.Neighbors()
+	analysis := PathAnalysis{
+		Metrics:         ComputeMetrics(g),
+		HopDistribution: make(map[int]int),
+		Throughput:      ComputeThroughput(g),
+	}
+
+	total, pairs := 0, 0
+	for i, v := range g.Vertices {
+		dist := Distances(adj, v.ID)
+		for _, w := range g.Vertices[i+1:] {
+			d, ok := dist[w.ID]
+			if !ok {
+				analysis.UnreachablePair++
+				continue
+			}
+			analysis.HopDistribution[d]++
+			total += d
+			pairs++
+		}
+	}
+	if pairs > 0 {
+		analysis.AverageHops = float64(total) / float64(pairs)
+	}
+
+	// Per-cell diameters over each cell's own subgraph
+	cells := make(map[string]*Graph)
+	for _, v := range g.Vertices {
+		if prefix := CellPrefix(v.ID); prefix != "" {
+			if cells[prefix] == nil {
+				cells[prefix] = &Graph{}
+			}
+			cells[prefix].Vertices = append(cells[prefix].Vertices, v)
+		}
+	}
+	if len(cells) > 0 {
+		analysis.CellDiameters = make(map[string]int, len(cells))
+		for _, e := range g.Edges {
+			if a := CellPrefix(e[0]); a != "" && a == CellPrefix(e[1]) {
+				cells[a].Edges = append(cells[a].Edges, e)
+			}
+		}
+		for prefix, cell := range cells {
+			analysis.CellDiameters[prefix] = ComputeMetrics(cell).Diameter
+		}
+	}
+	return analysis
+}
+
+// ShortestPath returns a shortest path from one vertex to another, including
+// both ends. Ties are broken by neighbour order.
+func ShortestPath(g *Graph, from, to string) ([]string, error) {
+	for _, id := range []string{from, to} {
+		if _, ok := g.Vertex(id); !ok {
+			return nil, fmt.Errorf("unknown vertex %q", id)
+		}
+	}
+	adj := g.Neighbors()
+	parent := map[string]string{from: ""}
+	queue := []string{from}
+	for len(queue) > 0 && queue[0] != to {
+		current := queue[0]
+		queue = queue[1:]
+		for _, next := range adj[current] {
+			if _, seen := parent[next]; !seen {
+				parent[next] = current
+				queue = append(queue, next)
+			}
+		}
+	}
+	if _, ok := parent[to]; !ok {
+		return nil, fmt.Errorf("no path from %s to %s", from, to)
+	}
+	var path []string
+	for id := to; id != ""; id = parent[id] {
+		path = append([]string{id}, path...)
+	}
+	return path, nil
+}
+
+// ComputeThroughput finds a maximum matching of senders to receivers with
+// augmenting paths (Kuhn's algorithm)
+func ComputeThroughput(g *Graph) Throughput {
+	adj := g.Neighbors()
+	receiverOf := make(map[string]string) // receiver -> sender
+	var augment func(sender string, visited map[string]bool) bool
+	augment = func(sender string, visited map[string]bool) bool {
+		for _, receiver := range adj[sender] {
+			if visited[receiver] {
+				continue
+			}
+			visited[receiver] = true
+			current, taken := receiverOf[receiver]
+			if !taken || augment(current, visited) {
+				receiverOf[receiver] = sender
+				return true
+			}
+		}
+		return false
+	}
+	for _, v := range g.Vertices {
+		augment(v.ID, make(map[string]bool))
+	}
+
+	t := Throughput{Transfers: len(receiverOf), Schedule: []Transfer{}}
+	for _, v := range g.Vertices {
+		if sender, ok := receiverOf[v.ID]; ok {
+			t.Schedule = append(t.Schedule, Transfer{From: sender, To: v.ID})
+		}
+	}
+	sort.Slice(t.Schedule, func(i, j int) bool { return t.Schedule[i].From < t.Schedule[j].From })
+	if len(g.Vertices) > 0 {
+		t.PerNode = float64(t.Transfers) / float64(len(g.Vertices))
+	}
+	return t
+}
+
+// MaxFlow computes the maximum flow from source to sink with Edmonds-Karp,
+// treating every edge as a pair of opposite arcs of the given capacity
+func MaxFlow(g *Graph, source, sink string, capacity float64) (Flow, error) {
+	flow := Flow{Source: source, Sink: sink, Capacity: capacity, Edges: []EdgeFlow{}, MinCut: []Edge{}}
+	for _, id := range []string{source, sink} {
+		if _, ok := g.Vertex(id); !ok {
+			return flow, fmt.Errorf("unknown vertex %q", id)
+		}
+	}
+	if source == sink {
+		return flow, fmt.Errorf("source and sink must differ")
+	}
+	if capacity <= 0 {
+		return flow, fmt.Errorf("capacity must be positive")
+	}
+
+	type arc struct{ from, to string }
+	residual := make(map[arc]float64)
+	for _, e := range g.Edges {
+		residual[arc{e[0], e[1]}] += capacity
+		residual[arc{e[1], e[0]}] += capacity
+	}
+	adj := g.Neighbors()
+
+	for {
+		// Breadth-first search for the shortest augmenting path
+		parent := map[string]string{source: ""}
+		queue := []string{source}
+		for len(queue) > 0 && queue[0] != sink {
+			current := queue[0]
+			queue = queue[1:]
+			for _, next := range adj[current] {
+				if _, seen := parent[next]; !seen && residual[arc{current, next}] > 0 {
+					parent[next] = current
+					queue = append(queue, next)
+				}
+			}
+		}
+		if _, ok := parent[sink]; !ok {
+			// Nodes still reachable from the source form the cut's source side
+			for _, e := range g.Edges {
+				_, a := parent[e[0]]
+				_, b := parent[e[1]]
+				if a != b {
+					flow.MinCut = append(flow.MinCut, e)
+				}
+			}
+			break
+		}
+
+		bottleneck := -1.0
+		for id := sink; id != source; id = parent[id] {
+			if r := residual[arc{parent[id], id}]; bottleneck < 0 || r < bottleneck {
+				bottleneck = r
+			}
+		}
+		for id := sink; id != source; id = parent[id] {
+			residual[arc{parent[id], id}] -= bottleneck
+			residual[arc{id, parent[id]}] += bottleneck
+		}
+		flow.Value += bottleneck
+	}
+
+	// Net flow on an edge is how much its forward arc lost beyond the reverse
+	for _, e := range g.Edges {
+		net := (capacity - residual[arc{e[0], e[1]}] - (capacity - residual[arc{e[1], e[0]}])) / 2
+		switch {
+		case net > 0:
+			flow.Edges = append(flow.Edges, EdgeFlow{From: e[0], To: e[1], Flow: net})
+		case net < 0:
+			flow.Edges = append(flow.Edges, EdgeFlow{From: e[1], To: e[0], Flow: -net})
+		}
+	}
+	return flow, nil
+}
@@ -0,0 +1,169 @@
+package flups
+
+import (
+	"fmt"
+	"testing"
+)
+
+// testGraph builds a graph from its edges, plus any isolated vertices
+func testGraph(edges []Edge, isolated ...string) *Graph {
+	g := &Graph{Edges: edges}
+	seen := make(map[string]bool)
+	add := func(id string) {
+		if !seen[id] {
+			seen[id] = true
+			g.Vertices = append(g.Vertices, Vertex{ID: id, X: float64(len(g.Vertices))})
+		}
+	}
+	for _, e := range edges {
+		add(e[0])
+		add(e[1])
+	}
+	for _, id := range isolated {
+		add(id)
+	}
+	return g
+}
+
+// cycle returns the edges of a ring of n vertices v0..v(n-1)
+func cycle(n int) []Edge {
+	edges := make([]Edge, n)
+	for i := range edges {
+		edges[i] = Edge{fmt.Sprintf("v%d", i), fmt.Sprintf("v%d", (i+1)%n)}
+	}
+	return edges
+}
+
+var (
+	pathEdges     = []Edge{{"a", "b"}, {"b", "c"}}
+	starEdges     = []Edge{{"hub", "x"}, {"hub", "y"}, {"hub", "z"}}
+	completeEdges = []Edge{{"a", "b"}, {"a", "c"}, {"a", "d"}, {"b", "c"}, {"b", "d"}, {"c", "d"}}
+	// Two triangles joined by the single bridge c-d
+	bridgeEdges = []Edge{{"a", "b"}, {"b", "c"}, {"c", "a"}, {"c", "d"}, {"d", "e"}, {"e", "f"}, {"f", "d"}}
+)
+
+func TestComputeThroughput(t *testing.T) {
+	tests := []struct {
+		name  string
+		graph *Graph
+		want  int
+	}{
+		{"no edges", testGraph(nil, "a", "b"), 0},
+		{"single edge", testGraph([]Edge{{"a", "b"}}), 2},
+		{"path", testGraph(pathEdges), 2},
+		{"star", testGraph(starEdges), 2},
+		{"triangle", testGraph(cycle(3)), 3},
+		{"square", testGraph(cycle(4)), 4},
+		{"hexagon", testGraph(cycle(6)), 6},
+		{"complete graph", testGraph(completeEdges), 4},
+		{"bridged triangles", testGraph(bridgeEdges), 6},
+		{"edge and isolated vertex", testGraph([]Edge{{"a", "b"}}, "c"), 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ComputeThroughput(tt.graph)
+			if got.Transfers != tt.want || len(got.Schedule) != tt.want {
+				t.Fatalf("Transfers = %d with %d scheduled, want %d", got.Transfers, len(got.Schedule), tt.want)
+			}
+			if want := float64(tt.want) / float64(len(tt.graph.Vertices)); got.PerNode != want {
+				t.Errorf("PerNode = %v, want %v", got.PerNode, want)
+			}
+
+			// The schedule must be a matching along edges
+			adjacent := make(map[Edge]bool)
+			for _, e := range tt.graph.Edges {
+				adjacent[e.normalized()] = true
+			}
+			senders, receivers := make(map[string]bool), make(map[string]bool)
+			for _, tr := range got.Schedule {
+				if !adjacent[Edge{tr.From, tr.To}.normalized()] {
+					t.Errorf("transfer %s -> %s is not along an edge", tr.From, tr.To)
+				}
+				if senders[tr.From] || receivers[tr.To] {
+					t.Errorf("transfer %s -> %s reuses a sender or receiver", tr.From, tr.To)
+				}
+				senders[tr.From], receivers[tr.To] = true, true
+			}
+		})
+	}
+}
+
+func TestMaxFlow(t *testing.T) {
+	tests := []struct {
+		name         string
+		graph        *Graph
+		source, sink string
+		capacity     float64
+		want         float64
+	}{
+		{"single edge", testGraph([]Edge{{"a", "b"}}), "a", "b", 1, 1},
+		{"path", testGraph(pathEdges), "a", "c", 1, 1},
+		{"path reversed", testGraph(pathEdges), "c", "a", 1, 1},
+		{"triangle", testGraph(cycle(3)), "v0", "v1", 1, 2},
+		{"hexagon opposite corners", testGraph(cycle(6)), "v0", "v3", 1, 2},
+		{"star leaves", testGraph(starEdges), "x", "y", 1, 1},
+		{"complete graph", testGraph(completeEdges), "a", "d", 1, 3},
+		{"bridge bottleneck", testGraph(bridgeEdges), "a", "f", 1, 1},
+		{"fractional capacity", testGraph(cycle(3)), "v0", "v2", 2.5, 5},
+		{"disconnected", testGraph([]Edge{{"a", "b"}}, "c"), "a", "c", 1, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			flow, err := MaxFlow(tt.graph, tt.source, tt.sink, tt.capacity)
+			if err != nil {
+				t.Fatalf("MaxFlow: %v", err)
+			}
+			if flow.Value != tt.want {
+				t.Fatalf("Value = %v, want %v", flow.Value, tt.want)
+			}
+			// Max-flow min-cut: the cut's capacity equals the flow
+			if cut := float64(len(flow.MinCut)) * tt.capacity; cut != tt.want {
+				t.Errorf("MinCut %v has capacity %v, want %v", flow.MinCut, cut, tt.want)
+			}
+
+			// Edge flows respect capacity and are conserved at inner nodes
+			net := make(map[string]float64)
+			for _, e := range flow.Edges {
+				if e.Flow <= 0 || e.Flow > tt.capacity {
+					t.Errorf("edge %s -> %s carries %v", e.From, e.To, e.Flow)
+				}
+				net[e.From] -= e.Flow
+				net[e.To] += e.Flow
+			}
+			for _, v := range tt.graph.Vertices {
+				want := 0.0
+				switch v.ID {
+				case tt.source:
+					want = -tt.want
+				case tt.sink:
+					want = tt.want
+				}
+				if net[v.ID] != want {
+					t.Errorf("net flow into %s = %v, want %v", v.ID, net[v.ID], want)
+				}
+			}
+		})
+	}
+}
+
+func TestMaxFlowErrors(t *testing.T) {
+	g := testGraph(pathEdges)
+	tests := []struct {
+		name         string
+		source, sink string
+		capacity     float64
+	}{
+		{"unknown source", "x", "c", 1},
+		{"unknown sink", "a", "x", 1},
+		{"source is sink", "a", "a", 1},
+		{"zero capacity", "a", "c", 0},
+		{"negative capacity", "a", "c", -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := MaxFlow(g, tt.source, tt.sink, tt.capacity); err == nil {
+				t.Error("MaxFlow succeeded, want an error")
+			}
+		})
+	}
+}
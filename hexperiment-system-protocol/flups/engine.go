@@ -0,0 +1,449 @@
+package flups
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Node states
+const (
+	StateIdle      = "idle"
+	StateActive    = "active"
+	StateReceived  = "received"
+	StateProcessed = "processed"
+)
+
+// Action kinds. Each kind moves energy from one node to another and leaves
+// the target in a different state; halt stops the engine.
+const (
+	KindTransmit = "transmit"
+	KindProcess  = "process"
+	KindFeedback = "feedback"
+	KindHalt     = "halt"
+)
+
+// targetStates maps an action kind to the state it leaves the target node in
+var targetStates = map[string]string{
+	KindTransmit: StateReceived,
+	KindProcess:  StateProcessed,
+	KindFeedback: StateActive,
+}
+
+// NodeState is the mutable state of a vertex during a simulation
+type NodeState struct {
+	ID     string  `json:"id"`
+	Energy float64 `json:"energy"`
+	State  string  `json:"state"`
+}
+
+// Condition compares a node field against a value. Field is "energy"
+// (compared numerically) or "state" (compared as a string with == or !=).
+type Condition struct {
+	Node  string  `json:"node"`
+	Field string  `json:"field"`
+	Op    string  `json:"op"`
+	Value float64 `json:"value,omitempty"`
+	State string  `json:"state,omitempty"`
+}
+
+// ActionSpec is what a rule does when its conditions hold. A Duration of 0
+// (unset) is treated as 1.
+type ActionSpec struct {
+	Kind     string  `json:"kind"`
+	From     string  `json:"from,omitempty"`
+	To       string  `json:"to,omitempty"`
+	Amount   float64 `json:"amount,omitempty"`
+	Cost     float64 `json:"cost,omitempty"`
+	Duration int     `json:"duration,omitempty"`
+}
+
+// Rule fires its action when all conditions hold; higher priority rules are
+// queued first
+type Rule struct {
+	Name       string      `json:"name"`
+	Priority   int         `json:"priority"`
+	Conditions []Condition `json:"conditions"`
+	Action     ActionSpec  `json:"action"`
+}
+
+// Action is an executed (or queued) rule firing
+type Action struct {
+	Step      int     `json:"step"`
+	Rule      string  `json:"rule"`
+	Kind      string  `json:"kind"`
+	From      string  `json:"from,omitempty"`
+	To        string  `json:"to,omitempty"`
+	Amount    float64 `json:"amount"`
+	Cost      float64 `json:"cost,omitempty"`
+	Duration  int     `json:"duration"`
+	Phase     string  `json:"phase,omitempty"`
+	StartTime int     `json:"startTime"`
+	EndTime   int     `json:"endTime"`
+}
+
+// Engine is the action-driven virtual time engine: time only advances when
+// a rule fires, and freezes when no rule is valid
+type Engine struct {
+	graph  *Graph
+	nodes  map[string]*NodeState
+	order  []string
+	rules  []Rule
+	queue  []Action
+	time   int
+	steps  int
+	frozen bool
+	halted bool
+
+	// Phase-locked scheduling, see UsePhaseLock
+	phaseLock *phaseLock
+}
+
+// NewEngine creates an engine over a graph with the given initial node states
+func NewEngine(graph *Graph, initial []NodeState, rules []Rule) (*Engine, error) {
+	if err := ValidateRules(graph, rules); err != nil {
+		return nil, err
+	}
+	e := &Engine{
+		graph: graph,
+		nodes: make(map[string]*NodeState, len(graph.Vertices)),
+		rules: sortedRules(rules),
+	}
+	for _, v := range graph.Vertices {
+		e.nodes[v.ID] = &NodeState{ID: v.ID, State: StateIdle}
+		e.order = append(e.order, v.ID)
+	}
+	for _, n := range initial {
+		node, ok := e.nodes[n.ID]
+		if !ok {
+			return nil, fmt.Errorf("initial state for unknown node %q", n.ID)
+		}
+		node.Energy = n.Energy
+		if n.State != "" {
+			node.State = n.State
+		}
+	}
+	return e, nil
+}
+
+// ValidateRules checks that rules reference known nodes, fields and operators
+func ValidateRules(graph *Graph, rules []Rule) error {
+	var problems []string
+	known := func(id string) bool {
+		_, ok := graph.Vertex(id)
+		return ok
+	}
+	names := make(map[string]bool, len(rules))
+	for i, r := range rules {
+		name := r.Name
+		if name == "" {
+			problems = append(problems, fmt.Sprintf("rule %d has no name", i))
+			name = "(unnamed)"
+		} else if names[name] {
+			problems = append(problems, fmt.Sprintf("duplicate rule name %q", name))
+		}
+		names[name] = true
+		for _, c := range r.Conditions {
+			if !known(c.Node) {
+				problems = append(problems, fmt.Sprintf("rule %s: unknown node %q", name, c.Node))
+			}
+			switch c.Field {
+			case "energy":
+				if !validOp(c.Op) {
+					problems = append(problems, fmt.Sprintf("rule %s: invalid operator %q", name, c.Op))
+				}
+			case "state":
+				if c.Op != "==" && c.Op != "!=" {
+					problems = append(problems, fmt.Sprintf("rule %s: state only supports == and !=", name))
+				}
+			default:
+				problems = append(problems, fmt.Sprintf("rule %s: unknown field %q", name, c.Field))
+			}
+		}
+		a := r.Action
+		if a.Kind == KindHalt {
+			continue
+		}
+		if _, ok := targetStates[a.Kind]; !ok {
+			problems = append(problems, fmt.Sprintf("rule %s: unknown action %q", name, a.Kind))
+			continue
+		}
+		if !known(a.From) || !known(a.To) {
+			problems = append(problems, fmt.Sprintf("rule %s: action %s references unknown node", name, a.Kind))
+		}
+		if a.Amount < 0 || a.Cost < 0 || a.Duration < 0 {
+			problems = append(problems, fmt.Sprintf("rule %s: amount, cost and duration must not be negative", name))
+		}
+	}
+	if len(problems) > 0 {
+		return &ValidationError{Subject: "rules", Problems: problems}
+	}
+	return nil
+}
+
+func validOp(op string) bool {
+	switch op {
+	case ">", ">=", "<", "<=", "==", "!=":
+		return true
+	}
+	return false
+}
+
+// sortedRules orders rules by descending priority, keeping definition order for ties
+func sortedRules(rules []Rule) []Rule {
+	sorted := append([]Rule(nil), rules...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Priority > sorted[j].Priority
+	})
+	return sorted
+}
+
+// DefaultRules builds the R1-R3 cycle from flups-action-time.md over the
+// graph's vertices in order: the first vertex transmits to the second when
+// its energy exceeds the threshold, each following vertex processes onward,
+// and the last feeds back to the first. R0 (halt) is implicit: when no rule
+// is valid the engine freezes.
+func DefaultRules(graph *Graph, threshold, amount float64) []Rule {
+	n := len(graph.Vertices)
+	if n < 2 {
+		return nil
+	}
+	id := func(i int) string { return graph.Vertices[i%n].ID }
+
+	rules := []Rule{{
+		Name:     "R1-transmit",
+		Priority: 3,
+		Conditions: []Condition{
+			{Node: id(0), Field: "energy", Op: ">", Value: threshold},
+			{Node: id(0), Field: "state", Op: "==", State: StateActive},
+		},
+		Action: ActionSpec{Kind: KindTransmit, From: id(0), To: id(1), Amount: amount, Duration: 1},
+	}}
+	// The second vertex has received a transmission; later ones were handed a processed signal
+	waiting := func(i int) string {
+		if i == 1 {
+			return StateReceived
+		}
+		return StateProcessed
+	}
+	for i := 1; i < n-1; i++ {
+		rules = append(rules, Rule{
+			Name:       fmt.Sprintf("R2-process-%s", id(i)),
+			Priority:   2,
+			Conditions: []Condition{{Node: id(i), Field: "state", Op: "==", State: waiting(i)}},
+			Action:     ActionSpec{Kind: KindProcess, From: id(i), To: id(i + 1), Amount: amount, Duration: 1},
+		})
+	}
+	rules = append(rules, Rule{
+		Name:       "R3-feedback",
+		Priority:   1,
+		Conditions: []Condition{{Node: id(n - 1), Field: "state", Op: "==", State: waiting(n - 1)}},
+		Action:     ActionSpec{Kind: KindFeedback, From: id(n - 1), To: id(0), Amount: amount, Duration: 1},
+	})
+	return rules
+}
+
+// Step executes the next valid action. It returns nil when time is frozen.
+func (e *Engine) Step() *Action {
+	if e.halted {
+		return nil
+	}
+	for {
+		if len(e.queue) == 0 {
+			if e.phaseLock != nil {
+				e.queue = e.nextPhase()
+			} else {
+				e.queue = e.evaluate()
+			}
+			if len(e.queue) == 0 {
+				// No valid action: time stops
+				e.frozen = true
+				return nil
+			}
+		}
+
+		action := e.queue[0]
+		e.queue = e.queue[1:]
+		if !e.valid(action) {
+			continue
+		}
+		e.execute(&action)
+		e.frozen = false
+		return &action
+	}
+}
+
+// evaluate queues an action for every rule whose conditions hold
+func (e *Engine) evaluate() []Action {
+	var actions []Action
+	for _, r := range e.rules {
+		if !e.matches(r.Conditions) {
+			continue
+		}
+		duration := r.Action.Duration
+		if duration == 0 {
+			duration = 1
+		}
+		actions = append(actions, Action{
+			Rule:     r.Name,
+			Kind:     r.Action.Kind,
+			From:     r.Action.From,
+			To:       r.Action.To,
+			Amount:   r.Action.Amount,
+			Cost:     r.Action.Cost,
+			Duration: duration,
+		})
+	}
+	return actions
+}
+
+// valid re-checks a queued action against the current state, since earlier
+// actions in the queue may have changed it
+func (e *Engine) valid(a Action) bool {
+	for _, r := range e.rules {
+		if r.Name == a.Rule {
+			return e.matches(r.Conditions)
+		}
+	}
+	// Actions not produced by a rule (e.g. from a scheduler) are always valid
+	return true
+}
+
+func (e *Engine) matches(conditions []Condition) bool {
+	for _, c := range conditions {
+		node := e.nodes[c.Node]
+		if node == nil {
+			return false
+		}
+		var ok bool
+		if c.Field == "state" {
+			ok = (node.State == c.State) == (c.Op == "==")
+		} else {
+			ok = compare(node.Energy, c.Op, c.Value)
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func compare(a float64, op string, b float64) bool {
+	switch op {
+	case ">":
+		return a > b
+	case ">=":
+		return a >= b
+	case "<":
+		return a < b
+	case "<=":
+		return a <= b
+	case "==":
+		return a == b
+	case "!=":
+		return a != b
+	}
+	return false
+}
+
+// execute applies an action to the state and advances virtual time. Every
+// action takes at least one unit, as evaluate turns a duration of 0 into 1.
+func (e *Engine) execute(a *Action) {
+	e.steps++
+	a.Step = e.steps
+	a.StartTime = e.time
+	e.time += a.Duration
+	a.EndTime = e.time
+
+	if a.Kind == KindHalt {
+		e.halted = true
+		e.frozen = true
+		e.queue = nil
+		return
+	}
+
+	from, to := e.nodes[a.From], e.nodes[a.To]
+	// A node cannot give away more energy than it has
+	if a.Cost > from.Energy {
+		a.Cost = from.Energy
+	}
+	from.Energy -= a.Cost
+	if a.Amount > from.Energy {
+		a.Amount = from.Energy
+	}
+	from.Energy -= a.Amount
+	to.Energy += a.Amount
+	from.State = StateIdle
+	to.State = targetStates[a.Kind]
+}
+
+// SetRules replaces the rules, keeping node states, time and step count.
+// Pending actions of the old rules are discarded.
+func (e *Engine) SetRules(rules []Rule) error {
+	if err := ValidateRules(e.graph, rules); err != nil {
+		return err
+	}
+	e.rules = sortedRules(rules)
+	e.queue = nil
+	return nil
+}
+
+// take removes up to amount energy from a node and returns what was removed
+func (e *Engine) take(id string, amount float64) float64 {
+	node := e.nodes[id]
+	if amount > node.Energy {
+		amount = node.Energy
+	}
+	node.Energy -= amount
+	return amount
+}
+
+// give adds energy to a node from outside the engine and sets its state
+func (e *Engine) give(id string, amount float64, state string) {
+	node := e.nodes[id]
+	node.Energy += amount
+	node.State = state
+}
+
+// syncTime moves the clock forward to t if it is behind, as a Lamport clock
+// does on receiving a message
+func (e *Engine) syncTime(t int) {
+	if t > e.time {
+		e.time = t
+	}
+}
+
+// Time returns the virtual time, the sum of executed action durations
+func (e *Engine) Time() int { return e.time }
+
+// Steps returns the number of executed actions
+func (e *Engine) Steps() int { return e.steps }
+
+// Frozen reports whether no rule was valid on the last step
+func (e *Engine) Frozen() bool { return e.frozen }
+
+// Halted reports whether a halt action stopped the engine
+func (e *Engine) Halted() bool { return e.halted }
+
+// Queue returns the pending actions
+func (e *Engine) Queue() []Action { return append([]Action(nil), e.queue...) }
+
+// Rules returns the engine's rules in evaluation order
+func (e *Engine) Rules() []Rule { return append([]Rule(nil), e.rules...) }
+
+// Nodes returns a copy of every node state in vertex order
+func (e *Engine) Nodes() []NodeState {
+	nodes := make([]NodeState, len(e.order))
+	for i, id := range e.order {
+		nodes[i] = *e.nodes[id]
+	}
+	return nodes
+}
+
+// TotalEnergy sums the energy of all nodes
+func (e *Engine) TotalEnergy() float64 {
+	var total float64
+	for _, id := range e.order {
+		total += e.nodes[id].Energy
+	}
+	return total
+}
@@ -0,0 +1,157 @@
+// Package flups models the flups lattice: vertices with 3D coordinates joined
+// by undirected edges, as described in flups.ini.
+package flups
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Vertex is a flups node positioned in 3D space
+type Vertex struct {
+	ID string  `json:"id"`
+	X  float64 `json:"x"`
+	Y  float64 `json:"y"`
+	Z  float64 `json:"z"`
+}
+
+// Edge is an undirected connection between two vertex IDs, encoded as a
+// two-element JSON array
+type Edge [2]string
+
+// UnmarshalJSON rejects edges that do not have exactly two endpoints
+func (e *Edge) UnmarshalJSON(data []byte) error {
+	var ends []string
+	if err := json.Unmarshal(data, &ends); err != nil {
+		return fmt.Errorf("edge must be an array of vertex IDs: %v", err)
+	}
+	if len(ends) != 2 {
+		return fmt.Errorf("edge must have exactly 2 endpoints, got %d", len(ends))
+	}
+	e[0], e[1] = ends[0], ends[1]
+	return nil
+}
+
+// Graph is a flups lattice
+type Graph struct {
+	Vertices []Vertex `json:"vertices"`
+	Edges    []Edge   `json:"edges"`
+}
+
+// ValidationError lists every problem found in a graph, rule set or run directory
+type ValidationError struct {
+	Subject  string
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return "invalid flups " + e.Subject + ": " + strings.Join(e.Problems, "; ")
+}
+
+// Parse decodes and validates a graph in the flups.ini vertex/edge format
+func Parse(r io.Reader) (*Graph, error) {
+	var g Graph
+	decoder := json.NewDecoder(r)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&g); err != nil {
+		return nil, fmt.Errorf("failed to decode flups graph: %v", err)
+	}
+	if err := g.Validate(); err != nil {
+		return nil, err
+	}
+	return &g, nil
+}
+
+// Load reads and validates a graph file
+func Load(path string) (*Graph, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Parse(f)
+}
+
+// Validate checks for empty or duplicate vertex IDs, unknown edge endpoints,
+// self-loops and duplicate edges
+func (g *Graph) Validate() error {
+	var problems []string
+	if len(g.Vertices) == 0 {
+		problems = append(problems, "graph has no vertices")
+	}
+
+	ids := make(map[string]bool, len(g.Vertices))
+	for i, v := range g.Vertices {
+		switch {
+		case v.ID == "":
+			problems = append(problems, fmt.Sprintf("vertex %d has an empty id", i))
+		case ids[v.ID]:
+			problems = append(problems, fmt.Sprintf("duplicate vertex id %q", v.ID))
+		}
+		ids[v.ID] = true
+	}
+
+	seen := make(map[Edge]bool, len(g.Edges))
+	for i, e := range g.Edges {
+		for _, end := range e {
+			if !ids[end] {
+				problems = append(problems, fmt.Sprintf("edge %d references unknown vertex %q", i, end))
+			}
+		}
+		if e[0] == e[1] {
+			problems = append(problems, fmt.Sprintf("edge %d is a self-loop on %q", i, e[0]))
+		}
+		key := e.normalized()
+		if seen[key] {
+			problems = append(problems, fmt.Sprintf("duplicate edge %q-%q", e[0], e[1]))
+		}
+		seen[key] = true
+	}
+
+	if len(problems) > 0 {
+		return &ValidationError{Subject: "graph", Problems: problems}
+	}
+	return nil
+}
+
+// normalized orders the endpoints so undirected duplicates compare equal
+func (e Edge) normalized() Edge {
+	if e[1] < e[0] {
+		return Edge{e[1], e[0]}
+	}
+	return e
+}
+
+// Vertex returns the vertex with the given ID
+func (g *Graph) Vertex(id string) (Vertex, bool) {
+	for _, v := range g.Vertices {
+		if v.ID == id {
+			return v, true
+		}
+	}
+	return Vertex{}, false
+}
+
+// Neighbors returns the adjacency list of every vertex, in edge order
+func (g *Graph) Neighbors() map[string][]string {
+	adj := make(map[string][]string, len(g.Vertices))
+	for _, v := range g.Vertices {
+		adj[v.ID] = []string{}
+	}
+	for _, e := range g.Edges {
+		adj[e[0]] = append(adj[e[0]], e[1])
+		adj[e[1]] = append(adj[e[1]], e[0])
+	}
+	return adj
+}
+
+// Clone returns a deep copy of the graph
+func (g *Graph) Clone() *Graph {
+	return &Graph{
+		Vertices: append([]Vertex(nil), g.Vertices...),
+		Edges:    append([]Edge(nil), g.Edges...),
+	}
+}
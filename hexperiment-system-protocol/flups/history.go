@@ -0,0 +1,173 @@
+package flups
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+)
+
+// MaxHistoryFrames bounds the frames a simulator keeps; older frames are
+// dropped first
+const MaxHistoryFrames = 10000
+
+// FrameNode is one node of a frame as a point in 4D spacetime, with the
+// energy and state it had at that point
+type FrameNode struct {
+	ID     string  `json:"id"`
+	X      float64 `json:"x"`
+	Y      float64 `json:"y"`
+	Z      float64 `json:"z"`
+	T      int     `json:"t"`
+	Energy float64 `json:"energy"`
+	State  string  `json:"state"`
+}
+
+// Frame is the state of every node right after an action, the time slices
+// of flups-4d-visualization.md. Frame 0 is the initial state and has no
+// action.
+type Frame struct {
+	Step   int         `json:"step"`
+	Time   int         `json:"time"`
+	Action *Action     `json:"action,omitempty"`
+	Nodes  []FrameNode `json:"nodes"`
+}
+
+// newFrame places the engine's node states at their graph positions
+func newFrame(graph *Graph, e *Engine, action *Action) Frame {
+	frame := Frame{Step: e.Steps(), Time: e.Time(), Action: action}
+	for i, n := range e.Nodes() {
+		v := graph.Vertices[i]
+		frame.Nodes = append(frame.Nodes, FrameNode{
+			ID:     n.ID,
+			X:      v.X,
+			Y:      v.Y,
+			Z:      v.Z,
+			T:      frame.Time,
+			Energy: n.Energy,
+			State:  n.State,
+		})
+	}
+	return frame
+}
+
+// SliceFrames returns the frames with virtual time in [from, to]. A negative
+// to means no upper bound.
+func SliceFrames(frames []Frame, from, to int) []Frame {
+	sliced := []Frame{}
+	for _, f := range frames {
+		if f.Time >= from && (to < 0 || f.Time <= to) {
+			sliced = append(sliced, f)
+		}
+	}
+	return sliced
+}
+
+// FrameAt returns the last frame at or before virtual time t. Actions with
+// zero duration share a time, so this is the state once they all happened.
+func FrameAt(frames []Frame, t int) (Frame, bool) {
+	var found Frame
+	ok := false
+	for _, f := range frames {
+		if f.Time > t {
+			break
+		}
+		found, ok = f, true
+	}
+	return found, ok
+}
+
+// WriteNDJSON writes one frame per line
+func WriteNDJSON(w io.Writer, frames []Frame) error {
+	encoder := json.NewEncoder(w)
+	for _, f := range frames {
+		if err := encoder.Encode(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Binary history format, all integers little-endian:
+//
+//	magic "FLUP", version uint8
+//	node count uint32, then per node: ID length uint16, ID bytes, x, y, z float32
+//	state count uint8, then per state: name length uint8, name bytes
+//	frame count uint32, then per frame: step uint32, time uint32,
+//	    and per node in the order above: energy float32, state index uint8
+//
+// Positions are written once since they do not change during a run.
+const (
+	binaryHistoryMagic   = "FLUP"
+	binaryHistoryVersion = 1
+)
+
+// binaryStates lists the known node states first so their indexes are stable
+var binaryStates = []string{StateIdle, StateActive, StateReceived, StateProcessed}
+
+// WriteBinary writes frames in the compact binary history format. It fails
+// before writing anything if a vertex ID or state name is too long for its
+// length prefix, or if there are more states than the table can index.
+func WriteBinary(w io.Writer, graph *Graph, frames []Frame) error {
+	for _, v := range graph.Vertices {
+		if len(v.ID) > math.MaxUint16 {
+			return fmt.Errorf("vertex ID %.32q... is over %d bytes", v.ID, math.MaxUint16)
+		}
+	}
+
+	// Initial states may name custom states; append them to the table
+	states := append([]string(nil), binaryStates...)
+	stateIndex := make(map[string]uint8, len(states))
+	for i, s := range states {
+		stateIndex[s] = uint8(i)
+	}
+	for _, f := range frames {
+		for _, n := range f.Nodes {
+			if _, ok := stateIndex[n.State]; ok {
+				continue
+			}
+			if len(n.State) > math.MaxUint8 {
+				return fmt.Errorf("state %.32q... is over %d bytes", n.State, math.MaxUint8)
+			}
+			if len(states) == math.MaxUint8 {
+				return fmt.Errorf("more than %d distinct states", math.MaxUint8)
+			}
+			stateIndex[n.State] = uint8(len(states))
+			states = append(states, n.State)
+		}
+	}
+
+	bw := bufio.NewWriter(w)
+	le := binary.LittleEndian
+	write := func(v interface{}) {
+		binary.Write(bw, le, v)
+	}
+
+	bw.WriteString(binaryHistoryMagic)
+	write(uint8(binaryHistoryVersion))
+
+	write(uint32(len(graph.Vertices)))
+	for _, v := range graph.Vertices {
+		write(uint16(len(v.ID)))
+		bw.WriteString(v.ID)
+		write([3]float32{float32(v.X), float32(v.Y), float32(v.Z)})
+	}
+
+	write(uint8(len(states)))
+	for _, s := range states {
+		write(uint8(len(s)))
+		bw.WriteString(s)
+	}
+
+	write(uint32(len(frames)))
+	for _, f := range frames {
+		write([2]uint32{uint32(f.Step), uint32(f.Time)})
+		for _, n := range f.Nodes {
+			write(float32(n.Energy))
+			write(stateIndex[n.State])
+		}
+	}
+	return bw.Flush()
+}
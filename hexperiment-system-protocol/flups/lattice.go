@@ -0,0 +1,194 @@
+package flups
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// MirrorSuffix marks the mirrored copy of a base vertex
+const MirrorSuffix = "_m"
+
+// CellPrefix returns the "r{row}c{col}" cell a lattice vertex ID belongs
+// to, or "" for IDs without a cell prefix
+func CellPrefix(id string) string {
+	if i := strings.LastIndex(id, "/"); i >= 0 {
+		return id[:i]
+	}
+	return ""
+}
+
+// Limits on generated lattice size
+const (
+	MaxLatticeRows = 20
+	MaxLatticeCols = 20
+)
+
+// Cell is one hexagon of a lattice: the original triangle and its mirror
+type Cell struct {
+	Row      int      `json:"row"`
+	Col      int      `json:"col"`
+	Original []string `json:"original"`
+	Mirror   []string `json:"mirror"`
+}
+
+// Lattice is a tiled hexagonal mirror lattice. It encodes to the flups.ini
+// vertex/edge JSON with extra neighbour, cell and metric fields.
+type Lattice struct {
+	Graph
+	Neighbors map[string][]string `json:"neighbors"`
+	Cells     []Cell              `json:"cells"`
+	Metrics   Metrics             `json:"metrics"`
+}
+
+// MirrorLattice mirrors a base triangle into a six-node hexagon and tiles
+// it into a rows x cols lattice, as described in flups-hexagonal-mirror.md.
+//
+// Each hexagon holds the base vertices v0, v1, v2 and their mirrors, reflected
+// through the triangle's centroid in the xy-plane so the six nodes form a
+// hexagon. Besides the two triangles, each cell has the three cross
+// connections v0-m1, v1-m0 and v2-m2, giving nine edges and degree three.
+// Cells are laid out in offset rows and adjacent cells are joined by an edge
+// between their closest nodes.
+func MirrorLattice(base *Graph, rows, cols int) (*Lattice, error) {
+	if len(base.Vertices) != 3 || len(base.Edges) != 3 {
+		return nil, fmt.Errorf("base must be a triangle of 3 vertices and 3 edges")
+	}
+	if err := base.Validate(); err != nil {
+		return nil, err
+	}
+	if rows < 1 || cols < 1 || rows > MaxLatticeRows || cols > MaxLatticeCols {
+		return nil, fmt.Errorf("rows and cols must be between 1 and %d", MaxLatticeRows)
+	}
+
+	// Mirror through the centroid
+	var cx, cy float64
+	for _, v := range base.Vertices {
+		cx += v.X / 3
+		cy += v.Y / 3
+	}
+	mirror := make([]Vertex, 3)
+	for i, v := range base.Vertices {
+		mirror[i] = Vertex{ID: v.ID + MirrorSuffix, X: 2*cx - v.X, Y: 2*cy - v.Y, Z: v.Z}
+	}
+
+	// Cell pitch: the hexagon's extent plus one average edge length of spacing
+	hexagon := append(append([]Vertex(nil), base.Vertices...), mirror...)
+	minX, maxX, minY, maxY := bounds(hexagon)
+	spacing := averageEdgeLength(base)
+	pitchX := maxX - minX + spacing
+	pitchY := maxY - minY + spacing
+
+	lattice := &Lattice{}
+	single := rows == 1 && cols == 1
+	cellID := func(r, c int, id string) string {
+		if single {
+			return id
+		}
+		return fmt.Sprintf("r%dc%d/%s", r, c, id)
+	}
+
+	cells := make(map[[2]int][]Vertex)
+	for r := 0; r < rows; r++ {
+		for c := 0; c < cols; c++ {
+			offsetX := float64(c) * pitchX
+			if r%2 == 1 {
+				offsetX += pitchX / 2
+			}
+			offsetY := -float64(r) * pitchY
+
+			cell := Cell{Row: r, Col: c}
+			var nodes []Vertex
+			for i, v := range hexagon {
+				node := Vertex{ID: cellID(r, c, v.ID), X: v.X + offsetX, Y: v.Y + offsetY, Z: v.Z}
+				nodes = append(nodes, node)
+				if i < 3 {
+					cell.Original = append(cell.Original, node.ID)
+				} else {
+					cell.Mirror = append(cell.Mirror, node.ID)
+				}
+			}
+			lattice.Vertices = append(lattice.Vertices, nodes...)
+			lattice.Cells = append(lattice.Cells, cell)
+			cells[[2]int{r, c}] = nodes
+
+			for _, e := range base.Edges {
+				lattice.Edges = append(lattice.Edges,
+					Edge{cellID(r, c, e[0]), cellID(r, c, e[1])},
+					Edge{cellID(r, c, e[0]+MirrorSuffix), cellID(r, c, e[1]+MirrorSuffix)})
+			}
+			v0, v1, v2 := base.Vertices[0].ID, base.Vertices[1].ID, base.Vertices[2].ID
+			lattice.Edges = append(lattice.Edges,
+				Edge{cellID(r, c, v0), cellID(r, c, v1+MirrorSuffix)},
+				Edge{cellID(r, c, v1), cellID(r, c, v0+MirrorSuffix)},
+				Edge{cellID(r, c, v2), cellID(r, c, v2+MirrorSuffix)})
+		}
+	}
+
+	// Join neighbouring cells: right, and the cells below in the offset row
+	for r := 0; r < rows; r++ {
+		for c := 0; c < cols; c++ {
+			below := []int{c, c - 1}
+			if r%2 == 1 {
+				below = []int{c, c + 1}
+			}
+			neighbours := [][2]int{{r, c + 1}}
+			for _, bc := range below {
+				neighbours = append(neighbours, [2]int{r + 1, bc})
+			}
+			for _, n := range neighbours {
+				other, ok := cells[n]
+				if !ok {
+					continue
+				}
+				a, b := closestPair(cells[[2]int{r, c}], other)
+				lattice.Edges = append(lattice.Edges, Edge{a, b})
+			}
+		}
+	}
+
+	lattice.Neighbors = lattice.Graph.Neighbors()
+	lattice.Metrics = ComputeMetrics(&lattice.Graph)
+	return lattice, nil
+}
+
+func bounds(vertices []Vertex) (minX, maxX, minY, maxY float64) {
+	minX, minY = math.Inf(1), math.Inf(1)
+	maxX, maxY = math.Inf(-1), math.Inf(-1)
+	for _, v := range vertices {
+		minX, maxX = math.Min(minX, v.X), math.Max(maxX, v.X)
+		minY, maxY = math.Min(minY, v.Y), math.Max(maxY, v.Y)
+	}
+	return minX, maxX, minY, maxY
+}
+
+func averageEdgeLength(g *Graph) float64 {
+	var total float64
+	for _, e := range g.Edges {
+		a, _ := g.Vertex(e[0])
+		b, _ := g.Vertex(e[1])
+		total += distance(a, b)
+	}
+	if total == 0 {
+		return 1
+	}
+	return total / float64(len(g.Edges))
+}
+
+func distance(a, b Vertex) float64 {
+	return math.Sqrt((a.X-b.X)*(a.X-b.X) + (a.Y-b.Y)*(a.Y-b.Y) + (a.Z-b.Z)*(a.Z-b.Z))
+}
+
+// closestPair returns the IDs of the nearest nodes of two cells
+func closestPair(a, b []Vertex) (string, string) {
+	best := math.Inf(1)
+	var from, to string
+	for _, u := range a {
+		for _, v := range b {
+			if d := distance(u, v); d < best {
+				best, from, to = d, u.ID, v.ID
+			}
+		}
+	}
+	return from, to
+}
@@ -0,0 +1,68 @@
+package flups
+
+// Metrics summarizes the shape of a graph
+type Metrics struct {
+	Nodes         int     `json:"nodes"`
+	Edges         int     `json:"edges"`
+	AverageDegree float64 `json:"averageDegree"`
+	MinDegree     int     `json:"minDegree"`
+	MaxDegree     int     `json:"maxDegree"`
+	Diameter      int     `json:"diameter"`
+	Connected     bool    `json:"connected"`
+}
+
+// ComputeMetrics returns degree statistics and the diameter (the longest
+// shortest path, measured within components if the graph is disconnected)
+func ComputeMetrics(g *Graph) Metrics {
+	adj := g.Neighbors()
+	m := Metrics{
+		Nodes:     len(g.Vertices),
+		Edges:     len(g.Edges),
+		Connected: true,
+	}
+	if m.Nodes == 0 {
+		return m
+	}
+
+	m.MinDegree = len(g.Edges) * 2
+	for _, v := range g.Vertices {
+		d := len(adj[v.ID])
+		if d < m.MinDegree {
+			m.MinDegree = d
+		}
+		if d > m.MaxDegree {
+			m.MaxDegree = d
+		}
+	}
+	m.AverageDegree = float64(2*m.Edges) / float64(m.Nodes)
+
+	for _, v := range g.Vertices {
+		dist := Distances(adj, v.ID)
+		if len(dist) < m.Nodes {
+			m.Connected = false
+		}
+		for _, d := range dist {
+			if d > m.Diameter {
+				m.Diameter = d
+			}
+		}
+	}
+	return m
+}
+
+// Distances returns the hop count from source to every reachable vertex
+func Distances(adj map[string][]string, source string) map[string]int {
+	dist := map[string]int{source: 0}
+	queue := []string{source}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		for _, next := range adj[current] {
+			if _, seen := dist[next]; !seen {
+				dist[next] = dist[current] + 1
+				queue = append(queue, next)
+			}
+		}
+	}
+	return dist
+}
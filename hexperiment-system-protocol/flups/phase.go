@@ -0,0 +1,150 @@
+package flups
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Schedulers decide which actions the engine queues
+const (
+	SchedulerRules       = "rules"
+	SchedulerPhaseLocked = "phase-locked"
+)
+
+// PhaseLabels names the six 60° phases of flups-hexagonal-mirror.md: the
+// original triangle's nodes A, B, C transmit in turn, then the mirror
+// triangle's nodes A', B', C' process and transmit back
+var PhaseLabels = [6]string{"A", "B", "C", "A'", "B'", "C'"}
+
+// phaseCell is one hexagon of a mirror lattice with each node's cross partner
+type phaseCell struct {
+	original []string
+	mirror   []string
+	partner  map[string]string
+}
+
+type phaseLock struct {
+	cells     []phaseCell
+	amount    float64
+	threshold float64
+	next      int
+}
+
+// UsePhaseLock switches the engine from rule evaluation to the six-phase
+// locked schedule. The graph must be a mirror lattice as produced by
+// MirrorLattice. In each phase the scheduled node of every cell sends amount
+// energy across its cross connection if it holds at least that much and more
+// than the threshold; all cells act simultaneously, so a phase takes one
+// unit of virtual time.
+func (e *Engine) UsePhaseLock(amount, threshold float64) error {
+	cells, err := mirrorCells(e.graph)
+	if err != nil {
+		return err
+	}
+	e.phaseLock = &phaseLock{cells: cells, amount: amount, threshold: threshold}
+	return nil
+}
+
+// Phase returns the label of the next phase, or "" when not phase-locked
+func (e *Engine) Phase() string {
+	if e.phaseLock == nil {
+		return ""
+	}
+	return PhaseLabels[e.phaseLock.next]
+}
+
+// nextPhase returns the actions of the next phase in which any node can
+// transmit, skipping silent phases. A full silent cycle freezes the engine.
+func (e *Engine) nextPhase() []Action {
+	pl := e.phaseLock
+	for tries := 0; tries < len(PhaseLabels); tries++ {
+		phase := pl.next
+		pl.next = (pl.next + 1) % len(PhaseLabels)
+
+		var actions []Action
+		for _, cell := range pl.cells {
+			kind, from := KindTransmit, ""
+			if phase < 3 {
+				from = cell.original[phase]
+			} else {
+				kind, from = KindProcess, cell.mirror[phase-3]
+			}
+			node := e.nodes[from]
+			if node.Energy < pl.amount || node.Energy <= pl.threshold {
+				continue
+			}
+			duration := 0
+			if len(actions) == 0 {
+				duration = 1
+			}
+			actions = append(actions, Action{
+				Rule:     "phase-" + PhaseLabels[phase],
+				Kind:     kind,
+				From:     from,
+				To:       cell.partner[from],
+				Amount:   pl.amount,
+				Duration: duration,
+				Phase:    PhaseLabels[phase],
+			})
+		}
+		if len(actions) > 0 {
+			return actions
+		}
+	}
+	return nil
+}
+
+// mirrorCells groups a mirror lattice's vertices by cell (the ID prefix up
+// to the last "/") and pairs every node with its cross-connected partner
+func mirrorCells(g *Graph) ([]phaseCell, error) {
+	byPrefix := make(map[string]*phaseCell)
+	var prefixes []string
+	for _, v := range g.Vertices {
+		prefix := CellPrefix(v.ID)
+		cell, ok := byPrefix[prefix]
+		if !ok {
+			cell = &phaseCell{partner: make(map[string]string)}
+			byPrefix[prefix] = cell
+			prefixes = append(prefixes, prefix)
+		}
+		if strings.HasSuffix(v.ID, MirrorSuffix) {
+			cell.mirror = append(cell.mirror, v.ID)
+		} else {
+			cell.original = append(cell.original, v.ID)
+		}
+	}
+
+	mirrored := func(id string) bool { return strings.HasSuffix(id, MirrorSuffix) }
+	for _, edge := range g.Edges {
+		a, b := edge[0], edge[1]
+		if CellPrefix(a) != CellPrefix(b) || mirrored(a) == mirrored(b) {
+			continue
+		}
+		cell := byPrefix[CellPrefix(a)]
+		cell.partner[a] = b
+		cell.partner[b] = a
+	}
+
+	cells := make([]phaseCell, 0, len(prefixes))
+	for _, prefix := range prefixes {
+		cell := byPrefix[prefix]
+		name := prefix
+		if name == "" {
+			name = "(root)"
+		}
+		if len(cell.original) != 3 || len(cell.mirror) != 3 {
+			return nil, fmt.Errorf("cell %s is not a mirrored hexagon (need 3 original and 3 %s nodes)", name, MirrorSuffix)
+		}
+		// Order mirrors to match their originals so phase k' mirrors phase k
+		for i, id := range cell.original {
+			cell.mirror[i] = id + MirrorSuffix
+		}
+		for _, id := range append(append([]string(nil), cell.original...), cell.mirror...) {
+			if cell.partner[id] == "" {
+				return nil, fmt.Errorf("node %s has no cross connection in cell %s", id, name)
+			}
+		}
+		cells = append(cells, *cell)
+	}
+	return cells, nil
+}
@@ -0,0 +1,270 @@
+package flups
+
+import (
+	"fmt"
+	"html"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"math"
+	"strings"
+)
+
+// Projections map a vertex to the drawing plane
+const (
+	ProjectionXY  = "xy"
+	ProjectionXZ  = "xz"
+	ProjectionYZ  = "yz"
+	ProjectionIso = "iso"
+)
+
+// Limits on rendered image size; a PNG at the maximum is rasterised in
+// 16 MiB of memory
+const (
+	MaxRenderSize     = 2048
+	defaultRenderSize = 600
+)
+
+// RenderOptions controls a 2D rendering of a graph
+type RenderOptions struct {
+	Width      int    `json:"width"`
+	Height     int    `json:"height"`
+	Projection string `json:"projection"`
+	// Labels draws vertex IDs and energies; SVG only
+	Labels bool `json:"labels"`
+}
+
+// Node roles drawn as in the phase diagrams of flups-hexagonal-mirror.md:
+// ● active/transmitting, ○ receiving/processing
+const (
+	roleIdle         = "idle"
+	roleTransmitting = "transmitting"
+	roleReceiving    = "receiving"
+)
+
+var roleColors = map[string]color.RGBA{
+	roleIdle:         {0x9e, 0x9e, 0x9e, 0xff},
+	roleTransmitting: {0xff, 0x6b, 0x35, 0xff},
+	roleReceiving:    {0x35, 0x9b, 0xff, 0xff},
+}
+
+var (
+	renderBackground = color.RGBA{0x11, 0x14, 0x1b, 0xff}
+	renderEdge       = color.RGBA{0x5c, 0x63, 0x70, 0xff}
+	renderActiveEdge = color.RGBA{0xff, 0xd1, 0x66, 0xff}
+)
+
+// renderNode is a vertex placed in image coordinates
+type renderNode struct {
+	id     string
+	x, y   float64
+	role   string
+	energy float64
+}
+
+// withDefaults validates options and fills unset fields
+func (o RenderOptions) withDefaults() (RenderOptions, error) {
+	if o.Width == 0 {
+		o.Width = defaultRenderSize
+	}
+	if o.Height == 0 {
+		o.Height = defaultRenderSize
+	}
+	if o.Width < 16 || o.Height < 16 || o.Width > MaxRenderSize || o.Height > MaxRenderSize {
+		return o, fmt.Errorf("width and height must be between 16 and %d", MaxRenderSize)
+	}
+	switch o.Projection {
+	case "":
+		o.Projection = ProjectionXY
+	case ProjectionXY, ProjectionXZ, ProjectionYZ, ProjectionIso:
+	default:
+		return o, fmt.Errorf("unknown projection %q (expected xy, xz, yz or iso)", o.Projection)
+	}
+	return o, nil
+}
+
+func project(v Vertex, projection string) (float64, float64) {
+	switch projection {
+	case ProjectionXZ:
+		return v.X, v.Z
+	case ProjectionYZ:
+		return v.Y, v.Z
+	case ProjectionIso:
+		// Isometric: x and y recede at 30°, z is up
+		return (v.X - v.Y) * math.Cos(math.Pi/6), v.Z + (v.X+v.Y)*math.Sin(math.Pi/6)
+	}
+	return v.X, v.Y
+}
+
+// layout projects the graph into image coordinates with a margin and
+// assigns every node its role in the frame (all idle without a frame)
+func layout(g *Graph, frame *Frame, o RenderOptions) (map[string]*renderNode, []*renderNode, float64) {
+	nodes := make(map[string]*renderNode, len(g.Vertices))
+	ordered := make([]*renderNode, 0, len(g.Vertices))
+	minX, minY := math.Inf(1), math.Inf(1)
+	maxX, maxY := math.Inf(-1), math.Inf(-1)
+	for _, v := range g.Vertices {
+		x, y := project(v, o.Projection)
+		n := &renderNode{id: v.ID, x: x, y: y, role: roleIdle}
+		nodes[v.ID] = n
+		ordered = append(ordered, n)
+		minX, maxX = math.Min(minX, x), math.Max(maxX, x)
+		minY, maxY = math.Min(minY, y), math.Max(maxY, y)
+	}
+
+	radius := math.Max(4, math.Min(float64(o.Width), float64(o.Height))/40)
+	margin := radius * 3
+	spanX, spanY := maxX-minX, maxY-minY
+	if spanX == 0 {
+		spanX = 1
+	}
+	if spanY == 0 {
+		spanY = 1
+	}
+	scale := math.Min((float64(o.Width)-2*margin)/spanX, (float64(o.Height)-2*margin)/spanY)
+	offsetX := (float64(o.Width) - scale*(maxX-minX)) / 2
+	offsetY := (float64(o.Height) - scale*(maxY-minY)) / 2
+	for _, n := range ordered {
+		// Image y grows downwards
+		n.x = offsetX + (n.x-minX)*scale
+		n.y = float64(o.Height) - (offsetY + (n.y-minY)*scale)
+	}
+
+	if frame != nil {
+		for _, fn := range frame.Nodes {
+			n := nodes[fn.ID]
+			if n == nil {
+				continue
+			}
+			n.energy = fn.Energy
+			switch fn.State {
+			case StateActive:
+				n.role = roleTransmitting
+			case StateReceived, StateProcessed:
+				n.role = roleReceiving
+			}
+		}
+		if a := frame.Action; a != nil && a.Kind != KindHalt {
+			if n := nodes[a.From]; n != nil {
+				n.role = roleTransmitting
+			}
+			if n := nodes[a.To]; n != nil {
+				n.role = roleReceiving
+			}
+		}
+	}
+	return nodes, ordered, radius
+}
+
+// activeEdge reports whether an edge carried the frame's action
+func activeEdge(e Edge, frame *Frame) bool {
+	if frame == nil || frame.Action == nil {
+		return false
+	}
+	a := frame.Action
+	return (e[0] == a.From && e[1] == a.To) || (e[0] == a.To && e[1] == a.From)
+}
+
+func hexColor(c color.RGBA) string {
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
+
+// RenderSVG draws a 2D projection of a graph, coloured by a simulation frame
+// if one is given
+func RenderSVG(w io.Writer, g *Graph, frame *Frame, options RenderOptions) error {
+	o, err := options.withDefaults()
+	if err != nil {
+		return err
+	}
+	nodes, ordered, radius := layout(g, frame, o)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d">`+"\n", o.Width, o.Height, o.Width, o.Height)
+	fmt.Fprintf(&b, `<rect width="100%%" height="100%%" fill="%s"/>`+"\n", hexColor(renderBackground))
+	for _, e := range g.Edges {
+		a, c := nodes[e[0]], nodes[e[1]]
+		stroke, width := renderEdge, radius/4
+		if activeEdge(e, frame) {
+			stroke, width = renderActiveEdge, radius/2
+		}
+		fmt.Fprintf(&b, `<line x1="%.1f" y1="%.1f" x2="%.1f" y2="%.1f" stroke="%s" stroke-width="%.1f"/>`+"\n",
+			a.x, a.y, c.x, c.y, hexColor(stroke), width)
+	}
+	for _, n := range ordered {
+		c := hexColor(roleColors[n.role])
+		fill := c
+		if n.role == roleReceiving {
+			fill = hexColor(renderBackground)
+		}
+		fmt.Fprintf(&b, `<circle cx="%.1f" cy="%.1f" r="%.1f" fill="%s" stroke="%s" stroke-width="%.1f"><title>%s</title></circle>`+"\n",
+			n.x, n.y, radius, fill, c, radius/3, html.EscapeString(n.id))
+		if o.Labels {
+			label := n.id
+			if frame != nil {
+				label = fmt.Sprintf("%s (%s)", n.id, formatNumber(n.energy))
+			}
+			fmt.Fprintf(&b, `<text x="%.1f" y="%.1f" fill="#e0e0e0" font-family="sans-serif" font-size="%.0f" text-anchor="middle">%s</text>`+"\n",
+				n.x, n.y-radius*1.6, radius*1.4, html.EscapeString(label))
+		}
+	}
+	if frame != nil {
+		fmt.Fprintf(&b, `<text x="%.0f" y="%.0f" fill="#e0e0e0" font-family="sans-serif" font-size="%.0f">t=%d step=%d</text>`+"\n",
+			radius, radius*2.5, radius*1.6, frame.Time, frame.Step)
+	}
+	b.WriteString("</svg>\n")
+	_, err = io.WriteString(w, b.String())
+	return err
+}
+
+// RenderPNG rasterizes the same drawing as RenderSVG, without text
+func RenderPNG(w io.Writer, g *Graph, frame *Frame, options RenderOptions) error {
+	o, err := options.withDefaults()
+	if err != nil {
+		return err
+	}
+	nodes, ordered, radius := layout(g, frame, o)
+
+	img := image.NewRGBA(image.Rect(0, 0, o.Width, o.Height))
+	for i := 0; i < len(img.Pix); i += 4 {
+		img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3] = renderBackground.R, renderBackground.G, renderBackground.B, renderBackground.A
+	}
+	for _, e := range g.Edges {
+		a, c := nodes[e[0]], nodes[e[1]]
+		stroke, width := renderEdge, radius/8
+		if activeEdge(e, frame) {
+			stroke, width = renderActiveEdge, radius/4
+		}
+		drawLine(img, a.x, a.y, c.x, c.y, width, stroke)
+	}
+	for _, n := range ordered {
+		c := roleColors[n.role]
+		fillDisc(img, n.x, n.y, radius, c)
+		if n.role == roleReceiving {
+			fillDisc(img, n.x, n.y, radius*2/3, renderBackground)
+		}
+	}
+	return png.Encode(w, img)
+}
+
+// fillDisc paints a filled circle
+func fillDisc(img *image.RGBA, cx, cy, r float64, c color.RGBA) {
+	for y := int(cy - r); y <= int(cy+r)+1; y++ {
+		for x := int(cx - r); x <= int(cx+r)+1; x++ {
+			dx, dy := float64(x)+0.5-cx, float64(y)+0.5-cy
+			if dx*dx+dy*dy <= r*r {
+				img.SetRGBA(x, y, c)
+			}
+		}
+	}
+}
+
+// drawLine paints a line of the given half-width by stamping discs along it
+func drawLine(img *image.RGBA, x0, y0, x1, y1, halfWidth float64, c color.RGBA) {
+	halfWidth = math.Max(halfWidth, 0.75)
+	steps := int(math.Ceil(math.Hypot(x1-x0, y1-y0)/halfWidth)) + 1
+	for i := 0; i <= steps; i++ {
+		t := float64(i) / float64(steps)
+		fillDisc(img, x0+(x1-x0)*t, y0+(y1-y0)*t, halfWidth, c)
+	}
+}
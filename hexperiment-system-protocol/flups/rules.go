@@ -0,0 +1,419 @@
+package flups
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// The rule language writes the rule table of flups-action-time.md as text:
+//
+//	# R1: charged flup+ transmits to flup-
+//	rule R1 priority 3:
+//	    if flup-plus.energy > 1 and flup-plus.state == active
+//	    then transmit(flup-plus -> flup-minus, amount=1, cost=0) duration 1
+//
+//	rule R0: if cflup-n.energy >= 10 then halt
+//
+// A rule starts with "rule NAME", optionally followed by "priority N", and a
+// colon. Conditions compare NODE.energy with a number (>, >=, <, <=, ==, !=)
+// or NODE.state with a state name (== or !=), joined by "and"; the "if"
+// clause may be omitted for unconditional rules. Actions are transmit,
+// process and feedback with "FROM -> TO" (or →) and optional amount and
+// cost, or halt. "duration N" sets the virtual time the action takes,
+// at least 1, which is also the default.
+// Comments start with # or //.
+
+// ParseError reports the position of a syntax error
+type ParseError struct {
+	Line int
+	Col  int
+	Msg  string
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("line %d, col %d: %s", e.Line, e.Col, e.Msg)
+}
+
+type tokenKind int
+
+const (
+	tokWord tokenKind = iota
+	tokSymbol
+	tokEOF
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	line int
+	col  int
+}
+
+// isWordRune reports whether r can appear in node IDs, keywords and numbers
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune("_-+/.'", r)
+}
+
+func tokenize(src string) ([]token, error) {
+	var tokens []token
+	runes := []rune(src)
+	line, col := 1, 1
+	advance := func(n int) {
+		for i := 0; i < n; i++ {
+			if runes[0] == '\n' {
+				line++
+				col = 1
+			} else {
+				col++
+			}
+			runes = runes[1:]
+		}
+	}
+
+	for len(runes) > 0 {
+		r := runes[0]
+		switch {
+		case r == '#' || (r == '/' && len(runes) > 1 && runes[1] == '/'):
+			for len(runes) > 0 && runes[0] != '\n' {
+				advance(1)
+			}
+		case unicode.IsSpace(r):
+			advance(1)
+		case r == '→':
+			tokens = append(tokens, token{tokSymbol, "->", line, col})
+			advance(1)
+		case r == '-' && len(runes) > 1 && runes[1] == '>':
+			tokens = append(tokens, token{tokSymbol, "->", line, col})
+			advance(2)
+		case strings.ContainsRune("<>=!", r):
+			text := string(r)
+			if len(runes) > 1 && runes[1] == '=' {
+				text += "="
+			}
+			if text == "!" {
+				return nil, &ParseError{line, col, "unexpected '!'"}
+			}
+			tokens = append(tokens, token{tokSymbol, text, line, col})
+			advance(len([]rune(text)))
+		case strings.ContainsRune("():,", r):
+			tokens = append(tokens, token{tokSymbol, string(r), line, col})
+			advance(1)
+		case isWordRune(r):
+			startLine, startCol := line, col
+			var b strings.Builder
+			for len(runes) > 0 && isWordRune(runes[0]) {
+				// Stop before an arrow so "a->b" splits into a, ->, b
+				if runes[0] == '-' && len(runes) > 1 && runes[1] == '>' {
+					break
+				}
+				b.WriteRune(runes[0])
+				advance(1)
+			}
+			tokens = append(tokens, token{tokWord, b.String(), startLine, startCol})
+		default:
+			return nil, &ParseError{line, col, fmt.Sprintf("unexpected character %q", r)}
+		}
+	}
+	tokens = append(tokens, token{tokEOF, "", line, col})
+	return tokens, nil
+}
+
+type ruleParser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *ruleParser) peek() token { return p.tokens[p.pos] }
+
+func (p *ruleParser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *ruleParser) errorf(t token, format string, args ...interface{}) error {
+	return &ParseError{t.line, t.col, fmt.Sprintf(format, args...)}
+}
+
+// isKeyword reports whether the next token is the given keyword
+func (p *ruleParser) isKeyword(keyword string) bool {
+	t := p.peek()
+	return t.kind == tokWord && strings.EqualFold(t.text, keyword)
+}
+
+func (p *ruleParser) expectKeyword(keyword string) error {
+	t := p.next()
+	if t.kind != tokWord || !strings.EqualFold(t.text, keyword) {
+		return p.errorf(t, "expected %q, got %q", keyword, t.text)
+	}
+	return nil
+}
+
+func (p *ruleParser) expectSymbol(symbol string) error {
+	t := p.next()
+	if t.kind != tokSymbol || t.text != symbol {
+		return p.errorf(t, "expected %q, got %q", symbol, t.text)
+	}
+	return nil
+}
+
+func (p *ruleParser) word(what string) (token, error) {
+	t := p.next()
+	if t.kind != tokWord {
+		return t, p.errorf(t, "expected %s, got %q", what, t.text)
+	}
+	return t, nil
+}
+
+func (p *ruleParser) number(what string) (float64, error) {
+	t, err := p.word(what)
+	if err != nil {
+		return 0, err
+	}
+	v, err := strconv.ParseFloat(t.text, 64)
+	if err != nil {
+		return 0, p.errorf(t, "expected %s, got %q", what, t.text)
+	}
+	return v, nil
+}
+
+func (p *ruleParser) integer(what string) (int, error) {
+	t, err := p.word(what)
+	if err != nil {
+		return 0, err
+	}
+	v, err := strconv.Atoi(t.text)
+	if err != nil {
+		return 0, p.errorf(t, "expected %s, got %q", what, t.text)
+	}
+	return v, nil
+}
+
+// ParseRules parses rule language source into rules. Node references are
+// not checked; use ValidateRules against a graph for that.
+func ParseRules(src string) ([]Rule, error) {
+	tokens, err := tokenize(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &ruleParser{tokens: tokens}
+	var rules []Rule
+	for p.peek().kind != tokEOF {
+		rule, err := p.rule()
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func (p *ruleParser) rule() (Rule, error) {
+	var rule Rule
+	if err := p.expectKeyword("rule"); err != nil {
+		return rule, err
+	}
+	name, err := p.word("rule name")
+	if err != nil {
+		return rule, err
+	}
+	rule.Name = name.text
+
+	if p.isKeyword("priority") {
+		p.next()
+		if rule.Priority, err = p.integer("priority"); err != nil {
+			return rule, err
+		}
+	}
+	if err := p.expectSymbol(":"); err != nil {
+		return rule, err
+	}
+
+	if p.isKeyword("if") {
+		p.next()
+		for {
+			condition, err := p.condition()
+			if err != nil {
+				return rule, err
+			}
+			rule.Conditions = append(rule.Conditions, condition)
+			if !p.isKeyword("and") {
+				break
+			}
+			p.next()
+		}
+	}
+
+	if err := p.expectKeyword("then"); err != nil {
+		return rule, err
+	}
+	if rule.Action, err = p.action(); err != nil {
+		return rule, err
+	}
+	if p.isKeyword("duration") {
+		p.next()
+		if rule.Action.Duration, err = p.integer("duration"); err != nil {
+			return rule, err
+		}
+	}
+	return rule, nil
+}
+
+func (p *ruleParser) condition() (Condition, error) {
+	var c Condition
+	parens := false
+	if t := p.peek(); t.kind == tokSymbol && t.text == "(" {
+		p.next()
+		parens = true
+	}
+
+	ref, err := p.word("NODE.field")
+	if err != nil {
+		return c, err
+	}
+	dot := strings.LastIndex(ref.text, ".")
+	if dot <= 0 || dot == len(ref.text)-1 {
+		return c, p.errorf(ref, "expected NODE.energy or NODE.state, got %q", ref.text)
+	}
+	c.Node, c.Field = ref.text[:dot], strings.ToLower(ref.text[dot+1:])
+
+	op := p.next()
+	if op.kind != tokSymbol || !validOp(op.text) {
+		return c, p.errorf(op, "expected comparison operator, got %q", op.text)
+	}
+	c.Op = op.text
+
+	switch c.Field {
+	case "energy":
+		if c.Value, err = p.number("energy value"); err != nil {
+			return c, err
+		}
+	case "state":
+		if c.Op != "==" && c.Op != "!=" {
+			return c, p.errorf(op, "state only supports == and !=")
+		}
+		state, err := p.word("state name")
+		if err != nil {
+			return c, err
+		}
+		c.State = strings.ToLower(state.text)
+	default:
+		return c, p.errorf(ref, "unknown field %q (expected energy or state)", c.Field)
+	}
+
+	if parens {
+		if err := p.expectSymbol(")"); err != nil {
+			return c, err
+		}
+	}
+	return c, nil
+}
+
+func (p *ruleParser) action() (ActionSpec, error) {
+	var a ActionSpec
+	kind, err := p.word("action")
+	if err != nil {
+		return a, err
+	}
+	a.Kind = strings.ToLower(kind.text)
+	if a.Kind == KindHalt {
+		return a, nil
+	}
+	if _, ok := targetStates[a.Kind]; !ok {
+		return a, p.errorf(kind, "unknown action %q (expected transmit, process, feedback or halt)", kind.text)
+	}
+
+	if err := p.expectSymbol("("); err != nil {
+		return a, err
+	}
+	from, err := p.word("source node")
+	if err != nil {
+		return a, err
+	}
+	if err := p.expectSymbol("->"); err != nil {
+		return a, err
+	}
+	to, err := p.word("target node")
+	if err != nil {
+		return a, err
+	}
+	a.From, a.To = from.text, to.text
+
+	for positional := 0; ; positional++ {
+		t := p.next()
+		if t.kind == tokSymbol && t.text == ")" {
+			return a, nil
+		}
+		if t.kind != tokSymbol || t.text != "," {
+			return a, p.errorf(t, "expected ',' or ')', got %q", t.text)
+		}
+
+		// Either amount=N, cost=N, or a bare amount
+		arg := p.peek()
+		key := "amount"
+		if arg.kind == tokWord && p.tokens[p.pos+1].kind == tokSymbol && p.tokens[p.pos+1].text == "=" {
+			key = strings.ToLower(arg.text)
+			p.next()
+			p.next()
+		} else if positional > 0 {
+			return a, p.errorf(arg, "only the first argument may omit its name")
+		}
+		value, err := p.number(key)
+		if err != nil {
+			return a, err
+		}
+		switch key {
+		case "amount":
+			a.Amount = value
+		case "cost":
+			a.Cost = value
+		default:
+			return a, p.errorf(arg, "unknown argument %q (expected amount or cost)", key)
+		}
+	}
+}
+
+// FormatRules renders rules back into the rule language
+func FormatRules(rules []Rule) string {
+	var b strings.Builder
+	for i, r := range rules {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		fmt.Fprintf(&b, "rule %s priority %d:\n", r.Name, r.Priority)
+		if len(r.Conditions) > 0 {
+			parts := make([]string, len(r.Conditions))
+			for j, c := range r.Conditions {
+				if c.Field == "state" {
+					parts[j] = fmt.Sprintf("%s.state %s %s", c.Node, c.Op, c.State)
+				} else {
+					parts[j] = fmt.Sprintf("%s.energy %s %s", c.Node, c.Op, formatNumber(c.Value))
+				}
+			}
+			fmt.Fprintf(&b, "    if %s\n", strings.Join(parts, " and "))
+		}
+		a := r.Action
+		if a.Kind == KindHalt {
+			b.WriteString("    then halt")
+		} else {
+			fmt.Fprintf(&b, "    then %s(%s -> %s, amount=%s", a.Kind, a.From, a.To, formatNumber(a.Amount))
+			if a.Cost != 0 {
+				fmt.Fprintf(&b, ", cost=%s", formatNumber(a.Cost))
+			}
+			b.WriteString(")")
+		}
+		if a.Duration != 0 {
+			fmt.Fprintf(&b, " duration %d", a.Duration)
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+func formatNumber(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,146 @@
+package flups
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// The example from the rule language documentation
+const exampleRules = `# R1: charged flup+ transmits to flup-
+rule R1 priority 3:
+    if flup-plus.energy > 1 and flup-plus.state == active
+    then transmit(flup-plus -> flup-minus, amount=1, cost=0) duration 1
+
+rule R0: if cflup-n.energy >= 10 then halt
+`
+
+func TestParseRules(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want []Rule
+	}{
+		{
+			name: "documented example",
+			src:  exampleRules,
+			want: []Rule{
+				{
+					Name:     "R1",
+					Priority: 3,
+					Conditions: []Condition{
+						{Node: "flup-plus", Field: "energy", Op: ">", Value: 1},
+						{Node: "flup-plus", Field: "state", Op: "==", State: StateActive},
+					},
+					Action: ActionSpec{Kind: KindTransmit, From: "flup-plus", To: "flup-minus", Amount: 1, Duration: 1},
+				},
+				{
+					Name:       "R0",
+					Conditions: []Condition{{Node: "cflup-n", Field: "energy", Op: ">=", Value: 10}},
+					Action:     ActionSpec{Kind: KindHalt},
+				},
+			},
+		},
+		{
+			name: "unconditional with bare amount and unicode arrow",
+			src:  "rule pump: then process(a → b, 2.5)",
+			want: []Rule{{Name: "pump", Action: ActionSpec{Kind: KindProcess, From: "a", To: "b", Amount: 2.5}}},
+		},
+		{
+			name: "arrow without spaces, named cost, comments",
+			src: `// feedback loop
+rule F priority -1: if (b.energy != 0) then feedback(b->a, 1, cost=0.5) # trailing
+`,
+			want: []Rule{{
+				Name:       "F",
+				Priority:   -1,
+				Conditions: []Condition{{Node: "b", Field: "energy", Op: "!=", Value: 0}},
+				Action:     ActionSpec{Kind: KindFeedback, From: "b", To: "a", Amount: 1, Cost: 0.5},
+			}},
+		},
+		{
+			name: "keywords and fields are case-insensitive",
+			src:  "RULE X PRIORITY 2: IF n.State != Idle AND n.ENERGY <= 3 THEN HALT DURATION 4",
+			want: []Rule{{
+				Name:     "X",
+				Priority: 2,
+				Conditions: []Condition{
+					{Node: "n", Field: "state", Op: "!=", State: StateIdle},
+					{Node: "n", Field: "energy", Op: "<=", Value: 3},
+				},
+				Action: ActionSpec{Kind: KindHalt, Duration: 4},
+			}},
+		},
+		{
+			name: "empty source",
+			src:  "# nothing here\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseRules(tt.src)
+			if err != nil {
+				t.Fatalf("ParseRules: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseRules =\n%+v\nwant\n%+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseRulesErrors(t *testing.T) {
+	tests := []struct {
+		name      string
+		src       string
+		line, col int
+		msg       string
+	}{
+		{"missing rule keyword", "R1: then halt", 1, 1, `expected "rule"`},
+		{"missing colon", "rule R1 then halt", 1, 9, `expected ":"`},
+		{"bad priority", "rule R1 priority high: then halt", 1, 18, "expected priority"},
+		{"missing then", "rule R1: if a.energy > 1 halt", 1, 26, `expected "then"`},
+		{"condition without field", "rule R1: if a > 1 then halt", 1, 13, "expected NODE.energy or NODE.state"},
+		{"unknown field", "rule R1: if a.mass > 1 then halt", 1, 13, `unknown field "mass"`},
+		{"missing operator", "rule R1: if a.energy 1 then halt", 1, 22, "expected comparison operator"},
+		{"ordered state comparison", "rule R1: if a.state > idle then halt", 1, 21, "state only supports == and !="},
+		{"non-numeric energy", "rule R1: if a.energy > lots then halt", 1, 24, "expected energy value"},
+		{"unclosed condition", "rule R1: if (a.energy > 1 then halt", 1, 27, `expected ")"`},
+		{"unknown action", "rule R1: then explode(a -> b)", 1, 15, `unknown action "explode"`},
+		{"missing arrow", "rule R1: then transmit(a, b)", 1, 25, `expected "->"`},
+		{"unknown argument", "rule R1: then transmit(a -> b, speed=2)", 1, 32, `unknown argument "speed"`},
+		{"second bare argument", "rule R1: then transmit(a -> b, 1, 2)", 1, 35, "only the first argument may omit its name"},
+		{"unterminated arguments", "rule R1: then transmit(a -> b, amount=1", 1, 40, `expected ',' or ')'`},
+		{"bad duration", "rule R1: then halt duration 1.5", 1, 29, "expected duration"},
+		{"stray character", "rule R1: then halt;", 1, 19, "unexpected character ';'"},
+		{"lone bang", "rule R1: if a.energy ! 1 then halt", 1, 22, "unexpected '!'"},
+		{"error on a later line", "rule R1: then halt\n\nrule R2:\n  if b.energy >> 1 then halt", 4, 16, "expected energy value"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules, err := ParseRules(tt.src)
+			var parseErr *ParseError
+			if !errors.As(err, &parseErr) {
+				t.Fatalf("ParseRules = %+v, %v; want a *ParseError", rules, err)
+			}
+			if parseErr.Line != tt.line || parseErr.Col != tt.col || !strings.Contains(parseErr.Msg, tt.msg) {
+				t.Errorf("error = %v; want line %d, col %d: %s", err, tt.line, tt.col, tt.msg)
+			}
+		})
+	}
+}
+
+func TestFormatRulesRoundTrip(t *testing.T) {
+	rules, err := ParseRules(exampleRules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := ParseRules(FormatRules(rules))
+	if err != nil {
+		t.Fatalf("ParseRules(FormatRules): %v", err)
+	}
+	if !reflect.DeepEqual(again, rules) {
+		t.Errorf("round trip =\n%+v\nwant\n%+v", again, rules)
+	}
+}
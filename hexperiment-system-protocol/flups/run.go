@@ -0,0 +1,483 @@
+package flups
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MaxRunActions bounds a run's action log; later actions are not recorded
+const MaxRunActions = 1000000
+
+// MaxResidentRuns is how many of the newest runs keep their actions in
+// memory. Older persisted runs are read back from disk when needed; older
+// in-memory runs are dropped.
+const MaxResidentRuns = 8
+
+// RunHeader is everything needed to reproduce a run besides its actions.
+// Time is defined by the action sequence, so a root run is replayed by
+// rebuilding the engine from Graph and Config and stepping it. A fork is
+// replayed by replaying its parent to ForkStep and switching to Config.Rules.
+type RunHeader struct {
+	ID       string    `json:"id"`
+	Parent   string    `json:"parent,omitempty"`
+	ForkStep int       `json:"forkStep,omitempty"`
+	Created  time.Time `json:"created"`
+	Graph    *Graph    `json:"graph"`
+	Config   Config    `json:"config"`
+}
+
+// Run is an append-only action log. Steps continue the parent's numbering
+// in forks, so the first action of a fork at step 10 is step 11.
+type Run struct {
+	mu       sync.Mutex
+	Header   RunHeader
+	actions  []Action
+	count    int
+	lastStep int
+	// unloaded runs hold no actions; their log is read from path
+	unloaded bool
+	path     string
+	file     *os.File
+	writer   *bufio.Writer
+	err      error
+}
+
+// RunInfo summarizes a run for listings
+type RunInfo struct {
+	ID        string    `json:"id"`
+	Parent    string    `json:"parent,omitempty"`
+	ForkStep  int       `json:"forkStep,omitempty"`
+	Created   time.Time `json:"created"`
+	Seed      int64     `json:"seed"`
+	Scheduler string    `json:"scheduler"`
+	Actions   int       `json:"actions"`
+	LastStep  int       `json:"lastStep"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// runLogEntry is one line of a persisted run: the header first, then actions
+type runLogEntry struct {
+	Header *RunHeader `json:"header,omitempty"`
+	Action *Action    `json:"action,omitempty"`
+}
+
+// Actions returns a copy of the logged actions, or nil if an unloaded
+// run's log can no longer be read
+func (r *Run) Actions() []Action {
+	actions, _ := r.actionLog()
+	return actions
+}
+
+// actionLog returns a copy of the logged actions, reading them from disk
+// when the run is not resident
+func (r *Run) actionLog() ([]Action, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.unloaded {
+		return append([]Action(nil), r.actions...), nil
+	}
+	r.flushLocked()
+	stored, err := readRunFile(r.path)
+	if err != nil {
+		return nil, fmt.Errorf("run %s: %v", r.Header.ID, err)
+	}
+	return stored.actions, nil
+}
+
+// Info summarizes the run
+func (r *Run) Info() RunInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	info := RunInfo{
+		ID:        r.Header.ID,
+		Parent:    r.Header.Parent,
+		ForkStep:  r.Header.ForkStep,
+		Created:   r.Header.Created,
+		Seed:      r.Header.Config.Seed,
+		Scheduler: r.Header.Config.Scheduler,
+		Actions:   r.count,
+		LastStep:  r.Header.ForkStep,
+	}
+	if r.count > 0 {
+		info.LastStep = r.lastStep
+	}
+	if r.err != nil {
+		info.Error = r.err.Error()
+	}
+	return info
+}
+
+// WriteLog writes the run in its persisted NDJSON form
+func (r *Run) WriteLog(w io.Writer) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.unloaded {
+		r.flushLocked()
+		f, err := os.Open(r.path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(w, f)
+		return err
+	}
+	encoder := json.NewEncoder(w)
+	if err := encoder.Encode(runLogEntry{Header: &r.Header}); err != nil {
+		return err
+	}
+	for i := range r.actions {
+		if err := encoder.Encode(runLogEntry{Action: &r.actions[i]}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// append logs an action, buffering it for disk in persisted runs until the
+// next Flush. The first failure is kept and stops further recording.
+func (r *Run) append(action Action) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return
+	}
+	if r.count >= MaxRunActions {
+		r.err = fmt.Errorf("action log full after %d actions", MaxRunActions)
+		return
+	}
+	if r.path != "" {
+		if r.err = r.writeLocked(runLogEntry{Action: &action}); r.err != nil {
+			return
+		}
+	}
+	if !r.unloaded {
+		r.actions = append(r.actions, action)
+	}
+	r.count++
+	r.lastStep = action.Step
+}
+
+// writeLocked buffers a log entry, opening the run's file on first use
+func (r *Run) writeLocked(entry runLogEntry) error {
+	if r.writer == nil {
+		f, err := os.OpenFile(r.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+		if err != nil {
+			return err
+		}
+		r.file, r.writer = f, bufio.NewWriter(f)
+	}
+	return json.NewEncoder(r.writer).Encode(entry)
+}
+
+// Flush writes buffered actions to disk, returning the run's first failure
+func (r *Run) Flush() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.flushLocked()
+	return r.err
+}
+
+func (r *Run) flushLocked() {
+	if r.writer == nil {
+		return
+	}
+	if err := r.writer.Flush(); err != nil && r.err == nil {
+		r.err = err
+	}
+}
+
+// Close flushes the run and closes its file; a later append reopens it
+func (r *Run) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closeLocked()
+	return r.err
+}
+
+func (r *Run) closeLocked() {
+	if r.file == nil {
+		return
+	}
+	r.flushLocked()
+	if err := r.file.Close(); err != nil && r.err == nil {
+		r.err = err
+	}
+	r.file, r.writer = nil, nil
+}
+
+// unload releases a persisted run's actions, leaving them on disk
+func (r *Run) unload() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.path == "" || r.unloaded {
+		return
+	}
+	r.closeLocked()
+	r.actions = nil
+	r.unloaded = true
+}
+
+// ReadRunLog parses a persisted run
+func ReadRunLog(r io.Reader) (*Run, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16<<20)
+	run := &Run{}
+	line := 0
+	for scanner.Scan() {
+		line++
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		var entry runLogEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		switch {
+		case entry.Header != nil && run.Header.ID == "":
+			run.Header = *entry.Header
+		case entry.Action != nil && run.Header.ID != "":
+			run.actions = append(run.actions, *entry.Action)
+			run.count++
+			run.lastStep = entry.Action.Step
+		default:
+			return nil, fmt.Errorf("line %d: expected a header followed by actions", line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if run.Header.ID == "" || run.Header.Graph == nil {
+		return nil, fmt.Errorf("run log has no header")
+	}
+	return run, nil
+}
+
+// RunStore keeps runs in memory and, when it has a directory, persists each
+// as <dir>/<id>.ndjson. Only the MaxResidentRuns newest runs keep their
+// actions in memory.
+type RunStore struct {
+	mu   sync.RWMutex
+	dir  string
+	runs map[string]*Run
+}
+
+// NewRunStore creates a store; an empty dir keeps runs in memory only.
+// Existing runs in dir are loaded; unreadable files are reported in the
+// returned error but do not prevent the store from being used.
+func NewRunStore(dir string) (*RunStore, error) {
+	s := &RunStore{dir: dir, runs: make(map[string]*Run)}
+	if dir == "" {
+		return s, nil
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return s, err
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, "*.ndjson"))
+	if err != nil {
+		return s, err
+	}
+	var problems []string
+	for _, path := range paths {
+		run, err := readRunFile(path)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", filepath.Base(path), err))
+			continue
+		}
+		run.path = path
+		s.runs[run.Header.ID] = run
+	}
+	s.evict()
+	if len(problems) > 0 {
+		return s, &ValidationError{Subject: "runs", Problems: problems}
+	}
+	return s, nil
+}
+
+func readRunFile(path string) (*Run, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadRunLog(f)
+}
+
+// Create starts a root run from a normalized config
+func (s *RunStore) Create(graph *Graph, config Config) (*Run, error) {
+	return s.add(RunHeader{Graph: graph.Clone(), Config: config})
+}
+
+func (s *RunStore) add(header RunHeader) (*Run, error) {
+	header.ID = fmt.Sprintf("run-%d", time.Now().UnixNano())
+	header.Created = time.Now()
+	run := &Run{Header: header}
+	if s.dir != "" {
+		run.path = filepath.Join(s.dir, header.ID+".ndjson")
+		err := run.writeLocked(runLogEntry{Header: &run.Header})
+		if err == nil {
+			err = run.Flush()
+		}
+		if err != nil {
+			run.Close()
+			return nil, err
+		}
+	}
+	s.mu.Lock()
+	s.runs[header.ID] = run
+	s.evict()
+	s.mu.Unlock()
+	return run, nil
+}
+
+// evict unloads persisted runs beyond the MaxResidentRuns newest and drops
+// in-memory ones. Callers hold s.mu.
+func (s *RunStore) evict() {
+	if len(s.runs) <= MaxResidentRuns {
+		return
+	}
+	runs := make([]*Run, 0, len(s.runs))
+	for _, run := range s.runs {
+		runs = append(runs, run)
+	}
+	sort.Slice(runs, func(i, j int) bool {
+		return runs[i].Header.Created.After(runs[j].Header.Created)
+	})
+	for _, run := range runs[MaxResidentRuns:] {
+		if run.path == "" {
+			delete(s.runs, run.Header.ID)
+			continue
+		}
+		run.unload()
+	}
+}
+
+// Get returns a run by ID
+func (s *RunStore) Get(id string) (*Run, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	run, ok := s.runs[id]
+	return run, ok
+}
+
+// List returns all runs, oldest first
+func (s *RunStore) List() []*Run {
+	s.mu.RLock()
+	runs := make([]*Run, 0, len(s.runs))
+	for _, run := range s.runs {
+		runs = append(runs, run)
+	}
+	s.mu.RUnlock()
+	sort.Slice(runs, func(i, j int) bool {
+		return runs[i].Header.Created.Before(runs[j].Header.Created)
+	})
+	return runs
+}
+
+// Replay rebuilds the engine of a run as it was after step actions. It fails
+// if the engine no longer produces the logged actions.
+func (s *RunStore) Replay(id string, step int) (*Engine, error) {
+	run, ok := s.Get(id)
+	if !ok {
+		return nil, fmt.Errorf("run %s not found", id)
+	}
+	return s.replay(run, step, 0)
+}
+
+func (s *RunStore) replay(run *Run, step, depth int) (*Engine, error) {
+	if step < 0 {
+		return nil, fmt.Errorf("step must not be negative")
+	}
+	if depth > 100 {
+		return nil, fmt.Errorf("run %s: fork chain too deep", run.Header.ID)
+	}
+	header := run.Header
+	var engine *Engine
+	if header.Parent != "" {
+		parent, ok := s.Get(header.Parent)
+		if !ok {
+			return nil, fmt.Errorf("run %s: parent run %s not found", header.ID, header.Parent)
+		}
+		if step < header.ForkStep {
+			return s.replay(parent, step, depth+1)
+		}
+		var err error
+		if engine, err = s.replay(parent, header.ForkStep, depth+1); err != nil {
+			return nil, err
+		}
+		if err := engine.SetRules(header.Config.seededRules()); err != nil {
+			return nil, err
+		}
+	} else {
+		var err error
+		if _, engine, err = header.Config.newEngine(header.Graph); err != nil {
+			return nil, err
+		}
+	}
+
+	actions, err := run.actionLog()
+	if err != nil {
+		return nil, err
+	}
+	for _, logged := range actions {
+		if engine.Steps() >= step {
+			break
+		}
+		action := engine.Step()
+		if action == nil || !sameAction(*action, logged) {
+			return nil, fmt.Errorf("run %s diverged from its log at step %d", header.ID, logged.Step)
+		}
+	}
+	if engine.Steps() < step {
+		return nil, fmt.Errorf("run %s only reaches step %d", header.ID, engine.Steps())
+	}
+	return engine, nil
+}
+
+// sameAction compares a replayed action with a logged one
+func sameAction(a, b Action) bool {
+	return a.Step == b.Step && a.Rule == b.Rule && a.Kind == b.Kind &&
+		a.From == b.From && a.To == b.To && a.Amount == b.Amount && a.Cost == b.Cost &&
+		a.StartTime == b.StartTime && a.EndTime == b.EndTime
+}
+
+// Fork starts a new run from step of an existing one, continuing with rules
+// (nil keeps the parent's). It returns the new run and its engine, ready to
+// step.
+func (s *RunStore) Fork(parentID string, step int, rules []Rule) (*Run, *Engine, error) {
+	parent, ok := s.Get(parentID)
+	if !ok {
+		return nil, nil, fmt.Errorf("run %s not found", parentID)
+	}
+	engine, err := s.replay(parent, step, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Replay of the fork switches rules at the fork point, so do the same
+	// here even when they are unchanged
+	config := parent.Header.Config
+	if rules != nil {
+		config.Rules = rules
+		config.RuleSource = ""
+	}
+	if err := engine.SetRules(config.seededRules()); err != nil {
+		return nil, nil, err
+	}
+	run, err := s.add(RunHeader{
+		Parent:   parentID,
+		ForkStep: step,
+		Graph:    parent.Header.Graph,
+		Config:   config,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return run, engine, nil
+}
@@ -0,0 +1,470 @@
+package flups
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// DefaultEnergyTolerance is the largest change in total energy per step
+// that is not reported as a conservation violation
+const DefaultEnergyTolerance = 1e-9
+
+// Config sets up a simulation. Empty fields fall back to DefaultConfig.
+// RuleSource, when set, is parsed with ParseRules and replaces Rules.
+// Scheduler is SchedulerRules (the default) or SchedulerPhaseLocked, which
+// requires a mirror lattice graph and ignores the rules. A non-zero Seed
+// shuffles rules of equal priority, so a run explores a different but
+// reproducible tie order.
+type Config struct {
+	Threshold       float64            `json:"threshold"`
+	Amount          float64            `json:"amount"`
+	InitialEnergy   map[string]float64 `json:"initialEnergy,omitempty"`
+	InitialState    map[string]string  `json:"initialState,omitempty"`
+	Rules           []Rule             `json:"rules,omitempty"`
+	RuleSource      string             `json:"ruleSource,omitempty"`
+	Scheduler       string             `json:"scheduler,omitempty"`
+	EnergyTolerance float64            `json:"energyTolerance,omitempty"`
+	Seed            int64              `json:"seed,omitempty"`
+}
+
+// DefaultConfig charges the first vertex and marks it active so the default
+// R1-R3 cycle can start
+func DefaultConfig(graph *Graph) Config {
+	config := Config{Threshold: 1, Amount: 1, Scheduler: SchedulerRules, EnergyTolerance: DefaultEnergyTolerance}
+	if len(graph.Vertices) > 0 {
+		first := graph.Vertices[0].ID
+		config.InitialEnergy = map[string]float64{first: 5}
+		config.InitialState = map[string]string{first: StateActive}
+	}
+	return config
+}
+
+// withDefaults fills unset fields from DefaultConfig
+func (c Config) withDefaults(graph *Graph) Config {
+	defaults := DefaultConfig(graph)
+	if c.Threshold == 0 {
+		c.Threshold = defaults.Threshold
+	}
+	if c.Amount == 0 {
+		c.Amount = defaults.Amount
+	}
+	if c.Scheduler == "" {
+		c.Scheduler = defaults.Scheduler
+	}
+	if c.EnergyTolerance == 0 {
+		c.EnergyTolerance = defaults.EnergyTolerance
+	}
+	if c.InitialEnergy == nil {
+		c.InitialEnergy = defaults.InitialEnergy
+	}
+	if c.InitialState == nil {
+		c.InitialState = defaults.InitialState
+	}
+	if len(c.Rules) == 0 {
+		c.Rules = DefaultRules(graph, c.Threshold, c.Amount)
+	}
+	return c
+}
+
+// initialNodes converts the config's initial maps to node states
+func (c Config) initialNodes(graph *Graph) ([]NodeState, error) {
+	var nodes []NodeState
+	for id := range c.InitialState {
+		if _, ok := graph.Vertex(id); !ok {
+			return nil, fmt.Errorf("initial state for unknown node %q", id)
+		}
+	}
+	for _, v := range graph.Vertices {
+		energy, hasEnergy := c.InitialEnergy[v.ID]
+		state, hasState := c.InitialState[v.ID]
+		if hasEnergy || hasState {
+			nodes = append(nodes, NodeState{ID: v.ID, Energy: energy, State: state})
+		}
+	}
+	for id := range c.InitialEnergy {
+		if _, ok := graph.Vertex(id); !ok {
+			return nil, fmt.Errorf("initial energy for unknown node %q", id)
+		}
+	}
+	return nodes, nil
+}
+
+// Snapshot is the observable state of a simulation
+type Snapshot struct {
+	Time        int         `json:"time"`
+	Steps       int         `json:"steps"`
+	Running     bool        `json:"running"`
+	Frozen      bool        `json:"frozen"`
+	Halted      bool        `json:"halted"`
+	TotalEnergy float64     `json:"totalEnergy"`
+	Nodes       []NodeState `json:"nodes"`
+	Queue       []Action    `json:"queue"`
+	Phase       string      `json:"phase,omitempty"`
+}
+
+// Violation records a step that changed the total energy of the system
+type Violation struct {
+	Step     int     `json:"step"`
+	Time     int     `json:"time"`
+	Action   Action  `json:"action"`
+	Expected float64 `json:"expected"`
+	Actual   float64 `json:"actual"`
+	Delta    float64 `json:"delta"`
+}
+
+// Summary reports a run since the last reset, including every energy
+// conservation violation
+type Summary struct {
+	Scheduler     string      `json:"scheduler"`
+	Steps         int         `json:"steps"`
+	Time          int         `json:"time"`
+	Frozen        bool        `json:"frozen"`
+	Halted        bool        `json:"halted"`
+	InitialEnergy float64     `json:"initialEnergy"`
+	FinalEnergy   float64     `json:"finalEnergy"`
+	Conserved     bool        `json:"conserved"`
+	Violations    []Violation `json:"violations"`
+}
+
+// Simulator drives an Engine either step by step or on a real-time ticker,
+// checking after every action that total energy is conserved. Callbacks are
+// invoked without holding the simulator lock.
+type Simulator struct {
+	mu         sync.Mutex
+	graph      *Graph
+	config     Config
+	engine     *Engine
+	running    bool
+	stop       chan struct{}
+	initial    float64
+	violations []Violation
+	frames     []Frame
+	store      *RunStore
+	recording  *Run
+
+	OnAction    func(Action, Snapshot)
+	OnFrame     func(Frame)
+	OnFrozen    func(Snapshot)
+	OnViolation func(Violation)
+}
+
+// NewSimulator creates a simulator over a graph
+func NewSimulator(graph *Graph, config Config) (*Simulator, error) {
+	s := &Simulator{graph: graph}
+	if err := s.configure(config); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// newEngine builds the engine for a config over a graph, returning the
+// config with defaults filled in and rule source parsed
+func (c Config) newEngine(graph *Graph) (Config, *Engine, error) {
+	if c.RuleSource != "" {
+		rules, err := ParseRules(c.RuleSource)
+		if err != nil {
+			return c, nil, err
+		}
+		c.Rules = rules
+	}
+	c = c.withDefaults(graph)
+	initial, err := c.initialNodes(graph)
+	if err != nil {
+		return c, nil, err
+	}
+	engine, err := NewEngine(graph, initial, c.seededRules())
+	if err != nil {
+		return c, nil, err
+	}
+	switch c.Scheduler {
+	case SchedulerRules:
+	case SchedulerPhaseLocked:
+		if err := engine.UsePhaseLock(c.Amount, c.Threshold); err != nil {
+			return c, nil, err
+		}
+	default:
+		return c, nil, fmt.Errorf("unknown scheduler %q (expected %s or %s)", c.Scheduler, SchedulerRules, SchedulerPhaseLocked)
+	}
+	return c, engine, nil
+}
+
+// seededRules shuffles the rules with the seed; the engine's stable sort by
+// priority then leaves only ties in shuffled order
+func (c Config) seededRules() []Rule {
+	rules := append([]Rule(nil), c.Rules...)
+	if c.Seed != 0 {
+		rng := rand.New(rand.NewSource(c.Seed))
+		rng.Shuffle(len(rules), func(i, j int) { rules[i], rules[j] = rules[j], rules[i] })
+	}
+	return rules
+}
+
+func (s *Simulator) configure(config Config) error {
+	config, engine, err := config.newEngine(s.graph)
+	if err != nil {
+		return err
+	}
+	var run *Run
+	if s.store != nil {
+		if run, err = s.store.Create(s.graph, config); err != nil {
+			return err
+		}
+	}
+	s.attach(s.graph, config, engine, run)
+	return nil
+}
+
+// attach makes the simulator continue from an engine, recording to run
+func (s *Simulator) attach(graph *Graph, config Config, engine *Engine, run *Run) {
+	s.graph = graph
+	s.config = config
+	s.engine = engine
+	if s.recording != nil && s.recording != run {
+		s.recording.Close()
+	}
+	s.recording = run
+	s.initial = engine.TotalEnergy()
+	s.violations = nil
+	s.frames = []Frame{newFrame(graph, engine, nil)}
+}
+
+// Config returns the active configuration
+func (s *Simulator) Config() Config {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.config
+}
+
+// Graph returns the simulated graph
+func (s *Simulator) Graph() *Graph {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.graph
+}
+
+// Record restarts the simulation from its initial state and logs every
+// action to a new run in store; each Reset starts another run
+func (s *Simulator) Record(store *RunStore) error {
+	s.Pause()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.store = store
+	return s.configure(s.config)
+}
+
+// RunID returns the ID of the run being recorded, or "" when not recording
+func (s *Simulator) RunID() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.recording == nil {
+		return ""
+	}
+	return s.recording.Header.ID
+}
+
+// Fork pauses the simulation and continues it as a new run branched from
+// step of an existing run, with the given rules (nil keeps the parent's)
+func (s *Simulator) Fork(parentID string, step int, rules []Rule) (*Run, error) {
+	s.Pause()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.store == nil {
+		return nil, fmt.Errorf("simulation is not recording runs")
+	}
+	run, engine, err := s.store.Fork(parentID, step, rules)
+	if err != nil {
+		return nil, err
+	}
+	s.attach(run.Header.Graph, run.Header.Config, engine, run)
+	return run, nil
+}
+
+// Step executes up to n actions, stopping early if time freezes
+func (s *Simulator) Step(n int) []Action {
+	type executed struct {
+		action   Action
+		snapshot Snapshot
+		frame    Frame
+	}
+
+	s.mu.Lock()
+	var done []executed
+	var violations []Violation
+	wasFrozen := s.engine.Frozen()
+	for i := 0; i < n; i++ {
+		before := s.engine.TotalEnergy()
+		action := s.engine.Step()
+		if action == nil {
+			break
+		}
+		if after := s.engine.TotalEnergy(); math.Abs(after-before) > s.config.EnergyTolerance {
+			violations = append(violations, Violation{
+				Step:     action.Step,
+				Time:     action.EndTime,
+				Action:   *action,
+				Expected: before,
+				Actual:   after,
+				Delta:    after - before,
+			})
+		}
+		if s.recording != nil {
+			s.recording.append(*action)
+		}
+		recorded := *action
+		frame := newFrame(s.graph, s.engine, &recorded)
+		s.frames = append(s.frames, frame)
+		done = append(done, executed{*action, s.snapshotLocked(), frame})
+	}
+	if excess := len(s.frames) - MaxHistoryFrames; excess > 0 {
+		s.frames = append([]Frame(nil), s.frames[excess:]...)
+	}
+	s.violations = append(s.violations, violations...)
+	froze := s.engine.Frozen() && !wasFrozen
+	final := s.snapshotLocked()
+	onAction, onFrame, onFrozen, onViolation := s.OnAction, s.OnFrame, s.OnFrozen, s.OnViolation
+	recording := s.recording
+	s.mu.Unlock()
+
+	// Write the batch to disk outside the simulator lock; failures show in
+	// the run's Info
+	if recording != nil && len(done) > 0 {
+		recording.Flush()
+	}
+
+	actions := make([]Action, len(done))
+	for i, d := range done {
+		actions[i] = d.action
+		if onAction != nil {
+			onAction(d.action, d.snapshot)
+		}
+		if onFrame != nil {
+			onFrame(d.frame)
+		}
+	}
+	if onViolation != nil {
+		for _, v := range violations {
+			onViolation(v)
+		}
+	}
+	if froze && onFrozen != nil {
+		onFrozen(final)
+	}
+	return actions
+}
+
+// Start runs one action per interval until paused or frozen
+func (s *Simulator) Start(interval time.Duration) error {
+	if interval <= 0 {
+		return fmt.Errorf("interval must be positive")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.running {
+		return fmt.Errorf("simulation already running")
+	}
+	if s.engine.Halted() {
+		return fmt.Errorf("simulation halted; reset it first")
+	}
+	s.running = true
+	s.stop = make(chan struct{})
+	go s.run(interval, s.stop)
+	return nil
+}
+
+func (s *Simulator) run(interval time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if len(s.Step(1)) == 0 {
+				s.pauseRun(stop)
+				return
+			}
+		}
+	}
+}
+
+// pauseRun pauses the run that owns stop, leaving any later run alone
+func (s *Simulator) pauseRun(stop chan struct{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.running && s.stop == stop {
+		close(s.stop)
+		s.running = false
+	}
+}
+
+// Pause stops a running simulation; state is kept
+func (s *Simulator) Pause() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.running {
+		close(s.stop)
+		s.running = false
+	}
+}
+
+// Reset pauses the simulation and restores the initial state. A non-nil
+// config replaces the current one.
+func (s *Simulator) Reset(config *Config) error {
+	s.Pause()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	next := s.config
+	if config != nil {
+		next = *config
+	}
+	return s.configure(next)
+}
+
+// Snapshot returns the current state
+func (s *Simulator) Snapshot() Snapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.snapshotLocked()
+}
+
+func (s *Simulator) snapshotLocked() Snapshot {
+	return Snapshot{
+		Time:        s.engine.Time(),
+		Steps:       s.engine.Steps(),
+		Running:     s.running,
+		Frozen:      s.engine.Frozen(),
+		Halted:      s.engine.Halted(),
+		TotalEnergy: s.engine.TotalEnergy(),
+		Nodes:       s.engine.Nodes(),
+		Queue:       s.engine.Queue(),
+		Phase:       s.engine.Phase(),
+	}
+}
+
+// History returns the recorded frames since the last reset, oldest first.
+// At most MaxHistoryFrames are kept.
+func (s *Simulator) History() []Frame {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Frame(nil), s.frames...)
+}
+
+// Summary reports the run since the last reset
+func (s *Simulator) Summary() Summary {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return Summary{
+		Scheduler:     s.config.Scheduler,
+		Steps:         s.engine.Steps(),
+		Time:          s.engine.Time(),
+		Frozen:        s.engine.Frozen(),
+		Halted:        s.engine.Halted(),
+		InitialEnergy: s.initial,
+		FinalEnergy:   s.engine.TotalEnergy(),
+		Conserved:     len(s.violations) == 0,
+		Violations:    append([]Violation{}, s.violations...),
+	}
+}
@@ -0,0 +1,455 @@
+package flups
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// MaxSystemMessages bounds the message log a system keeps
+const MaxSystemMessages = 1000
+
+// MaxSubsystemRate bounds the actions a subsystem runs per tick, as a tick
+// holds the system's lock until every subsystem has acted
+const MaxSubsystemRate = 100
+
+// Subsystems run independent engines, each with its own action counter and
+// clock. "Different subsystems can have different action rates"
+// (flups-action-time.md): Rate is how many actions a subsystem may execute
+// per tick of the system, so a subsystem with rate 2 ages twice as fast as
+// one with rate 1.
+//
+// Couplings are the only way subsystems interact. When an action in the
+// source subsystem delivers energy to the coupling's From node and that node
+// then holds at least Amount, Amount is sent to the To node of the target
+// subsystem. Clocks are synchronized as Lamport clocks: the receiver's clock
+// jumps to the send time plus the coupling's Duration if it is behind.
+
+// SubsystemConfig is one independent graph of a system
+type SubsystemConfig struct {
+	ID     string `json:"id"`
+	Graph  *Graph `json:"graph"`
+	Config Config `json:"config"`
+	Rate   int    `json:"rate"`
+}
+
+// Endpoint is a node of a subsystem
+type Endpoint struct {
+	Subsystem string `json:"subsystem"`
+	Node      string `json:"node"`
+}
+
+func (p Endpoint) String() string { return p.Subsystem + ":" + p.Node }
+
+// Coupling is a directed cross-subsystem edge
+type Coupling struct {
+	From     Endpoint `json:"from"`
+	To       Endpoint `json:"to"`
+	Amount   float64  `json:"amount"`
+	Duration int      `json:"duration"`
+}
+
+// SystemConfig sets up a multi-subsystem simulation
+type SystemConfig struct {
+	Subsystems []SubsystemConfig `json:"subsystems"`
+	Couplings  []Coupling        `json:"couplings"`
+}
+
+// Message is one energy exchange over a coupling
+type Message struct {
+	Tick       int      `json:"tick"`
+	From       Endpoint `json:"from"`
+	To         Endpoint `json:"to"`
+	Amount     float64  `json:"amount"`
+	SentAt     int      `json:"sentAt"`
+	ReceivedAt int      `json:"receivedAt"`
+	// Skew is how far the receiver's clock jumped to stay consistent
+	Skew int `json:"skew"`
+}
+
+// SubsystemSnapshot is the observable state of one subsystem
+type SubsystemSnapshot struct {
+	ID          string      `json:"id"`
+	Rate        int         `json:"rate"`
+	Time        int         `json:"time"`
+	Steps       int         `json:"steps"`
+	Frozen      bool        `json:"frozen"`
+	Halted      bool        `json:"halted"`
+	TotalEnergy float64     `json:"totalEnergy"`
+	Nodes       []NodeState `json:"nodes"`
+}
+
+// SystemSnapshot is the observable state of a system
+type SystemSnapshot struct {
+	Tick        int                 `json:"tick"`
+	Running     bool                `json:"running"`
+	Frozen      bool                `json:"frozen"`
+	TotalEnergy float64             `json:"totalEnergy"`
+	Subsystems  []SubsystemSnapshot `json:"subsystems"`
+	Messages    []Message           `json:"messages"`
+}
+
+// TickResult is what happened in one tick
+type TickResult struct {
+	Tick     int                 `json:"tick"`
+	Actions  map[string][]Action `json:"actions"`
+	Messages []Message           `json:"messages"`
+}
+
+type subsystem struct {
+	id     string
+	rate   int
+	graph  *Graph
+	engine *Engine
+}
+
+// System runs several subsystems side by side. Callbacks are invoked
+// without holding the system lock.
+type System struct {
+	mu         sync.Mutex
+	config     SystemConfig
+	subsystems []*subsystem
+	byID       map[string]*subsystem
+	couplings  map[Endpoint][]Coupling
+	tick       int
+	frozen     bool
+	messages   []Message
+	running    bool
+	stop       chan struct{}
+
+	OnTick   func(TickResult, SystemSnapshot)
+	OnFrozen func(SystemSnapshot)
+}
+
+// NewSystem creates a system; subsystem configs fall back to DefaultConfig
+// and rates to 1
+func NewSystem(config SystemConfig) (*System, error) {
+	s := &System{}
+	if err := s.configure(config); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *System) configure(config SystemConfig) error {
+	// Defaults are filled in place, so work on copies of the caller's slices
+	config.Subsystems = append([]SubsystemConfig(nil), config.Subsystems...)
+	config.Couplings = append([]Coupling(nil), config.Couplings...)
+
+	var problems []string
+	if len(config.Subsystems) == 0 {
+		problems = append(problems, "system has no subsystems")
+	}
+	subsystems := make([]*subsystem, 0, len(config.Subsystems))
+	byID := make(map[string]*subsystem, len(config.Subsystems))
+	for i := range config.Subsystems {
+		sc := &config.Subsystems[i]
+		if sc.ID == "" {
+			problems = append(problems, fmt.Sprintf("subsystem %d has no id", i))
+			continue
+		}
+		if byID[sc.ID] != nil {
+			problems = append(problems, fmt.Sprintf("duplicate subsystem %q", sc.ID))
+			continue
+		}
+		if sc.Graph == nil {
+			problems = append(problems, fmt.Sprintf("subsystem %s has no graph", sc.ID))
+			continue
+		}
+		if sc.Rate < 0 || sc.Rate > MaxSubsystemRate {
+			problems = append(problems, fmt.Sprintf("subsystem %s: rate must be between 0 and %d", sc.ID, MaxSubsystemRate))
+			continue
+		}
+		if sc.Rate == 0 {
+			sc.Rate = 1
+		}
+		if err := sc.Graph.Validate(); err != nil {
+			problems = append(problems, fmt.Sprintf("subsystem %s: %v", sc.ID, err))
+			continue
+		}
+		normalized, engine, err := sc.Config.newEngine(sc.Graph)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("subsystem %s: %v", sc.ID, err))
+			continue
+		}
+		sc.Config = normalized
+		sub := &subsystem{id: sc.ID, rate: sc.Rate, graph: sc.Graph, engine: engine}
+		subsystems = append(subsystems, sub)
+		byID[sc.ID] = sub
+	}
+
+	couplings := make(map[Endpoint][]Coupling)
+	known := func(p Endpoint) bool {
+		sub := byID[p.Subsystem]
+		if sub == nil {
+			return false
+		}
+		_, ok := sub.graph.Vertex(p.Node)
+		return ok
+	}
+	for i := range config.Couplings {
+		c := &config.Couplings[i]
+		if !known(c.From) || !known(c.To) {
+			problems = append(problems, fmt.Sprintf("coupling %s -> %s references unknown node", c.From, c.To))
+			continue
+		}
+		if c.From.Subsystem == c.To.Subsystem {
+			problems = append(problems, fmt.Sprintf("coupling %s -> %s stays within one subsystem; use a rule instead", c.From, c.To))
+			continue
+		}
+		if c.Amount <= 0 || c.Duration < 0 {
+			problems = append(problems, fmt.Sprintf("coupling %s -> %s: amount must be positive and duration not negative", c.From, c.To))
+			continue
+		}
+		if c.Duration == 0 {
+			c.Duration = 1
+		}
+		couplings[c.From] = append(couplings[c.From], *c)
+	}
+
+	if len(problems) > 0 {
+		return &ValidationError{Subject: "system", Problems: problems}
+	}
+	s.config = config
+	s.subsystems = subsystems
+	s.byID = byID
+	s.couplings = couplings
+	s.tick = 0
+	s.frozen = false
+	s.messages = nil
+	return nil
+}
+
+// Config returns the active configuration with defaults filled in
+func (s *System) Config() SystemConfig {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.config
+}
+
+// Step runs up to n ticks, stopping early when the whole system freezes
+func (s *System) Step(n int) []TickResult {
+	type executed struct {
+		result   TickResult
+		snapshot SystemSnapshot
+	}
+
+	s.mu.Lock()
+	var done []executed
+	wasFrozen := s.frozen
+	for i := 0; i < n; i++ {
+		result, ok := s.tickLocked()
+		if !ok {
+			break
+		}
+		done = append(done, executed{result, s.snapshotLocked()})
+	}
+	froze := s.frozen && !wasFrozen
+	final := s.snapshotLocked()
+	onTick, onFrozen := s.OnTick, s.OnFrozen
+	s.mu.Unlock()
+
+	results := make([]TickResult, len(done))
+	for i, d := range done {
+		results[i] = d.result
+		if onTick != nil {
+			onTick(d.result, d.snapshot)
+		}
+	}
+	if froze && onFrozen != nil {
+		onFrozen(final)
+	}
+	return results
+}
+
+// tickLocked lets every subsystem execute up to its rate of actions,
+// delivering coupling messages as they are sent. It reports false when no
+// subsystem could act.
+func (s *System) tickLocked() (TickResult, bool) {
+	result := TickResult{Tick: s.tick + 1, Actions: make(map[string][]Action)}
+	for _, sub := range s.subsystems {
+		for i := 0; i < sub.rate; i++ {
+			action := sub.engine.Step()
+			if action == nil {
+				break
+			}
+			result.Actions[sub.id] = append(result.Actions[sub.id], *action)
+			if action.Kind != KindHalt {
+				result.Messages = append(result.Messages, s.sendLocked(sub, *action, result.Tick)...)
+			}
+		}
+	}
+	if len(result.Actions) == 0 {
+		s.frozen = true
+		return result, false
+	}
+	s.tick++
+	s.frozen = false
+	s.messages = append(s.messages, result.Messages...)
+	if excess := len(s.messages) - MaxSystemMessages; excess > 0 {
+		s.messages = append([]Message(nil), s.messages[excess:]...)
+	}
+	return result, true
+}
+
+// sendLocked fires the couplings of the node an action delivered energy to
+func (s *System) sendLocked(sub *subsystem, action Action, tick int) []Message {
+	var messages []Message
+	for _, c := range s.couplings[Endpoint{Subsystem: sub.id, Node: action.To}] {
+		if sub.engine.nodes[action.To].Energy < c.Amount {
+			continue
+		}
+		target := s.byID[c.To.Subsystem]
+		amount := sub.engine.take(action.To, c.Amount)
+		target.engine.give(c.To.Node, amount, StateReceived)
+
+		sentAt := sub.engine.Time()
+		before := target.engine.Time()
+		target.engine.syncTime(sentAt + c.Duration)
+		messages = append(messages, Message{
+			Tick:       tick,
+			From:       c.From,
+			To:         c.To,
+			Amount:     amount,
+			SentAt:     sentAt,
+			ReceivedAt: target.engine.Time(),
+			Skew:       target.engine.Time() - before,
+		})
+	}
+	return messages
+}
+
+// Start runs one tick per interval until paused or frozen
+func (s *System) Start(interval time.Duration) error {
+	if interval <= 0 {
+		return fmt.Errorf("interval must be positive")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.running {
+		return fmt.Errorf("system already running")
+	}
+	s.running = true
+	s.stop = make(chan struct{})
+	go s.run(interval, s.stop)
+	return nil
+}
+
+func (s *System) run(interval time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if len(s.Step(1)) == 0 {
+				s.pauseRun(stop)
+				return
+			}
+		}
+	}
+}
+
+// pauseRun pauses the run that owns stop, leaving any later run alone
+func (s *System) pauseRun(stop chan struct{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.running && s.stop == stop {
+		close(s.stop)
+		s.running = false
+	}
+}
+
+// Pause stops a running system; state is kept
+func (s *System) Pause() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.running {
+		close(s.stop)
+		s.running = false
+	}
+}
+
+// Reset pauses the system and restores every subsystem's initial state. A
+// non-nil config replaces the current one.
+func (s *System) Reset(config *SystemConfig) error {
+	s.Pause()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	next := s.config
+	if config != nil {
+		next = *config
+	}
+	return s.configure(next)
+}
+
+// Snapshot returns the current state, with each subsystem's own clock
+func (s *System) Snapshot() SystemSnapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.snapshotLocked()
+}
+
+func (s *System) snapshotLocked() SystemSnapshot {
+	snapshot := SystemSnapshot{
+		Tick:     s.tick,
+		Running:  s.running,
+		Frozen:   s.frozen,
+		Messages: append([]Message{}, s.messages...),
+	}
+	for _, sub := range s.subsystems {
+		e := sub.engine
+		snapshot.TotalEnergy += e.TotalEnergy()
+		snapshot.Subsystems = append(snapshot.Subsystems, SubsystemSnapshot{
+			ID:          sub.id,
+			Rate:        sub.rate,
+			Time:        e.Time(),
+			Steps:       e.Steps(),
+			Frozen:      e.Frozen(),
+			Halted:      e.Halted(),
+			TotalEnergy: e.TotalEnergy(),
+			Nodes:       e.Nodes(),
+		})
+	}
+	return snapshot
+}
+
+// CellSubsystems splits a graph into one subsystem per lattice cell, using
+// the "r{row}c{col}/" vertex ID prefix written by MirrorLattice, and turns
+// every edge between cells into a pair of couplings moving amount energy. A
+// graph without cell prefixes becomes a single subsystem "main". Rates
+// default to 1; rates maps subsystem IDs to other rates.
+func CellSubsystems(graph *Graph, rates map[string]int, amount float64) SystemConfig {
+	cellOf := func(id string) string {
+		if prefix := CellPrefix(id); prefix != "" {
+			return prefix
+		}
+		return "main"
+	}
+
+	var config SystemConfig
+	graphs := make(map[string]*Graph)
+	for _, v := range graph.Vertices {
+		id := cellOf(v.ID)
+		g, ok := graphs[id]
+		if !ok {
+			g = &Graph{}
+			graphs[id] = g
+			config.Subsystems = append(config.Subsystems, SubsystemConfig{ID: id, Graph: g, Rate: rates[id]})
+		}
+		g.Vertices = append(g.Vertices, v)
+	}
+	for _, e := range graph.Edges {
+		a, b := cellOf(e[0]), cellOf(e[1])
+		if a == b {
+			graphs[a].Edges = append(graphs[a].Edges, e)
+			continue
+		}
+		from, to := Endpoint{Subsystem: a, Node: e[0]}, Endpoint{Subsystem: b, Node: e[1]}
+		config.Couplings = append(config.Couplings,
+			Coupling{From: from, To: to, Amount: amount, Duration: 1},
+			Coupling{From: to, To: from, Amount: amount, Duration: 1})
+	}
+	return config
+}
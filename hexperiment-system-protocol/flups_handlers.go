@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+
+	"hexperiment-system-protocol/flups"
+)
+
+// Graphs sent in request bodies for analysis or rendering. Analysis is
+// roughly quadratic in their size: 600 vertices take about a third of a
+// second.
+const (
+	maxFlupsRequestBytes    = 1 << 20
+	maxFlupsRequestVertices = 600
+	maxFlupsRequestEdges    = 3 * maxFlupsRequestVertices
+)
+
+// The flups lattice served to frontends, loaded from FLUPS_GRAPH_PATH (default flups.ini)
+var flupsGraph = struct {
+	sync.RWMutex
+	graph  *flups.Graph
+	source string
+}{}
+
+// loadFlupsGraph reads the lattice definition at startup
+func loadFlupsGraph() {
+	path := os.Getenv("FLUPS_GRAPH_PATH")
+	if path == "" {
+		path = "flups.ini"
+	}
+	graph, err := flups.Load(path)
+	if err != nil {
+		log.Printf("⚠️ Failed to load flups graph from %s: %v", path, err)
+		return
+	}
+
+	setFlupsGraph(graph, path)
+}
+
+// currentFlupsGraph returns a copy of the loaded lattice, or nil if none is loaded
+func currentFlupsGraph() *flups.Graph {
+	flupsGraph.RLock()
+	defer flupsGraph.RUnlock()
+	if flupsGraph.graph == nil {
+		return nil
+	}
+	return flupsGraph.graph.Clone()
+}
+
+// Flups graph handler: serves the lattice in the flups.ini vertex/edge format
+func flupsGraphHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	flupsGraph.RLock()
+	graph, source := flupsGraph.graph, flupsGraph.source
+	flupsGraph.RUnlock()
+
+	if graph == nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   "flups graph not loaded",
+		})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"vertices":  graph.Vertices,
+		"edges":     graph.Edges,
+		"neighbors": graph.Neighbors(),
+		"metrics":   flups.ComputeMetrics(graph),
+		"metadata": map[string]interface{}{
+			"source":       source,
+			"vertex_count": len(graph.Vertices),
+			"edge_count":   len(graph.Edges),
+		},
+	})
+}
+
+// Flups lattice handler: generates a hexagonal mirror lattice from a base
+// triangle (the loaded graph by default), optionally making it the active graph
+func flupsLatticeHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var request struct {
+		Base     *flups.Graph `json:"base"`
+		Rows     int          `json:"rows"`
+		Cols     int          `json:"cols"`
+		Activate bool         `json:"activate"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if request.Rows == 0 {
+		request.Rows = 1
+	}
+	if request.Cols == 0 {
+		request.Cols = 1
+	}
+
+	base := request.Base
+	if base == nil {
+		base = currentFlupsGraph()
+	}
+	if base == nil {
+		http.Error(w, "No base triangle given and no flups graph loaded", http.StatusBadRequest)
+		return
+	}
+
+	lattice, err := flups.MirrorLattice(base, request.Rows, request.Cols)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	if request.Activate {
+		setFlupsGraph(lattice.Graph.Clone(), fmt.Sprintf("lattice %dx%d", request.Rows, request.Cols))
+	}
+	json.NewEncoder(w).Encode(lattice)
+}
+
+// setFlupsGraph replaces the active graph and discards the simulation built on the old one
+func setFlupsGraph(graph *flups.Graph, source string) {
+	flupsGraph.Lock()
+	flupsGraph.graph = graph
+	flupsGraph.source = source
+	flupsGraph.Unlock()
+
+	flupsSim.Lock()
+	if flupsSim.sim != nil {
+		flupsSim.sim.Pause()
+		flupsSim.sim = nil
+	}
+	flupsSim.Unlock()
+	log.Printf("🔺 Active flups graph set to %s: %d vertices, %d edges", source, len(graph.Vertices), len(graph.Edges))
+}
+
+// Flups analysis handler: hop distribution, per-cell diameters and throughput
+// of the active graph (GET) or of a graph in the request body (POST), so
+// topologies can be compared before activating them
+func flupsAnalysisHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	graph := currentFlupsGraph()
+	if r.Method == "POST" {
+		var request struct {
+			Graph *flups.Graph `json:"graph"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxFlupsRequestBytes)).Decode(&request); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		if err := checkFlupsRequestGraph(request.Graph); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		graph = request.Graph
+	}
+	if graph == nil {
+		http.Error(w, "flups graph not loaded", http.StatusServiceUnavailable)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":  true,
+		"analysis": flups.AnalyzePaths(graph),
+	})
+}
+
+// checkFlupsRequestGraph validates a graph sent in a request body and bounds
+// its size
+func checkFlupsRequestGraph(graph *flups.Graph) error {
+	if graph == nil {
+		return fmt.Errorf("graph is required")
+	}
+	if len(graph.Vertices) > maxFlupsRequestVertices || len(graph.Edges) > maxFlupsRequestEdges {
+		return fmt.Errorf("graph too large: at most %d vertices and %d edges", maxFlupsRequestVertices, maxFlupsRequestEdges)
+	}
+	return graph.Validate()
+}
+
+// Flups path handler: shortest path between ?from= and ?to= in the active graph
+func flupsPathHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	graph := currentFlupsGraph()
+	if graph == nil {
+		http.Error(w, "flups graph not loaded", http.StatusServiceUnavailable)
+		return
+	}
+
+	query := r.URL.Query()
+	path, err := flups.ShortestPath(graph, query.Get("from"), query.Get("to"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"path":    path,
+		"hops":    len(path) - 1,
+	})
+}
+
+// Flups flow handler: max flow between ?source= and ?sink= in the active
+// graph, with ?capacity= per edge direction (default 1)
+func flupsFlowHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	graph := currentFlupsGraph()
+	if graph == nil {
+		http.Error(w, "flups graph not loaded", http.StatusServiceUnavailable)
+		return
+	}
+
+	query := r.URL.Query()
+	capacity := 1.0
+	if c := query.Get("capacity"); c != "" {
+		parsed, err := strconv.ParseFloat(c, 64)
+		if err != nil {
+			http.Error(w, "capacity must be a number", http.StatusBadRequest)
+			return
+		}
+		capacity = parsed
+	}
+	flow, err := flups.MaxFlow(graph, query.Get("source"), query.Get("sink"), capacity)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"flow":    flow,
+	})
+}
+
+// Flups render handler: draws the active graph as SVG (default) or PNG with
+// ?format=png. ?frame=latest or ?frame=<time> colours nodes by the
+// simulation's state at that virtual time; ?width, ?height, ?projection
+// (xy, xz, yz, iso) and ?labels=true adjust the drawing. POST renders
+// {"graph", "frame", "format", "options"} from the body instead.
+func flupsRenderHandler(w http.ResponseWriter, r *http.Request) {
+	var (
+		graph   *flups.Graph
+		frame   *flups.Frame
+		format  string
+		options flups.RenderOptions
+	)
+
+	if r.Method == "POST" {
+		var request struct {
+			Graph   *flups.Graph        `json:"graph"`
+			Frame   *flups.Frame        `json:"frame"`
+			Format  string              `json:"format"`
+			Options flups.RenderOptions `json:"options"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxFlupsRequestBytes)).Decode(&request); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		if err := checkFlupsRequestGraph(request.Graph); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		graph, frame, format, options = request.Graph, request.Frame, request.Format, request.Options
+	} else {
+		query := r.URL.Query()
+		format = query.Get("format")
+		options.Projection = query.Get("projection")
+		options.Labels = query.Get("labels") == "true"
+		for name, target := range map[string]*int{"width": &options.Width, "height": &options.Height} {
+			if v := query.Get(name); v != "" {
+				n, err := strconv.Atoi(v)
+				if err != nil {
+					http.Error(w, name+" must be an integer", http.StatusBadRequest)
+					return
+				}
+				*target = n
+			}
+		}
+
+		graph = currentFlupsGraph()
+		if at := query.Get("frame"); at != "" {
+			sim, err := currentFlupsSimulator()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+			history := sim.History()
+			selected := history[len(history)-1]
+			if at != "latest" {
+				t, err := strconv.Atoi(at)
+				if err != nil || t < 0 {
+					http.Error(w, "frame must be latest or a non-negative time", http.StatusBadRequest)
+					return
+				}
+				var ok bool
+				if selected, ok = flups.FrameAt(history, t); !ok {
+					http.Error(w, "No frame at or before that time", http.StatusNotFound)
+					return
+				}
+			}
+			graph, frame = sim.Graph(), &selected
+		}
+	}
+	if graph == nil {
+		http.Error(w, "flups graph not loaded", http.StatusServiceUnavailable)
+		return
+	}
+
+	var buf bytes.Buffer
+	var err error
+	switch format {
+	case "", "svg":
+		w.Header().Set("Content-Type", "image/svg+xml")
+		err = flups.RenderSVG(&buf, graph, frame, options)
+	case "png":
+		w.Header().Set("Content-Type", "image/png")
+		err = flups.RenderPNG(&buf, graph, frame, options)
+	default:
+		http.Error(w, "format must be svg or png", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Write(buf.Bytes())
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"hexperiment-system-protocol/flups"
+)
+
+// Recorded flups runs, persisted to FLUPS_RUN_DIR when set
+var flupsRuns *flups.RunStore
+
+// loadFlupsRuns opens the run store at startup
+func loadFlupsRuns() {
+	dir := os.Getenv("FLUPS_RUN_DIR")
+	store, err := flups.NewRunStore(dir)
+	if err != nil {
+		log.Printf("⚠️ Problems loading flups runs from %s: %v", dir, err)
+	}
+	flupsRuns = store
+	if dir != "" {
+		log.Printf("🔺 Loaded %d flups runs from %s", len(store.List()), dir)
+	}
+}
+
+// Flups run list handler
+func flupsRunListHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	runs := flupsRuns.List()
+	infos := make([]flups.RunInfo, len(runs))
+	for i, run := range runs {
+		infos[i] = run.Info()
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"count": len(infos),
+		"runs":  infos,
+	})
+}
+
+// Flups run handler: header and action log as JSON, or the raw NDJSON log
+// with ?format=ndjson
+func flupsRunHandler(w http.ResponseWriter, r *http.Request) {
+	run, ok := flupsRuns.Get(mux.Vars(r)["id"])
+	if !ok {
+		http.Error(w, "Run not found", http.StatusNotFound)
+		return
+	}
+
+	if r.URL.Query().Get("format") == "ndjson" {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.ndjson"`, run.Header.ID))
+		if err := run.WriteLog(w); err != nil {
+			log.Printf("⚠️ Failed to write flups run %s: %v", run.Header.ID, err)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"run":     run.Info(),
+		"header":  run.Header,
+		"actions": run.Actions(),
+	})
+}
+
+// Flups replay handler: rebuilds a run's state after ?step=N actions
+// (default: the whole log)
+func flupsRunReplayHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	run, ok := flupsRuns.Get(mux.Vars(r)["id"])
+	if !ok {
+		http.Error(w, "Run not found", http.StatusNotFound)
+		return
+	}
+
+	step := run.Info().LastStep
+	if s := r.URL.Query().Get("step"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			http.Error(w, "step must be a non-negative integer", http.StatusBadRequest)
+			return
+		}
+		step = n
+	}
+
+	engine, err := flupsRuns.Replay(run.Header.ID, step)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":     true,
+		"runId":       run.Header.ID,
+		"step":        engine.Steps(),
+		"time":        engine.Time(),
+		"frozen":      engine.Frozen(),
+		"halted":      engine.Halted(),
+		"totalEnergy": engine.TotalEnergy(),
+		"nodes":       engine.Nodes(),
+	})
+}
+
+// Flups fork handler: continues the simulation as a new run branched from
+// a step of an existing run, optionally with different rules
+func flupsRunForkHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var request struct {
+		Step       *int         `json:"step"`
+		Rules      []flups.Rule `json:"rules"`
+		RuleSource string       `json:"ruleSource"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	parent, ok := flupsRuns.Get(mux.Vars(r)["id"])
+	if !ok {
+		http.Error(w, "Run not found", http.StatusNotFound)
+		return
+	}
+	step := parent.Info().LastStep
+	if request.Step != nil {
+		step = *request.Step
+	}
+
+	rules := request.Rules
+	if request.RuleSource != "" {
+		parsed, err := flups.ParseRules(request.RuleSource)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			response := map[string]interface{}{
+				"success": false,
+				"error":   err.Error(),
+			}
+			var parseErr *flups.ParseError
+			if errors.As(err, &parseErr) {
+				response["line"] = parseErr.Line
+				response["col"] = parseErr.Col
+			}
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+		rules = parsed
+	}
+
+	sim, err := currentFlupsSimulator()
+	if err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+	run, err := sim.Fork(parent.Header.ID, step, rules)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		response := map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		}
+		var validationErr *flups.ValidationError
+		if errors.As(err, &validationErr) {
+			response["problems"] = validationErr.Problems
+		}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	log.Printf("🔺 Forked flups run %s from %s at step %d", run.Header.ID, parent.Header.ID, step)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"run":     run.Info(),
+		"state":   sim.Snapshot(),
+	})
+}
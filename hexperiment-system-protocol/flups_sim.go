@@ -0,0 +1,382 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"hexperiment-system-protocol/flups"
+)
+
+const (
+	maxFlupsSimSteps      = 1000
+	minFlupsSimIntervalMs = 10
+)
+
+// The virtual time simulation over the loaded flups graph, created on first use
+var flupsSim = struct {
+	sync.Mutex
+	sim *flups.Simulator
+}{}
+
+// currentFlupsSimulator returns the simulation, creating it from the loaded graph if needed
+func currentFlupsSimulator() (*flups.Simulator, error) {
+	flupsSim.Lock()
+	defer flupsSim.Unlock()
+	if flupsSim.sim != nil {
+		return flupsSim.sim, nil
+	}
+	graph := currentFlupsGraph()
+	if graph == nil {
+		return nil, fmt.Errorf("flups graph not loaded")
+	}
+	sim, err := newFlupsSimulator(graph, flups.DefaultConfig(graph))
+	if err != nil {
+		return nil, err
+	}
+	if flupsRuns != nil {
+		if err := sim.Record(flupsRuns); err != nil {
+			return nil, err
+		}
+	}
+	flupsSim.sim = sim
+	return sim, nil
+}
+
+// newFlupsSimulator creates a simulator that broadcasts every executed action,
+// its spacetime frame, and every energy conservation violation
+func newFlupsSimulator(graph *flups.Graph, config flups.Config) (*flups.Simulator, error) {
+	sim, err := flups.NewSimulator(graph, config)
+	if err != nil {
+		return nil, err
+	}
+	sim.OnAction = func(action flups.Action, snapshot flups.Snapshot) {
+		broadcast <- Protocol{
+			ID:   fmt.Sprintf("flups-action-%d-%d", action.Step, time.Now().UnixNano()),
+			Type: "flups_action",
+			Data: map[string]interface{}{
+				"action":       action,
+				"time":         snapshot.Time,
+				"steps":        snapshot.Steps,
+				"total_energy": snapshot.TotalEnergy,
+				"nodes":        snapshot.Nodes,
+			},
+			Timestamp: time.Now(),
+			Status:    "executed",
+		}
+	}
+	sim.OnFrame = func(frame flups.Frame) {
+		broadcast <- Protocol{
+			ID:   fmt.Sprintf("flups-frame-%d-%d", frame.Step, time.Now().UnixNano()),
+			Type: "flups_frame",
+			Data: map[string]interface{}{
+				"step":   frame.Step,
+				"time":   frame.Time,
+				"action": frame.Action,
+				"nodes":  frame.Nodes,
+			},
+			Timestamp: time.Now(),
+			Status:    "executed",
+		}
+	}
+	sim.OnFrozen = func(snapshot flups.Snapshot) {
+		broadcast <- Protocol{
+			ID:   fmt.Sprintf("flups-frozen-%d", time.Now().UnixNano()),
+			Type: "flups_frozen",
+			Data: map[string]interface{}{
+				"time":   snapshot.Time,
+				"steps":  snapshot.Steps,
+				"halted": snapshot.Halted,
+			},
+			Timestamp: time.Now(),
+			Status:    "frozen",
+		}
+	}
+	sim.OnViolation = func(violation flups.Violation) {
+		log.Printf("⚠️ Flups energy not conserved at step %d: %g -> %g", violation.Step, violation.Expected, violation.Actual)
+		broadcast <- Protocol{
+			ID:   fmt.Sprintf("flups-violation-%d-%d", violation.Step, time.Now().UnixNano()),
+			Type: "flups_invariant_violation",
+			Data: map[string]interface{}{
+				"step":     violation.Step,
+				"time":     violation.Time,
+				"action":   violation.Action,
+				"expected": violation.Expected,
+				"actual":   violation.Actual,
+				"delta":    violation.Delta,
+			},
+			Timestamp: time.Now(),
+			Status:    "violation",
+		}
+	}
+	return sim, nil
+}
+
+// Flups simulation handler: GET returns state, POST runs start/step/pause/reset
+func flupsSimHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	sim, err := currentFlupsSimulator()
+	if err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	if r.Method == "GET" {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"state":   sim.Snapshot(),
+			"config":  sim.Config(),
+			"summary": sim.Summary(),
+			"runId":   sim.RunID(),
+		})
+		return
+	}
+
+	var request struct {
+		Command    string        `json:"command"`
+		Steps      int           `json:"steps"`
+		IntervalMs int           `json:"intervalMs"`
+		Config     *flups.Config `json:"config"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	response := map[string]interface{}{
+		"success": true,
+		"command": request.Command,
+	}
+	switch request.Command {
+	case "start":
+		if request.IntervalMs == 0 {
+			request.IntervalMs = 1000
+		}
+		if request.IntervalMs < minFlupsSimIntervalMs {
+			request.IntervalMs = minFlupsSimIntervalMs
+		}
+		if err := sim.Start(time.Duration(request.IntervalMs) * time.Millisecond); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+	case "step":
+		if request.Steps <= 0 {
+			request.Steps = 1
+		}
+		if request.Steps > maxFlupsSimSteps {
+			request.Steps = maxFlupsSimSteps
+		}
+		response["actions"] = sim.Step(request.Steps)
+	case "pause":
+		sim.Pause()
+	case "reset":
+		if err := sim.Reset(request.Config); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "command must be one of start, step, pause, reset", http.StatusBadRequest)
+		return
+	}
+
+	response["state"] = sim.Snapshot()
+	response["summary"] = sim.Summary()
+	json.NewEncoder(w).Encode(response)
+}
+
+// Flups summary handler: run statistics and energy conservation violations
+// since the last reset
+func flupsSimSummaryHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	sim, err := currentFlupsSimulator()
+	if err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"summary": sim.Summary(),
+	})
+}
+
+// Flups history handler: recorded frames, optionally sliced by virtual time
+// with ?from=&to=, or the single time slice at ?at=
+func flupsSimHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	sim, err := currentFlupsSimulator()
+	if err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	query := r.URL.Query()
+	frames := sim.History()
+	if at := query.Get("at"); at != "" {
+		t, err := strconv.Atoi(at)
+		if err != nil || t < 0 {
+			http.Error(w, "at must be a non-negative integer", http.StatusBadRequest)
+			return
+		}
+		frame, ok := flups.FrameAt(frames, t)
+		if !ok {
+			http.Error(w, "No frame at or before that time", http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"frame":   frame,
+		})
+		return
+	}
+
+	from, to := 0, -1
+	for name, target := range map[string]*int{"from": &from, "to": &to} {
+		if v := query.Get(name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				http.Error(w, name+" must be a non-negative integer", http.StatusBadRequest)
+				return
+			}
+			*target = n
+		}
+	}
+	sliced := flups.SliceFrames(frames, from, to)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"count":   len(sliced),
+		"frames":  sliced,
+	})
+}
+
+// Flups history download handler: all recorded frames as NDJSON
+// (?format=ndjson, the default) or in the compact binary format (?format=binary)
+func flupsSimHistoryDownloadHandler(w http.ResponseWriter, r *http.Request) {
+	sim, err := currentFlupsSimulator()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	frames := sim.History()
+	switch format := r.URL.Query().Get("format"); format {
+	case "", "ndjson":
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Content-Disposition", `attachment; filename="flups-history.ndjson"`)
+		err = flups.WriteNDJSON(w, frames)
+	case "binary":
+		// Encode first so a history the format cannot hold gets an error
+		// response instead of an empty download
+		var buf bytes.Buffer
+		if err := flups.WriteBinary(&buf, sim.Graph(), frames); err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", `attachment; filename="flups-history.bin"`)
+		_, err = w.Write(buf.Bytes())
+	default:
+		http.Error(w, "format must be ndjson or binary", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Printf("⚠️ Failed to write flups history: %v", err)
+	}
+}
+
+// Flups rules handler: GET returns the simulation's rules as rule language
+// source; PUT/POST uploads new source and resets the simulation with it
+func flupsSimRulesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	sim, err := currentFlupsSimulator()
+	if err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	if r.Method != "GET" {
+		source, err := readRuleSource(w, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		config := sim.Config()
+		config.Rules = nil
+		config.RuleSource = source
+		if err := sim.Reset(&config); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			response := map[string]interface{}{
+				"success": false,
+				"error":   err.Error(),
+			}
+			var parseErr *flups.ParseError
+			var validationErr *flups.ValidationError
+			if errors.As(err, &parseErr) {
+				response["line"] = parseErr.Line
+				response["col"] = parseErr.Col
+			} else if errors.As(err, &validationErr) {
+				response["problems"] = validationErr.Problems
+			}
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+	}
+
+	config := sim.Config()
+	source := config.RuleSource
+	if source == "" {
+		source = flups.FormatRules(config.Rules)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"source":  source,
+		"rules":   config.Rules,
+	})
+}
+
+// readRuleSource accepts rule source as a text/plain body or as {"source": "..."}
+func readRuleSource(w http.ResponseWriter, r *http.Request) (string, error) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+	if err != nil {
+		return "", fmt.Errorf("failed to read rules: %v", err)
+	}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		var request struct {
+			Source string `json:"source"`
+		}
+		if err := json.Unmarshal(body, &request); err != nil {
+			return "", fmt.Errorf("invalid JSON")
+		}
+		body = []byte(request.Source)
+	}
+	if strings.TrimSpace(string(body)) == "" {
+		return "", fmt.Errorf("rule source is empty")
+	}
+	return string(body), nil
+}
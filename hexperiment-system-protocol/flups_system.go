@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"hexperiment-system-protocol/flups"
+)
+
+// The multi-subsystem simulation, created with the "create" command
+var flupsSystem = struct {
+	sync.Mutex
+	system *flups.System
+}{}
+
+// newFlupsSystem creates a system that broadcasts every tick with the
+// subsystems' own clocks
+func newFlupsSystem(config flups.SystemConfig) (*flups.System, error) {
+	system, err := flups.NewSystem(config)
+	if err != nil {
+		return nil, err
+	}
+	system.OnTick = func(result flups.TickResult, snapshot flups.SystemSnapshot) {
+		clocks := make(map[string]int, len(snapshot.Subsystems))
+		for _, sub := range snapshot.Subsystems {
+			clocks[sub.ID] = sub.Time
+		}
+		broadcast <- Protocol{
+			ID:   fmt.Sprintf("flups-system-tick-%d-%d", result.Tick, time.Now().UnixNano()),
+			Type: "flups_system_tick",
+			Data: map[string]interface{}{
+				"tick":         result.Tick,
+				"actions":      result.Actions,
+				"messages":     result.Messages,
+				"clocks":       clocks,
+				"total_energy": snapshot.TotalEnergy,
+			},
+			Timestamp: time.Now(),
+			Status:    "executed",
+		}
+	}
+	system.OnFrozen = func(snapshot flups.SystemSnapshot) {
+		broadcast <- Protocol{
+			ID:   fmt.Sprintf("flups-system-frozen-%d", time.Now().UnixNano()),
+			Type: "flups_system_frozen",
+			Data: map[string]interface{}{
+				"tick": snapshot.Tick,
+			},
+			Timestamp: time.Now(),
+			Status:    "frozen",
+		}
+	}
+	return system, nil
+}
+
+// Flups system handler: GET returns per-subsystem state; POST runs
+// create/start/step/pause/reset. "create" takes an explicit config, or splits
+// the active flups graph into one subsystem per lattice cell with optional
+// per-cell rates and the amount each cross-cell coupling carries.
+func flupsSystemHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	flupsSystem.Lock()
+	system := flupsSystem.system
+	flupsSystem.Unlock()
+
+	if r.Method == "GET" {
+		if system == nil {
+			http.Error(w, "No flups system; POST a create command first", http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"state":  system.Snapshot(),
+			"config": system.Config(),
+		})
+		return
+	}
+
+	var request struct {
+		Command        string              `json:"command"`
+		Steps          int                 `json:"steps"`
+		IntervalMs     int                 `json:"intervalMs"`
+		Config         *flups.SystemConfig `json:"config"`
+		Rates          map[string]int      `json:"rates"`
+		CouplingAmount float64             `json:"couplingAmount"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	if request.Command == "create" {
+		config := request.Config
+		if config == nil {
+			graph := currentFlupsGraph()
+			if graph == nil {
+				http.Error(w, "flups graph not loaded", http.StatusServiceUnavailable)
+				return
+			}
+			if request.CouplingAmount == 0 {
+				request.CouplingAmount = 1
+			}
+			cells := flups.CellSubsystems(graph, request.Rates, request.CouplingAmount)
+			config = &cells
+		}
+		created, err := newFlupsSystem(*config)
+		if err != nil {
+			writeFlupsSystemError(w, err)
+			return
+		}
+		flupsSystem.Lock()
+		if flupsSystem.system != nil {
+			flupsSystem.system.Pause()
+		}
+		flupsSystem.system = created
+		flupsSystem.Unlock()
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"command": request.Command,
+			"state":   created.Snapshot(),
+		})
+		return
+	}
+
+	if system == nil {
+		http.Error(w, "No flups system; POST a create command first", http.StatusNotFound)
+		return
+	}
+	response := map[string]interface{}{
+		"success": true,
+		"command": request.Command,
+	}
+	switch request.Command {
+	case "start":
+		if request.IntervalMs == 0 {
+			request.IntervalMs = 1000
+		}
+		if request.IntervalMs < minFlupsSimIntervalMs {
+			request.IntervalMs = minFlupsSimIntervalMs
+		}
+		if err := system.Start(time.Duration(request.IntervalMs) * time.Millisecond); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+	case "step":
+		if request.Steps <= 0 {
+			request.Steps = 1
+		}
+		if request.Steps > maxFlupsSimSteps {
+			request.Steps = maxFlupsSimSteps
+		}
+		response["ticks"] = system.Step(request.Steps)
+	case "pause":
+		system.Pause()
+	case "reset":
+		if err := system.Reset(request.Config); err != nil {
+			writeFlupsSystemError(w, err)
+			return
+		}
+	default:
+		http.Error(w, "command must be one of create, start, step, pause, reset", http.StatusBadRequest)
+		return
+	}
+
+	response["state"] = system.Snapshot()
+	json.NewEncoder(w).Encode(response)
+}
+
+// writeFlupsSystemError reports an invalid system config with its problems
+func writeFlupsSystemError(w http.ResponseWriter, err error) {
+	w.WriteHeader(http.StatusBadRequest)
+	response := map[string]interface{}{
+		"success": false,
+		"error":   err.Error(),
+	}
+	var validationErr *flups.ValidationError
+	if errors.As(err, &validationErr) {
+		response["problems"] = validationErr.Problems
+	}
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Job statuses
+const (
+	jobQueued    = "queued"
+	jobRunning   = "running"
+	jobCompleted = "completed"
+	jobFailed    = "failed"
+	jobCancelled = "cancelled"
+)
+
+const maxAsyncVariations = 50
+
+// Unfinished jobs allowed at once; each holds an enqueuing goroutine
+const maxPendingJobs = 20
+
+var errJobQueueFull = errors.New("job queue full")
+
+// Finished jobs are kept this long, and at most this many
+const (
+	finishedJobTTL  = time.Hour
+	maxFinishedJobs = 100
+)
+
+// JobError records a failure for one item of a job
+type JobError struct {
+	Index int    `json:"index"`
+	Error string `json:"error"`
+}
+
+// Job is a batch of persona enhancements processed by the worker pool
+type Job struct {
+	mu        sync.Mutex
+	ID        string     `json:"id"`
+	Type      string     `json:"type"`
+	Status    string     `json:"status"`
+	Total     int        `json:"total"`
+	Completed int        `json:"completed"`
+	Failed    int        `json:"failed"`
+	Results   []Persona  `json:"results"`
+	Errors    []JobError `json:"errors"`
+	Created   time.Time  `json:"created"`
+	Started   *time.Time `json:"started,omitempty"`
+	Finished  *time.Time `json:"finished,omitempty"`
+
+	personas []Persona
+	ctx      context.Context
+	cancel   context.CancelFunc
+}
+
+// jobTask is one persona of a job waiting for a worker
+type jobTask struct {
+	job   *Job
+	index int
+}
+
+// JobManager runs persona enhancement jobs on a bounded worker pool
+type JobManager struct {
+	mu      sync.RWMutex
+	jobs    map[string]*Job
+	tasks   chan jobTask
+	workers int
+}
+
+var jobManager *JobManager
+
+// NewJobManager creates a manager; call Start to launch its workers
+func NewJobManager(workers int) *JobManager {
+	if workers < 1 {
+		workers = 1
+	}
+	return &JobManager{
+		jobs:    make(map[string]*Job),
+		tasks:   make(chan jobTask, workers*maxAsyncVariations),
+		workers: workers,
+	}
+}
+
+// jobWorkersFromEnv reads JOB_WORKERS, defaulting to 4
+func jobWorkersFromEnv() int {
+	if n, err := strconv.Atoi(os.Getenv("JOB_WORKERS")); err == nil && n > 0 {
+		return n
+	}
+	return 4
+}
+
+// Start launches the worker pool
+func (m *JobManager) Start() {
+	for i := 0; i < m.workers; i++ {
+		go m.worker()
+	}
+}
+
+// SubmitPersonaBatch generates base personas and queues their AI
+// enhancement, failing with errJobQueueFull when maxPendingJobs are unfinished
+func (m *JobManager) SubmitPersonaBatch(socialSetting, trait string, variations int) (*Job, error) {
+	if variations < 1 {
+		return nil, fmt.Errorf("variations must be at least 1")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	job := &Job{
+		ID:       fmt.Sprintf("job-%d", time.Now().UnixNano()),
+		Type:     "persona_batch",
+		Status:   jobQueued,
+		Total:    variations,
+		Results:  []Persona{},
+		Errors:   []JobError{},
+		Created:  time.Now(),
+		personas: make([]Persona, variations),
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+	for i := range job.personas {
+		job.personas[i] = generatePersona(socialSetting, trait, false)
+	}
+
+	m.mu.Lock()
+	m.prune(time.Now())
+	if m.pending() >= maxPendingJobs {
+		m.mu.Unlock()
+		cancel()
+		return nil, errJobQueueFull
+	}
+	m.jobs[job.ID] = job
+	m.mu.Unlock()
+
+	// Enqueue without blocking the caller when the queue is full
+	go func() {
+		for i := 0; i < variations; i++ {
+			select {
+			case m.tasks <- jobTask{job: job, index: i}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return job, nil
+}
+
+// pending counts unfinished jobs. Callers hold m.mu.
+func (m *JobManager) pending() int {
+	count := 0
+	for _, job := range m.jobs {
+		job.mu.Lock()
+		if job.Finished == nil {
+			count++
+		}
+		job.mu.Unlock()
+	}
+	return count
+}
+
+// prune drops finished jobs older than finishedJobTTL, then the oldest
+// beyond maxFinishedJobs. Callers hold m.mu.
+func (m *JobManager) prune(now time.Time) {
+	type finishedJob struct {
+		id string
+		at time.Time
+	}
+	var finished []finishedJob
+	for id, job := range m.jobs {
+		job.mu.Lock()
+		at := job.Finished
+		job.mu.Unlock()
+		if at == nil {
+			continue
+		}
+		if now.Sub(*at) > finishedJobTTL {
+			delete(m.jobs, id)
+			continue
+		}
+		finished = append(finished, finishedJob{id, *at})
+	}
+	if excess := len(finished) - maxFinishedJobs; excess > 0 {
+		sort.Slice(finished, func(i, j int) bool { return finished[i].at.Before(finished[j].at) })
+		for _, job := range finished[:excess] {
+			delete(m.jobs, job.id)
+		}
+	}
+}
+
+// Get returns a job by ID
+func (m *JobManager) Get(id string) (*Job, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	job, ok := m.jobs[id]
+	return job, ok
+}
+
+// List returns all known jobs
+func (m *JobManager) List() []*Job {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	jobs := make([]*Job, 0, len(m.jobs))
+	for _, job := range m.jobs {
+		jobs = append(jobs, job)
+	}
+	return jobs
+}
+
+// Cancel stops a job; items already enhanced are kept as partial results
+func (m *JobManager) Cancel(id string) (*Job, bool) {
+	job, ok := m.Get(id)
+	if !ok {
+		return nil, false
+	}
+	job.mu.Lock()
+	active := job.Status == jobQueued || job.Status == jobRunning
+	if active {
+		job.Status = jobCancelled
+		now := time.Now()
+		job.Finished = &now
+	}
+	job.mu.Unlock()
+	job.cancel()
+	if active {
+		broadcastJobEvent(job, "job_completed")
+	}
+	return job, true
+}
+
+func (m *JobManager) worker() {
+	for task := range m.tasks {
+		m.process(task)
+	}
+}
+
+func (m *JobManager) process(task jobTask) {
+	job := task.job
+	if job.ctx.Err() != nil {
+		return
+	}
+
+	job.mu.Lock()
+	if job.Started == nil {
+		now := time.Now()
+		job.Started = &now
+		job.Status = jobRunning
+	}
+	persona := job.personas[task.index]
+	job.mu.Unlock()
+
+	err := enhancePersonaWithAIContext(job.ctx, &persona)
+
+	job.mu.Lock()
+	if job.Status == jobCancelled {
+		job.mu.Unlock()
+		return
+	}
+	if err != nil {
+		job.Failed++
+		job.Errors = append(job.Errors, JobError{Index: task.index, Error: err.Error()})
+	} else {
+		job.Completed++
+		job.personas[task.index] = persona
+		job.Results = append(job.Results, persona)
+	}
+	finished := job.Completed+job.Failed == job.Total
+	if finished {
+		now := time.Now()
+		job.Finished = &now
+		job.Status = jobCompleted
+		if job.Completed == 0 {
+			job.Status = jobFailed
+		}
+	}
+	job.mu.Unlock()
+
+	if err == nil {
+		personaRegistry.Save(persona)
+	}
+	if finished {
+		job.cancel()
+		broadcastJobEvent(job, "job_completed")
+	} else {
+		broadcastJobEvent(job, "job_progress")
+	}
+}
+
+// snapshot returns a copy of the job safe to encode while workers are running
+func (j *Job) snapshot() map[string]interface{} {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return map[string]interface{}{
+		"id":        j.ID,
+		"type":      j.Type,
+		"status":    j.Status,
+		"total":     j.Total,
+		"completed": j.Completed,
+		"failed":    j.Failed,
+		"progress":  float64(j.Completed+j.Failed) / float64(j.Total),
+		"results":   append([]Persona(nil), j.Results...),
+		"errors":    append([]JobError(nil), j.Errors...),
+		"created":   j.Created,
+		"started":   j.Started,
+		"finished":  j.Finished,
+	}
+}
+
+// broadcastJobEvent pushes job progress to WebSocket clients
+func broadcastJobEvent(job *Job, eventType string) {
+	job.mu.Lock()
+	data := map[string]interface{}{
+		"job_id":    job.ID,
+		"job_type":  job.Type,
+		"completed": job.Completed,
+		"failed":    job.Failed,
+		"total":     job.Total,
+	}
+	status := job.Status
+	job.mu.Unlock()
+
+	broadcast <- Protocol{
+		ID:        fmt.Sprintf("%s-%s-%d", eventType, job.ID, time.Now().UnixNano()),
+		Type:      eventType,
+		Data:      data,
+		Timestamp: time.Now(),
+		Status:    status,
+	}
+}
+
+// Job status handler
+func jobStatusHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	job, ok := jobManager.Get(mux.Vars(r)["id"])
+	if !ok {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(job.snapshot())
+}
+
+// Job list handler
+func jobListHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	jobs := jobManager.List()
+	summaries := make([]map[string]interface{}, len(jobs))
+	for i, job := range jobs {
+		summary := job.snapshot()
+		delete(summary, "results")
+		summaries[i] = summary
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"count": len(summaries),
+		"jobs":  summaries,
+	})
+}
+
+// Job cancel handler
+func jobCancelHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	job, ok := jobManager.Cancel(mux.Vars(r)["id"])
+	if !ok {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+	log.Printf("🛑 Job %s cancelled", job.ID)
+	json.NewEncoder(w).Encode(job.snapshot())
+}
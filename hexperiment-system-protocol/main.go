@@ -2,14 +2,15 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
-	"io"
 	"log"
 	"math/rand"
 	"net/http"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -72,38 +73,12 @@ type Usage struct {
 }
 
 // WebSocket upgrader
-var 
-
-upgrader = websocket.Ada{
+var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
+	// Origins are checked against the CORS policy's rule for /ws
 	CheckOrigin: func(r *http.Request) bool {
-		// Get allowed origins from environment
-		allowedOrigins := os.Getenv("WEBSOCKET_ALLOWED_ORIGINS")
-		
-		// Development mode: allow all origins
-		if allowedOrigins == "" || allowedOrigins == "*" {
-			log.Println("[WebSocket] WARNING: Allowing all origins. Set WEBSOCKET_ALLOWED_ORIGINS in production!")
-			return true
-		}
-		
-		// Production mode: check against allowed origins
-		origin := r.Header.Get("Origin")
-		if origin == "" {
-			// No origin header, could be non-browser client
-			return true
-		}
-		
-		// Check if origin is in allowed list
-		allowedList := strings.Split(allowedOrigins, ",")
-		for _, allowed := range allowedList {
-			if strings.TrimSpace(allowed) == origin {
-				return true
-			}
-		}
-		
-		log.Printf("[WebSocket] Rejected connection from origin: %s", origin)
-		return false
+		return corsPolicy.CheckOrigin(r)
 	},
 	// Enable compression
 	EnableCompression: true,
@@ -123,6 +98,18 @@ type Client struct {
 	id       string
 	joinTime time.Time
 	metadata map[string]interface{}
+	limiter  *messageLimiter
+	writeMu  sync.Mutex
+	// ctx is cancelled when the connection closes, stopping work started
+	// on the client's behalf
+	ctx context.Context
+}
+
+// send writes a protocol message to the client, serializing concurrent writers
+func (c *Client) send(protocol Protocol) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.conn.WriteJSON(protocol)
 }
 
 var clients = make(map[string]*Client)
@@ -166,164 +153,122 @@ func main() {
 		port = "8080"
 	}
 
+	loadJWTVerifier()
+	tlsConfig := loadTLSConfig()
+	loadAPIKeys()
+	rateLimits = NewRateLimiter(loadRateLimitConfig())
+	loadCORSPolicy()
+	loadAuditLog()
+	loadUpstreams()
+	jobManager = NewJobManager(jobWorkersFromEnv())
+	loadFlupsGraph()
+	loadFlupsRuns()
+
+	// Persona evolution rules can be overridden with PERSONA_EVOLUTION_RULES
+	if err := personaEvolution.SetConfig(loadEvolutionConfig()); err != nil {
+		log.Printf("⚠️ Persona evolution rules: %v", err)
+	}
+
 	// Initialize router
 	r := mux.NewRouter()
 
-	// --- Security: CORS Middleware for cross-container and browser security ---
-	r.Use(corsMiddleware)
+	// --- Security: audit log of mutating and rejected requests ---
+	r.Use(auditMiddleware)
 
-	// --- Security: API Key Middleware for protected endpoints ---
+	// --- Security: scoped API keys for protected endpoints ---
 	r.HandleFunc("/api/health", healthHandler).Methods("GET")
-	r.Handle("/api/protocol", apiKeyAuthMiddleware(http.HandlerFunc(protocolHandler))).Methods("GET", "POST")
-	r.Handle("/api/status", apiKeyAuthMiddleware(http.HandlerFunc(statusHandler))).Methods("GET")
+	r.Handle("/api/protocol", requireScope(scopeProtocolRead, http.HandlerFunc(protocolHandler))).Methods("GET")
+	r.Handle("/api/protocol", requireScope(scopeProtocolBroadcast, http.HandlerFunc(protocolHandler))).Methods("POST")
+	r.Handle("/api/status", requireScope(scopeProtocolRead, http.HandlerFunc(statusHandler))).Methods("GET")
 
 	// Enhanced endpoints
-	r.Handle("/api/persona/generate", apiKeyAuthMiddleware(http.HandlerFunc(personaGenerationHandler))).Methods("POST")
-	r.Handle("/api/lmstudio/chat", apiKeyAuthMiddleware(http.HandlerFunc(lmStudioChatHandler))).Methods("POST")
-	r.Handle("/api/realtime/status", apiKeyAuthMiddleware(http.HandlerFunc(realtimeStatusHandler))).Methods("GET")
-
-	// WebSocket endpoint
+	r.Handle("/api/persona/generate", requireScope(scopePersonaWrite, http.HandlerFunc(personaGenerationHandler))).Methods("POST")
+	r.Handle("/api/persona/analyze", requireScope(scopePersonaRead, http.HandlerFunc(personaAnalysisHandler))).Methods("POST")
+	r.Handle("/api/persona/export", requireScope(scopePersonaRead, http.HandlerFunc(personaExportHandler))).Methods("GET")
+	r.Handle("/api/persona/import", requireScope(scopePersonaWrite, http.HandlerFunc(personaImportHandler))).Methods("POST")
+	r.Handle("/api/persona/dialogue", requireScope(scopePersonaWrite, http.HandlerFunc(personaDialogueHandler))).Methods("POST")
+	r.Handle("/api/persona/dialogue/{id}", requireScope(scopePersonaRead, http.HandlerFunc(personaDialogueTranscriptHandler))).Methods("GET")
+	r.Handle("/api/persona/dialogue/{id}", requireScope(scopePersonaWrite, http.HandlerFunc(personaDialogueCancelHandler))).Methods("DELETE")
+	r.Handle("/api/persona/evolution/rules", requireScope(scopePersonaRead, http.HandlerFunc(personaEvolutionRulesHandler))).Methods("GET")
+	r.Handle("/api/persona/evolution/rules", requireScope(scopePersonaWrite, http.HandlerFunc(personaEvolutionRulesHandler))).Methods("PUT")
+	r.Handle("/api/persona/{id}/actions", requireScope(scopePersonaWrite, http.HandlerFunc(personaActionHandler))).Methods("POST")
+	r.Handle("/api/persona/{id}/history", requireScope(scopePersonaRead, http.HandlerFunc(personaHistoryHandler))).Methods("GET")
+	r.Handle("/api/persona/{id}/state", requireScope(scopePersonaRead, http.HandlerFunc(personaStateHandler))).Methods("GET")
+	r.Handle("/api/jobs", requireScope(scopeJobsRead, http.HandlerFunc(jobListHandler))).Methods("GET")
+	r.Handle("/api/jobs/{id}", requireScope(scopeJobsRead, http.HandlerFunc(jobStatusHandler))).Methods("GET")
+	r.Handle("/api/jobs/{id}", requireScope(scopeJobsWrite, http.HandlerFunc(jobCancelHandler))).Methods("DELETE")
+	r.Handle("/api/jobs/{id}/cancel", requireScope(scopeJobsWrite, http.HandlerFunc(jobCancelHandler))).Methods("POST")
+	r.Handle("/api/lmstudio/chat", requireScope(scopeLMStudioChat, http.HandlerFunc(lmStudioChatHandler))).Methods("POST")
+	r.Handle("/api/realtime/status", requireScope(scopeProtocolRead, http.HandlerFunc(realtimeStatusHandler))).Methods("GET")
+
+	// Flups lattice endpoints
+	r.Handle("/api/flups/graph", requireScope(scopeFlupsRead, http.HandlerFunc(flupsGraphHandler))).Methods("GET")
+	r.Handle("/api/flups/lattice", requireScope(scopeFlupsWrite, http.HandlerFunc(flupsLatticeHandler))).Methods("POST")
+	r.Handle("/api/flups/analysis", requireScope(scopeFlupsRead, http.HandlerFunc(flupsAnalysisHandler))).Methods("GET", "POST")
+	r.Handle("/api/flups/analysis/path", requireScope(scopeFlupsRead, http.HandlerFunc(flupsPathHandler))).Methods("GET")
+	r.Handle("/api/flups/analysis/flow", requireScope(scopeFlupsRead, http.HandlerFunc(flupsFlowHandler))).Methods("GET")
+	r.Handle("/api/flups/render", requireScope(scopeFlupsRead, http.HandlerFunc(flupsRenderHandler))).Methods("GET", "POST")
+	r.Handle("/api/flups/sim", requireScope(scopeFlupsRead, http.HandlerFunc(flupsSimHandler))).Methods("GET")
+	r.Handle("/api/flups/sim", requireScope(scopeFlupsWrite, http.HandlerFunc(flupsSimHandler))).Methods("POST")
+	r.Handle("/api/flups/sim/rules", requireScope(scopeFlupsRead, http.HandlerFunc(flupsSimRulesHandler))).Methods("GET")
+	r.Handle("/api/flups/sim/rules", requireScope(scopeFlupsWrite, http.HandlerFunc(flupsSimRulesHandler))).Methods("PUT", "POST")
+	r.Handle("/api/flups/sim/summary", requireScope(scopeFlupsRead, http.HandlerFunc(flupsSimSummaryHandler))).Methods("GET")
+	r.Handle("/api/flups/sim/history", requireScope(scopeFlupsRead, http.HandlerFunc(flupsSimHistoryHandler))).Methods("GET")
+	r.Handle("/api/flups/sim/history/download", requireScope(scopeFlupsRead, http.HandlerFunc(flupsSimHistoryDownloadHandler))).Methods("GET")
+	r.Handle("/api/flups/runs", requireScope(scopeFlupsRead, http.HandlerFunc(flupsRunListHandler))).Methods("GET")
+	r.Handle("/api/flups/runs/{id}", requireScope(scopeFlupsRead, http.HandlerFunc(flupsRunHandler))).Methods("GET")
+	r.Handle("/api/flups/runs/{id}/replay", requireScope(scopeFlupsRead, http.HandlerFunc(flupsRunReplayHandler))).Methods("GET")
+	r.Handle("/api/flups/runs/{id}/fork", requireScope(scopeFlupsWrite, http.HandlerFunc(flupsRunForkHandler))).Methods("POST")
+	r.Handle("/api/flups/system", requireScope(scopeFlupsRead, http.HandlerFunc(flupsSystemHandler))).Methods("GET")
+	r.Handle("/api/flups/system", requireScope(scopeFlupsWrite, http.HandlerFunc(flupsSystemHandler))).Methods("POST")
+
+	// API key management
+	r.Handle("/api/admin/keys", requireScope(scopeAdmin, http.HandlerFunc(adminKeyListHandler))).Methods("GET")
+	r.Handle("/api/admin/keys", requireScope(scopeAdmin, http.HandlerFunc(adminKeyCreateHandler))).Methods("POST")
+	r.Handle("/api/admin/keys/{id}", requireScope(scopeAdmin, http.HandlerFunc(adminKeyRevokeHandler))).Methods("DELETE")
+	r.Handle("/api/admin/keys/{id}/rotate", requireScope(scopeAdmin, http.HandlerFunc(adminKeyRotateHandler))).Methods("POST")
+	r.Handle("/api/admin/audit", requireScope(scopeAdmin, http.HandlerFunc(adminAuditHandler))).Methods("GET")
+	r.Handle("/api/admin/audit/verify", requireScope(scopeAdmin, http.HandlerFunc(adminAuditVerifyHandler))).Methods("GET")
+
+	// Proxy handlers; they spend the server's own upstream tokens
+	r.Handle("/api/github", requireScope(scopeProxyGitHub, http.HandlerFunc(githubProxyHandler))).Methods("GET")
+	r.Handle("/api/huggingface", requireScope(scopeProxyHuggingFace, http.HandlerFunc(huggingfaceProxyHandler))).Methods("POST")
+	r.Handle("/api/proxy", requireScope(scopeAdmin, http.HandlerFunc(upstreamListHandler))).Methods("GET")
+	registerUpstreamRoutes(r)
+
+	// WebSocket endpoint; authenticates at upgrade or with the first message
 	r.HandleFunc("/ws", websocketHandler)
 
-	// Static files (if needed)
+	// Static files (if needed). The catch-all must stay last: routes
+	// registered after it are never reached.
 	r.PathPrefix("/").Handler(http.FileServer(http.Dir("./static/")))
 
-	// Proxy handlers
-	r.HandleFunc("/api/github", githubProxyHandler).Methods("GET")
-	r.HandleFunc("/api/huggingface", huggingfaceProxyHandler).Methods("POST")
-
 	// Start WebSocket message broadcaster
 	go handleMessages()
 
+	// Start the job worker pool
+	jobManager.Start()
+
 	// Start periodic status updates
 	go periodicStatusUpdates()
 
+	scheme, wsScheme := "http", "ws"
+	if tlsConfig != nil {
+		scheme, wsScheme = "https", "wss"
+	}
 	log.Printf("🚀 Hexperiment System Protocol Server starting on port %s", port)
-	log.Printf("📍 Health check: http://localhost:%s/api/health", port)
-	log.Printf("🔌 WebSocket: ws://localhost:%s/ws", port)
-	log.Printf("🧬 Persona generation: http://localhost:%s/api/persona/generate", port)
-	log.Printf("🤖 LM Studio integration: http://localhost:%s/api/lmstudio/chat", port)
-
-	if err := http.ListenAndServe(":"+port, r); err != nil {
+	log.Printf("📍 Health check: %s://localhost:%s/api/health", scheme, port)
+	log.Printf("🔌 WebSocket: %s://localhost:%s/ws", wsScheme, port)
+	log.Printf("🧬 Persona generation: %s://localhost:%s/api/persona/generate", scheme, port)
+	log.Printf("🤖 LM Studio integration: %s://localhost:%s/api/lmstudio/chat", scheme, port)
+
+	// --- Security: CORS policy in front of the router, so preflights are
+	// answered for every route. TLS when TLS_CERT_FILE or TLS_DEV_CERT is set ---
+	if err := serve(":"+port, corsMiddleware(r), tlsConfig); err != nil {
 		log.Fatal("❌ Server failed to start:", err)
 	}
 }
 
-// --- Security: CORS middleware implementation ---
-func corsMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// For private Docker/K8s networks, allow all origins for internal communication
-		// In production/public, set CORS_ALLOW_ORIGIN to a trusted domain
-		allowOrigin := os.Getenv("CORS_ALLOW_ORIGIN")
-		if allowOrigin == "" {
-			allowOrigin = "*" // Default: allow all for private/internal use
-		}
-		w.Header().Set("Access-Control-Allow-Origin", allowOrigin)
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-API-Key")
-		if r.Method == "OPTIONS" {
-			w.WriteHeader(http.StatusNoContent)
-			return
-		}
-		next.ServeHTTP(w, r)
-	})
-}
-
-// --- Security: API Key authentication middleware ---
-func apiKeyAuthMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		apiKey := os.Getenv("API_KEY")
-		if apiKey == "" {
-			log.Println("[SECURITY WARNING] API_KEY not set. All requests are allowed. Set API_KEY in production!")
-			next.ServeHTTP(w, r)
-			return
-		}
-		key := r.Header.Get("X-API-Key")
-		if key == "" {
-			key = r.URL.Query().Get("api_key")
-		}
-		if key != apiKey {
-			w.WriteHeader(http.StatusUnauthorized)
-			w.Write([]byte(`{"error":"Unauthorized: missing or invalid API key"}`))
-			return
-		}
-		next.ServeHTTP(w, r)
-	})
-}
-
-// --- Minimal GitHub API proxy (secure, no secrets in code) ---
-func githubProxyHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	githubToken := os.Getenv("GITHUB_TOKEN")
-	if githubToken == "" {
-		http.Error(w, "GITHUB_TOKEN not set", http.StatusForbidden)
-		return
-	}
-	// Only allow safe GET requests to public API endpoints
-	if r.Method != "GET" {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
-	path := r.URL.Query().Get("path")
-	if path == "" || strings.Contains(path, "..") {
-		http.Error(w, "Invalid path", http.StatusBadRequest)
-		return
-	}
-	apiURL := "https://api.github.com" + path
-	req, err := http.NewRequest("GET", apiURL, nil)
-	if err != nil {
-		http.Error(w, "Request error", http.StatusInternalServerError)
-		return
-	}
-	req.Header.Set("Authorization", "Bearer "+githubToken)
-	req.Header.Set("Accept", "application/vnd.github+json")
-	client := &http.Client{Timeout: 10 * time.Second}
-	resp, err := client.Do(req)
-	if err != nil {
-		http.Error(w, "GitHub API error", http.StatusBadGateway)
-		return
-	}
-	defer resp.Body.Close()
-	w.WriteHeader(resp.StatusCode)
-	io.Copy(w, resp.Body)
-}
-
-// --- Minimal HuggingFace API proxy (secure, no secrets in code) ---
-func huggingfaceProxyHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	hfToken := os.Getenv("HUGGINGFACE_TOKEN")
-	if hfToken == "" {
-		http.Error(w, "HUGGINGFACE_TOKEN not set", http.StatusForbidden)
-		return
-	}
-	if r.Method != "POST" {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
-	model := r.URL.Query().Get("model")
-	if model == "" || strings.Contains(model, "..") {
-		http.Error(w, "Invalid model", http.StatusBadRequest)
-		return
-	}
-	apiURL := "https://api-inference.huggingface.co/models/" + model
-	req, err := http.NewRequest("POST", apiURL, r.Body)
-	if err != nil {
-		http.Error(w, "Request error", http.StatusInternalServerError)
-		return
-	}
-	req.Header.Set("Authorization", "Bearer "+hfToken)
-	req.Header.Set("Content-Type", "application/json")
-	client := &http.Client{Timeout: 30 * time.Second}
-	resp, err := client.Do(req)
-	if err != nil {
-		http.Error(w, "HuggingFace API error", http.StatusBadGateway)
-		return
-	}
-	defer resp.Body.Close()
-	w.WriteHeader(resp.StatusCode)
-	io.Copy(w, resp.Body)
-}
-
 // --- Protocol handler ---
 func protocolHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
@@ -378,8 +323,27 @@ func statusHandler(w http.ResponseWriter, r *http.Request) {
 			"status":    "/api/status",
 			"websocket": "/ws",
 			"persona":   "/api/persona/generate",
+			"analyze":   "/api/persona/analyze",
+			"export":    "/api/persona/export",
+			"import":    "/api/persona/import",
+			"dialogue":  "/api/persona/dialogue",
+			"evolution": "/api/persona/{id}/actions",
+			"jobs":      "/api/jobs",
 			"lmstudio":  "/api/lmstudio/chat",
 			"realtime":  "/api/realtime/status",
+			"flups":     "/api/flups/graph",
+			"lattice":   "/api/flups/lattice",
+			"analysis":  "/api/flups/analysis",
+			"render":    "/api/flups/render",
+			"flups_sim": "/api/flups/sim",
+			"rules":     "/api/flups/sim/rules",
+			"summary":   "/api/flups/sim/summary",
+			"history":   "/api/flups/sim/history",
+			"runs":      "/api/flups/runs",
+			"system":    "/api/flups/system",
+			"keys":      "/api/admin/keys",
+			"audit":     "/api/admin/audit",
+			"proxy":     "/api/proxy",
 		},
 		"timestamp": time.Now().UTC().Format(time.RFC3339),
 	}
@@ -395,6 +359,9 @@ func personaGenerationHandler(w http.ResponseWriter, r *http.Request) {
 		Trait         string `json:"trait"`
 		Variations    int    `json:"variations"`
 		UseAI         bool   `json:"useAI"`
+		Format        string `json:"format"`
+		Analyze       bool   `json:"analyze"`
+		Async         bool   `json:"async"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
@@ -402,23 +369,61 @@ func personaGenerationHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	format, err := negotiatePersonaFormat(r, request.Format)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	// Default values
 	if request.Variations == 0 {
 		request.Variations = 1
 	}
-	if request.Variations > 10 {
-		request.Variations = 10
+	if request.Variations < 1 {
+		http.Error(w, "variations must be at least 1", http.StatusBadRequest)
+		return
 	}
 	if request.SocialSetting == "" {
 		request.SocialSetting = "work"
 	}
 
+	// AI-enhanced batches can be queued as a job instead of blocking the request
+	if request.Async && request.UseAI {
+		if request.Variations > maxAsyncVariations {
+			request.Variations = maxAsyncVariations
+		}
+		job, err := jobManager.SubmitPersonaBatch(request.SocialSetting, request.Trait, request.Variations)
+		if err == errJobQueueFull {
+			w.Header().Set("Retry-After", "30")
+			http.Error(w, "Job queue full, try again later", http.StatusServiceUnavailable)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"jobId":   job.ID,
+			"status":  jobQueued,
+			"total":   request.Variations,
+			"job":     fmt.Sprintf("/api/jobs/%s", job.ID),
+		})
+		return
+	}
+
+	if request.Variations > 10 {
+		request.Variations = 10
+	}
+
 	personas := make([]Persona, request.Variations)
 
 	for i := 0; i < request.Variations; i++ {
 		persona := generatePersona(request.SocialSetting, request.Trait, request.UseAI)
 		personas[i] = persona
 	}
+	personaRegistry.Save(personas...)
 
 	// Broadcast persona generation event
 	protocolEvent := Protocol{
@@ -435,6 +440,11 @@ func personaGenerationHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	broadcast <- protocolEvent
 
+	if format != personaFormatJSON {
+		writePersonas(w, format, personas)
+		return
+	}
+
 	response := map[string]interface{}{
 		"success":  true,
 		"count":    len(personas),
@@ -445,13 +455,16 @@ func personaGenerationHandler(w http.ResponseWriter, r *http.Request) {
 			"variation_count": request.Variations,
 		},
 	}
+	if request.Analyze {
+		response["analysis"] = analyzePersonas(personas)
+	}
 
 	json.NewEncoder(w).Encode(response)
 }
 
 // Generate persona with enhanced algorithm
 func generatePersona(socialSetting, preferredTrait string, useAI bool) Persona {
-	id := fmt.Sprintf("persona-%d-%d", time.Now().Unix(), rand.Intn(1000))
+	id := fmt.Sprintf("persona-%d-%d", time.Now().UnixNano(), rand.Intn(1000))
 	
 	// Select traits
 	traits := make([]string, 0)
@@ -632,6 +645,8 @@ func realtimeStatusHandler(w http.ResponseWriter, r *http.Request) {
 			"total_generated": "unknown", // would need counter
 			"last_generation": "unknown",
 		},
+		// Upstream quotas (e.g. GitHub's X-RateLimit-*) and proxy cache hit ratios
+		"upstreams": upstreamStatus(),
 		"timestamp": time.Now(),
 	}
 
@@ -640,12 +655,37 @@ func realtimeStatusHandler(w http.ResponseWriter, r *http.Request) {
 
 // Enhanced WebSocket handler with client management
 func websocketHandler(w http.ResponseWriter, r *http.Request) {
+	if !rateLimits.allowIP(w, r) {
+		return
+	}
+	// Reject bad credentials before upgrading; none at all means the client
+	// authenticates with its first message
+	identity, status := authenticateWebSocket(r)
+	if status != 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write([]byte(fmt.Sprintf(`{"error": "WebSocket authentication failed: %s"}`, http.StatusText(status))))
+		return
+	}
+
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Printf("❌ WebSocket upgrade failed: %v", err)
 		return
 	}
 	defer conn.Close()
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	if identity == nil {
+		if identity, err = awaitWebSocketAuth(conn); err != nil {
+			log.Printf("🔑 WebSocket authentication failed from %s: %v", r.RemoteAddr, err)
+			auditWebSocket(r, nil, auditWSConnect, "", auditUnauthorized, time.Now(), err.Error())
+			rejectWebSocket(conn, err.Error())
+			return
+		}
+	}
+	auditWebSocket(r, identity, auditWSConnect, "", auditSuccess, time.Now(), "")
 
 	// Create client with metadata
 	clientID := fmt.Sprintf("client-%d", time.Now().UnixNano())
@@ -653,7 +693,13 @@ func websocketHandler(w http.ResponseWriter, r *http.Request) {
 		conn:     conn,
 		id:       clientID,
 		joinTime: time.Now(),
-		metadata: make(map[string]interface{}),
+		metadata: map[string]interface{}{
+			"identity":    identity,
+			"subject":     identity.Subject,
+			"auth_method": identity.Method,
+		},
+		limiter: rateLimits.newMessageLimiter(),
+		ctx:     ctx,
 	}
 
 	// Register client
@@ -667,14 +713,18 @@ func websocketHandler(w http.ResponseWriter, r *http.Request) {
 		Data: map[string]interface{}{
 			"client_id":        clientID,
 			"server_version":   "2.0.0",
-			"features_enabled": []string{"persona_generation", "lmstudio_integration", "realtime_data"},
+			"features_enabled": []string{"persona_generation", "persona_dialogue", "lmstudio_integration", "realtime_data"},
+			"subject":          identity.Subject,
+			"scopes":           identity.Scopes,
 		},
 		Timestamp: time.Now(),
 		Status:    "connected",
 	}
-	conn.WriteJSON(welcomeMsg)
+	client.send(welcomeMsg)
 
-	// Listen for messages from client
+	// Listen for messages from client. A burst of throttled messages is
+	// audited once, so floods cannot flood the audit log too.
+	throttled := false
 	for {
 		var protocol Protocol
 		err := conn.ReadJSON(&protocol)
@@ -685,21 +735,45 @@ func websocketHandler(w http.ResponseWriter, r *http.Request) {
 		}
 
 		// Process client message
+		start := time.Now()
+		if client.throttleMessage(protocol) {
+			if !throttled {
+				auditWebSocket(r, identity, auditWSMessage, protocol.Type, auditRateLimited, start, protocol.ID)
+			}
+			throttled = true
+			continue
+		}
+		throttled = false
+		if !client.authorizeMessage(protocol) {
+			auditWebSocket(r, identity, auditWSMessage, protocol.Type, auditForbidden, start, protocol.ID)
+			continue
+		}
 		protocol.Timestamp = time.Now()
+		if protocol.Data == nil {
+			protocol.Data = make(map[string]interface{})
+		}
 		protocol.Data["from_client"] = clientID
-		
+		protocol.Data["from_subject"] = identity.Subject
+
 		// Handle special message types
 		switch protocol.Type {
 		case "persona_request":
 			handlePersonaRequest(protocol, client)
 		case "lmstudio_request":
 			handleLMStudioRequest(protocol, client)
+		case "persona_dialogue_request":
+			handlePersonaDialogueRequest(protocol, client)
 		case "heartbeat":
 			handleHeartbeat(protocol, client)
+		case "auth":
+			// Already authenticated; never broadcast credentials
 		default:
 			// Broadcast message
 			broadcast <- protocol
 		}
+		if protocol.Type != "heartbeat" {
+			auditWebSocket(r, identity, auditWSMessage, protocol.Type, auditSuccess, start, protocol.ID)
+		}
 	}
 }
 
@@ -710,7 +784,7 @@ func handleMessages() {
 
 		// Send to all connected clients
 		for clientID, client := range clients {
-			err := client.conn.WriteJSON(protocol)
+			err := client.send(protocol)
 			if err != nil {
 				log.Printf("❌ WebSocket write error for client %s: %v", clientID, err)
 				client.conn.Close()
@@ -757,6 +831,13 @@ func contains(slice []string, item string) bool {
 
 // Enhance persona with AI (LM Studio integration)
 func enhancePersonaWithAI(persona *Persona) {
+	if err := enhancePersonaWithAIContext(context.Background(), persona); err != nil {
+		log.Printf("⚠️ AI enhancement failed: %v", err)
+	}
+}
+
+// Enhance persona with AI, stopping early if the context is cancelled
+func enhancePersonaWithAIContext(ctx context.Context, persona *Persona) error {
 	prompt := fmt.Sprintf(`Enhance this persona with more detailed characteristics and background:
 Name: %s
 Social Setting: %s
@@ -768,31 +849,42 @@ Provide a more detailed background story, specific interests, and unique charact
 		persona.Name, persona.SocialSetting, strings.Join(persona.Traits, ", "), 
 		persona.Background, persona.CommunicationStyle)
 
-	enhancement, err := callLMStudio(prompt, 0.8, 300)
+	enhancement, err := callLMStudioChat(ctx, []Message{
+		{Role: "system", Content: defaultSystemPrompt},
+		{Role: "user", Content: prompt},
+	}, 0.8, 300)
 	if err != nil {
-		log.Printf("⚠️ AI enhancement failed: %v", err)
 		persona.Metadata["ai_enhancement"] = "failed"
-		return
+		return err
 	}
 
 	persona.Background = enhancement
 	persona.Metadata["ai_enhanced"] = true
 	persona.Metadata["enhancement_timestamp"] = time.Now()
+	return nil
 }
 
+// System prompt for single-prompt LM Studio calls
+const defaultSystemPrompt = "You are a helpful AI assistant that provides clear, concise responses."
+
 // Call LM Studio API
 func callLMStudio(prompt string, temperature float64, maxTokens int) (string, error) {
+	return callLMStudioChat(context.Background(), []Message{
+		{Role: "system", Content: defaultSystemPrompt},
+		{Role: "user", Content: prompt},
+	}, temperature, maxTokens)
+}
+
+// Call LM Studio API with a full message history
+func callLMStudioChat(ctx context.Context, messages []Message, temperature float64, maxTokens int) (string, error) {
 	lmStudioURL := os.Getenv("LMSTUDIO_URL")
 	if lmStudioURL == "" {
 		lmStudioURL = "http://localhost:1234"
 	}
 
 	request := LMStudioRequest{
-		Model: "local-model",
-		Messages: []Message{
-			{Role: "system", Content: "You are a helpful AI assistant that provides clear, concise responses."},
-			{Role: "user", Content: prompt},
-		},
+		Model:       "local-model",
+		Messages:    messages,
 		MaxTokens:   maxTokens,
 		Temperature: temperature,
 		Stream:      false,
@@ -803,8 +895,14 @@ func callLMStudio(prompt string, temperature float64, maxTokens int) (string, er
 		return "", fmt.Errorf("failed to marshal request: %v", err)
 	}
 
+	req, err := http.NewRequestWithContext(ctx, "POST", lmStudioURL+"/v1/chat/completions", bytes.NewBuffer(jsonData))
+	if err != nil {
+		return "", fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
 	client := &http.Client{Timeout: 30 * time.Second}
-	resp, err := client.Post(lmStudioURL+"/v1/chat/completions", "application/json", bytes.NewBuffer(jsonData))
+	resp, err := client.Do(req)
 	if err != nil {
 		return "", fmt.Errorf("failed to call LM Studio: %v", err)
 	}
@@ -865,6 +963,7 @@ func handlePersonaRequest(protocol Protocol, client *Client) {
 	for i := 0; i < int(variations); i++ {
 		personas[i] = generatePersona(socialSetting, trait, useAI)
 	}
+	personaRegistry.Save(personas...)
 
 	response := Protocol{
 		ID:   fmt.Sprintf("persona-response-%d", time.Now().Unix()),
@@ -880,7 +979,7 @@ func handlePersonaRequest(protocol Protocol, client *Client) {
 	}
 
 	// Send directly to requesting client
-	client.conn.WriteJSON(response)
+	client.send(response)
 }
 
 // Handle LM Studio request via WebSocket
@@ -926,7 +1025,7 @@ func handleLMStudioRequest(protocol Protocol, client *Client) {
 	}
 
 	// Send directly to requesting client
-	client.conn.WriteJSON(protocolResponse)
+	client.send(protocolResponse)
 }
 
 // Handle heartbeat from client
@@ -943,5 +1042,5 @@ func handleHeartbeat(protocol Protocol, client *Client) {
 		Status:    "active",
 	}
 
-	client.conn.WriteJSON(response)
+	client.send(response)
 }
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strings"
+)
+
+// Trait pairs that should not appear on the same persona
+var contradictoryTraits = [][2]string{
+	{"introverted", "extroverted"},
+	{"cautious", "risk-taking"},
+	{"detail-oriented", "big-picture"},
+	{"methodical", "spontaneous"},
+	{"diplomatic", "direct"},
+}
+
+// Weights of each field in the pairwise similarity score
+const (
+	similarityTraitWeight      = 0.4
+	similarityMotivationWeight = 0.3
+	similarityStyleWeight      = 0.15
+	similarityBackgroundWeight = 0.15
+)
+
+// The similarity matrix is quadratic, so one request analyses at most this
+// many personas; without a selection, the most recently stored ones
+const maxAnalyzedPersonas = 200
+
+// EntropyScore describes how evenly values are spread across a batch
+type EntropyScore struct {
+	Bits       float64 `json:"bits"`
+	Normalized float64 `json:"normalized"`
+	Distinct   int     `json:"distinct"`
+}
+
+// PersonaContradiction is a pair of conflicting traits on one persona
+type PersonaContradiction struct {
+	PersonaID string    `json:"personaId"`
+	Traits    [2]string `json:"traits"`
+}
+
+// PersonaAnalysis reports diversity and quality metrics for a set of personas
+type PersonaAnalysis struct {
+	Count                   int                    `json:"count"`
+	TraitEntropy            EntropyScore           `json:"traitEntropy"`
+	MotivationEntropy       EntropyScore           `json:"motivationEntropy"`
+	DuplicateNameRate       float64                `json:"duplicateNameRate"`
+	DuplicateBackgroundRate float64                `json:"duplicateBackgroundRate"`
+	ContradictionCount      int                    `json:"contradictionCount"`
+	Contradictions          []PersonaContradiction `json:"contradictions"`
+	PersonaIDs              []string               `json:"personaIds"`
+	SimilarityMatrix        [][]float64            `json:"similarityMatrix"`
+	AverageSimilarity       float64                `json:"averageSimilarity"`
+	DiversityScore          float64                `json:"diversityScore"`
+}
+
+// analyzePersonas scores a set of personas for diversity and internal consistency
+func analyzePersonas(personas []Persona) PersonaAnalysis {
+	analysis := PersonaAnalysis{
+		Count:          len(personas),
+		Contradictions: []PersonaContradiction{},
+		PersonaIDs:     make([]string, len(personas)),
+	}
+
+	traitCounts := make(map[string]int)
+	motivationCounts := make(map[string]int)
+	names := make(map[string]bool)
+	backgrounds := make(map[string]bool)
+	for i, p := range personas {
+		analysis.PersonaIDs[i] = p.ID
+		for _, t := range p.Traits {
+			traitCounts[strings.ToLower(t)]++
+		}
+		for _, m := range p.Motivations {
+			motivationCounts[strings.ToLower(m)]++
+		}
+		names[strings.ToLower(p.Name)] = true
+		backgrounds[strings.ToLower(p.Background)] = true
+
+		for _, pair := range contradictoryTraits {
+			if containsFold(p.Traits, pair[0]) && containsFold(p.Traits, pair[1]) {
+				analysis.Contradictions = append(analysis.Contradictions, PersonaContradiction{PersonaID: p.ID, Traits: pair})
+			}
+		}
+	}
+	analysis.ContradictionCount = len(analysis.Contradictions)
+	analysis.TraitEntropy = entropy(traitCounts)
+	analysis.MotivationEntropy = entropy(motivationCounts)
+	if len(personas) > 0 {
+		analysis.DuplicateNameRate = float64(len(personas)-len(names)) / float64(len(personas))
+		analysis.DuplicateBackgroundRate = float64(len(personas)-len(backgrounds)) / float64(len(personas))
+	}
+
+	analysis.SimilarityMatrix = make([][]float64, len(personas))
+	var total float64
+	pairs := 0
+	for i := range personas {
+		analysis.SimilarityMatrix[i] = make([]float64, len(personas))
+		for j := range personas {
+			if i == j {
+				analysis.SimilarityMatrix[i][j] = 1
+				continue
+			}
+			if j < i {
+				analysis.SimilarityMatrix[i][j] = analysis.SimilarityMatrix[j][i]
+				continue
+			}
+			sim := personaSimilarity(personas[i], personas[j])
+			analysis.SimilarityMatrix[i][j] = sim
+			total += sim
+			pairs++
+		}
+	}
+	if pairs > 0 {
+		analysis.AverageSimilarity = total / float64(pairs)
+	}
+
+	// Overall diversity: spread of traits and motivations, penalized by duplication
+	analysis.DiversityScore = (analysis.TraitEntropy.Normalized + analysis.MotivationEntropy.Normalized +
+		(1 - analysis.AverageSimilarity) + (1 - analysis.DuplicateBackgroundRate)) / 4
+	if len(personas) < 2 {
+		analysis.DiversityScore = 0
+	}
+	return analysis
+}
+
+// personaSimilarity returns a weighted similarity in [0, 1]
+func personaSimilarity(a, b Persona) float64 {
+	score := similarityTraitWeight*jaccard(a.Traits, b.Traits) +
+		similarityMotivationWeight*jaccard(a.Motivations, b.Motivations)
+	if strings.EqualFold(a.CommunicationStyle, b.CommunicationStyle) {
+		score += similarityStyleWeight
+	}
+	if strings.EqualFold(a.Background, b.Background) {
+		score += similarityBackgroundWeight
+	}
+	return score
+}
+
+func jaccard(a, b []string) float64 {
+	if len(a) == 0 && len(b) == 0 {
+		return 1
+	}
+	set := make(map[string]bool, len(a))
+	for _, v := range a {
+		set[strings.ToLower(v)] = true
+	}
+	union := len(set)
+	intersection := 0
+	seen := make(map[string]bool, len(b))
+	for _, v := range b {
+		v = strings.ToLower(v)
+		if seen[v] {
+			continue
+		}
+		seen[v] = true
+		if set[v] {
+			intersection++
+		} else {
+			union++
+		}
+	}
+	return float64(intersection) / float64(union)
+}
+
+// entropy computes Shannon entropy over value counts, normalized by the
+// maximum possible entropy for the number of distinct values
+func entropy(counts map[string]int) EntropyScore {
+	total := 0
+	for _, c := range counts {
+		total += c
+	}
+	score := EntropyScore{Distinct: len(counts)}
+	if total == 0 {
+		return score
+	}
+	for _, c := range counts {
+		p := float64(c) / float64(total)
+		score.Bits -= p * math.Log2(p)
+	}
+	if len(counts) > 1 {
+		score.Normalized = score.Bits / math.Log2(float64(len(counts)))
+	}
+	return score
+}
+
+func containsFold(slice []string, item string) bool {
+	for _, s := range slice {
+		if strings.EqualFold(s, item) {
+			return true
+		}
+	}
+	return false
+}
+
+// Persona analysis handler: scores given personas, stored IDs, or the most
+// recent maxAnalyzedPersonas of the store
+func personaAnalysisHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var request struct {
+		Personas []Persona `json:"personas"`
+		IDs      []string  `json:"ids"`
+	}
+	// An empty body analyses the store
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 10<<20)).Decode(&request); err != nil && err != io.EOF {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if len(request.Personas)+len(request.IDs) > maxAnalyzedPersonas {
+		http.Error(w, fmt.Sprintf("At most %d personas can be analysed at once", maxAnalyzedPersonas), http.StatusBadRequest)
+		return
+	}
+
+	personas := request.Personas
+	for _, id := range request.IDs {
+		p, ok := personaRegistry.Get(id)
+		if !ok {
+			http.Error(w, "Persona not found: "+id, http.StatusNotFound)
+			return
+		}
+		personas = append(personas, p)
+	}
+	stored := 0
+	if len(request.Personas) == 0 && len(request.IDs) == 0 {
+		personas = personaRegistry.List()
+		stored = len(personas)
+		if stored > maxAnalyzedPersonas {
+			personas = personas[stored-maxAnalyzedPersonas:]
+		}
+	}
+
+	response := map[string]interface{}{
+		"success":  true,
+		"analysis": analyzePersonas(personas),
+	}
+	if stored > len(personas) {
+		response["stored"] = stored
+		response["note"] = fmt.Sprintf("analysed the %d most recent personas", len(personas))
+	}
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,448 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	maxDialoguePersonas = 6
+	maxDialogueTurns    = 20
+	maxDialogueTokens   = 1000
+	// A dialogue is abandoned if its turns take longer than this in total
+	maxDialogueDuration = 5 * time.Minute
+	// Finished transcripts are kept this long, and at most this many
+	finishedDialogueTTL  = time.Hour
+	maxFinishedDialogues = 100
+)
+
+// DialogueTurn is a single line spoken by a persona in a simulated dialogue
+type DialogueTurn struct {
+	Index     int       `json:"index"`
+	PersonaID string    `json:"personaId"`
+	Speaker   string    `json:"speaker"`
+	Content   string    `json:"content"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// DialogueTranscript records a persona-to-persona conversation
+type DialogueTranscript struct {
+	ID          string         `json:"id"`
+	Scenario    string         `json:"scenario"`
+	PersonaIDs  []string       `json:"personaIds"`
+	Turns       []DialogueTurn `json:"turns"`
+	TurnLimit   int            `json:"turnLimit"`
+	Status      string         `json:"status"`
+	Error       string         `json:"error,omitempty"`
+	Temperature float64        `json:"temperature"`
+	MaxTokens   int            `json:"maxTokens"`
+	Started     time.Time      `json:"started"`
+	Completed   *time.Time     `json:"completed,omitempty"`
+	cancel      context.CancelFunc
+}
+
+// DialogueRequest describes a dialogue to simulate
+type DialogueRequest struct {
+	PersonaIDs  []string `json:"personaIds"`
+	Scenario    string   `json:"scenario"`
+	Turns       int      `json:"turns"`
+	Temperature float64  `json:"temperature"`
+	MaxTokens   int      `json:"maxTokens"`
+}
+
+var dialogues = struct {
+	sync.RWMutex
+	byID map[string]*DialogueTranscript
+}{byID: make(map[string]*DialogueTranscript)}
+
+// Persona dialogue handler: starts a dialogue and streams turns over WebSocket
+func personaDialogueHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var request DialogueRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	transcript, participants, err := newDialogue(request)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	// The dialogue outlives this request; callers that give up cancel it
+	// with DELETE
+	startDialogue(context.WithoutCancel(r.Context()), transcript, participants, func(p Protocol) {
+		broadcast <- p
+	})
+
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":    true,
+		"dialogueId": transcript.ID,
+		"status":     transcript.Status,
+		"turns":      transcript.TurnLimit,
+		"transcript": fmt.Sprintf("/api/persona/dialogue/%s", transcript.ID),
+	})
+}
+
+// Persona dialogue transcript handler
+func personaDialogueTranscriptHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	id := mux.Vars(r)["id"]
+
+	dialogues.RLock()
+	transcript, ok := dialogues.byID[id]
+	var snapshot DialogueTranscript
+	if ok {
+		snapshot = *transcript
+		snapshot.Turns = append([]DialogueTurn{}, transcript.Turns...)
+	}
+	dialogues.RUnlock()
+
+	if !ok {
+		http.Error(w, "Dialogue not found", http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(snapshot)
+}
+
+// Persona dialogue cancel handler: stops a running dialogue
+func personaDialogueCancelHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	id := mux.Vars(r)["id"]
+
+	dialogues.RLock()
+	transcript, ok := dialogues.byID[id]
+	var status string
+	var cancel context.CancelFunc
+	if ok {
+		status, cancel = transcript.Status, transcript.cancel
+	}
+	dialogues.RUnlock()
+
+	if !ok {
+		http.Error(w, "Dialogue not found", http.StatusNotFound)
+		return
+	}
+	if status == "running" && cancel != nil {
+		cancel()
+		log.Printf("🛑 Dialogue %s cancelled", id)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":    true,
+		"dialogueId": id,
+		"cancelled":  status == "running",
+	})
+}
+
+// Handle persona dialogue request via WebSocket
+func handlePersonaDialogueRequest(protocol Protocol, client *Client) {
+	var request DialogueRequest
+	if ids, ok := protocol.Data["personaIds"].([]interface{}); ok {
+		for _, id := range ids {
+			if s, ok := id.(string); ok {
+				request.PersonaIDs = append(request.PersonaIDs, s)
+			}
+		}
+	}
+	request.Scenario, _ = protocol.Data["scenario"].(string)
+	turns, _ := protocol.Data["turns"].(float64)
+	request.Turns = int(turns)
+	request.Temperature, _ = protocol.Data["temperature"].(float64)
+	maxTokens, _ := protocol.Data["maxTokens"].(float64)
+	request.MaxTokens = int(maxTokens)
+
+	transcript, participants, err := newDialogue(request)
+	if err != nil {
+		client.send(Protocol{
+			ID:   fmt.Sprintf("persona-dialogue-error-%d", time.Now().Unix()),
+			Type: "persona_dialogue_completed",
+			Data: map[string]interface{}{
+				"success":    false,
+				"error":      err.Error(),
+				"request_id": protocol.ID,
+			},
+			Timestamp: time.Now(),
+			Status:    "error",
+		})
+		return
+	}
+
+	// Stream turns only to the requesting client, stopping if it disconnects
+	startDialogue(client.ctx, transcript, participants, func(p Protocol) {
+		p.Data["request_id"] = protocol.ID
+		client.send(p)
+	})
+}
+
+// newDialogue validates a request, resolves its personas and registers a transcript
+func newDialogue(request DialogueRequest) (*DialogueTranscript, []Persona, error) {
+	if len(request.PersonaIDs) < 2 {
+		return nil, nil, fmt.Errorf("at least two personaIds are required")
+	}
+	if len(request.PersonaIDs) > maxDialoguePersonas {
+		return nil, nil, fmt.Errorf("at most %d personas can take part in a dialogue", maxDialoguePersonas)
+	}
+	if strings.TrimSpace(request.Scenario) == "" {
+		return nil, nil, fmt.Errorf("scenario is required")
+	}
+
+	participants := make([]Persona, 0, len(request.PersonaIDs))
+	seen := make(map[string]bool)
+	for _, id := range request.PersonaIDs {
+		if seen[id] {
+			return nil, nil, fmt.Errorf("duplicate persona: %s", id)
+		}
+		seen[id] = true
+		persona, ok := personaRegistry.Get(id)
+		if !ok {
+			return nil, nil, fmt.Errorf("unknown persona: %s", id)
+		}
+		participants = append(participants, persona)
+	}
+
+	// Default values
+	if request.Turns <= 0 {
+		request.Turns = 2 * len(participants)
+	}
+	if request.Turns > maxDialogueTurns {
+		request.Turns = maxDialogueTurns
+	}
+	if request.Temperature == 0 {
+		request.Temperature = 0.8
+	}
+	if request.MaxTokens <= 0 {
+		request.MaxTokens = 200
+	}
+	if request.MaxTokens > maxDialogueTokens {
+		request.MaxTokens = maxDialogueTokens
+	}
+
+	transcript := &DialogueTranscript{
+		ID:          fmt.Sprintf("dialogue-%d", time.Now().UnixNano()),
+		Scenario:    request.Scenario,
+		PersonaIDs:  request.PersonaIDs,
+		Turns:       make([]DialogueTurn, 0, request.Turns),
+		TurnLimit:   request.Turns,
+		Status:      "running",
+		Temperature: request.Temperature,
+		MaxTokens:   request.MaxTokens,
+		Started:     time.Now(),
+	}
+
+	dialogues.Lock()
+	pruneDialogues(time.Now())
+	dialogues.byID[transcript.ID] = transcript
+	dialogues.Unlock()
+
+	return transcript, participants, nil
+}
+
+// pruneDialogues drops finished transcripts older than finishedDialogueTTL,
+// then the oldest beyond maxFinishedDialogues. Callers hold the lock.
+func pruneDialogues(now time.Time) {
+	var finished []*DialogueTranscript
+	for id, transcript := range dialogues.byID {
+		if transcript.Completed == nil {
+			continue
+		}
+		if now.Sub(*transcript.Completed) > finishedDialogueTTL {
+			delete(dialogues.byID, id)
+			continue
+		}
+		finished = append(finished, transcript)
+	}
+	if excess := len(finished) - maxFinishedDialogues; excess > 0 {
+		sort.Slice(finished, func(i, j int) bool { return finished[i].Completed.Before(*finished[j].Completed) })
+		for _, transcript := range finished[:excess] {
+			delete(dialogues.byID, transcript.ID)
+		}
+	}
+}
+
+// startDialogue runs a dialogue in the background under ctx, bounded by
+// maxDialogueDuration
+func startDialogue(parent context.Context, transcript *DialogueTranscript, participants []Persona, emit func(Protocol)) {
+	ctx, cancel := context.WithTimeout(parent, maxDialogueDuration)
+	dialogues.Lock()
+	transcript.cancel = cancel
+	dialogues.Unlock()
+
+	go func() {
+		defer cancel()
+		runDialogue(ctx, transcript, participants, emit)
+	}()
+}
+
+// runDialogue drives the conversation turn by turn, emitting each turn as a Protocol event
+func runDialogue(ctx context.Context, transcript *DialogueTranscript, participants []Persona, emit func(Protocol)) {
+	emit(Protocol{
+		ID:   fmt.Sprintf("persona-dialogue-start-%d", time.Now().Unix()),
+		Type: "persona_dialogue_started",
+		Data: map[string]interface{}{
+			"dialogue_id": transcript.ID,
+			"scenario":    transcript.Scenario,
+			"persona_ids": transcript.PersonaIDs,
+			"turns":       transcript.TurnLimit,
+		},
+		Timestamp: time.Now(),
+		Status:    "running",
+	})
+
+	var history []DialogueTurn
+	for i := 0; i < transcript.TurnLimit; i++ {
+		// Speaking order rotates through the participants
+		speaker := participants[i%len(participants)]
+		messages := dialogueMessages(speaker, participants, transcript.Scenario, history)
+		content, err := callLMStudioChat(ctx, messages, transcript.Temperature, transcript.MaxTokens)
+		if ctx.Err() != nil {
+			log.Printf("⚠️ Dialogue %s stopped at turn %d: %v", transcript.ID, i, ctx.Err())
+			finishDialogue(transcript, "cancelled", ctx.Err().Error())
+			emitDialogueCompleted(transcript, emit)
+			return
+		}
+		if err != nil {
+			log.Printf("⚠️ Dialogue %s failed at turn %d: %v", transcript.ID, i, err)
+			finishDialogue(transcript, "error", err.Error())
+			emitDialogueCompleted(transcript, emit)
+			return
+		}
+
+		turn := DialogueTurn{
+			Index:     i,
+			PersonaID: speaker.ID,
+			Speaker:   speaker.Name,
+			Content:   strings.TrimSpace(content),
+			Timestamp: time.Now(),
+		}
+		history = append(history, turn)
+
+		dialogues.Lock()
+		transcript.Turns = append(transcript.Turns, turn)
+		dialogues.Unlock()
+
+		emit(Protocol{
+			ID:   fmt.Sprintf("persona-dialogue-turn-%s-%d", transcript.ID, i),
+			Type: "persona_dialogue_turn",
+			Data: map[string]interface{}{
+				"dialogue_id": transcript.ID,
+				"turn":        turn,
+			},
+			Timestamp: time.Now(),
+			Status:    "streaming",
+		})
+	}
+
+	finishDialogue(transcript, "completed", "")
+	emitDialogueCompleted(transcript, emit)
+}
+
+// dialogueMessages builds the chat history from the speaker's point of view
+func dialogueMessages(speaker Persona, participants []Persona, scenario string, history []DialogueTurn) []Message {
+	others := make([]string, 0, len(participants)-1)
+	for _, p := range participants {
+		if p.ID != speaker.ID {
+			others = append(others, p.Name)
+		}
+	}
+
+	system := fmt.Sprintf(`You are %s, taking part in a conversation with %s.
+Background: %s
+Traits: %s
+Motivations: %s
+Communication style: %s
+
+Scenario: %s
+
+Stay in character. Reply only with your next line of dialogue, in a few sentences, without prefixing your name.`,
+		speaker.Name, strings.Join(others, ", "), speaker.Background,
+		strings.Join(speaker.Traits, ", "), strings.Join(speaker.Motivations, ", "),
+		speaker.CommunicationStyle, scenario)
+
+	messages := []Message{{Role: "system", Content: system}}
+	if len(history) == 0 {
+		messages = append(messages, Message{Role: "user", Content: "Open the conversation."})
+		return messages
+	}
+	for _, turn := range history {
+		if turn.PersonaID == speaker.ID {
+			messages = append(messages, Message{Role: "assistant", Content: turn.Content})
+		} else {
+			messages = append(messages, Message{Role: "user", Content: fmt.Sprintf("%s: %s", turn.Speaker, turn.Content)})
+		}
+	}
+	return messages
+}
+
+// finishDialogue marks a transcript as finished and saves it
+func finishDialogue(transcript *DialogueTranscript, status, errMsg string) {
+	now := time.Now()
+	dialogues.Lock()
+	transcript.Status = status
+	transcript.Error = errMsg
+	transcript.Completed = &now
+	dialogues.Unlock()
+
+	if err := saveDialogueTranscript(transcript); err != nil {
+		log.Printf("⚠️ Failed to save dialogue transcript %s: %v", transcript.ID, err)
+	}
+}
+
+// saveDialogueTranscript writes the transcript to DIALOGUE_TRANSCRIPT_DIR when configured
+func saveDialogueTranscript(transcript *DialogueTranscript) error {
+	dir := os.Getenv("DIALOGUE_TRANSCRIPT_DIR")
+	if dir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+
+	dialogues.RLock()
+	data, err := json.MarshalIndent(transcript, "", "  ")
+	dialogues.RUnlock()
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, transcript.ID+".json"), data, 0o644)
+}
+
+func emitDialogueCompleted(transcript *DialogueTranscript, emit func(Protocol)) {
+	dialogues.RLock()
+	data := map[string]interface{}{
+		"success":     transcript.Status == "completed",
+		"dialogue_id": transcript.ID,
+		"turns":       len(transcript.Turns),
+		"transcript":  fmt.Sprintf("/api/persona/dialogue/%s", transcript.ID),
+	}
+	if transcript.Error != "" {
+		data["error"] = transcript.Error
+	}
+	status := transcript.Status
+	dialogues.RUnlock()
+
+	emit(Protocol{
+		ID:        fmt.Sprintf("persona-dialogue-end-%d", time.Now().Unix()),
+		Type:      "persona_dialogue_completed",
+		Data:      data,
+		Timestamp: time.Now(),
+		Status:    status,
+	})
+}
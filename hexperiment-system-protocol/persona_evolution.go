@@ -0,0 +1,424 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// PersonaAction is something that happens to a persona. Following the flups
+// "time as action" principle, a persona's state only changes when an action is applied.
+type PersonaAction struct {
+	Type      string                 `json:"type"`
+	Intensity float64                `json:"intensity,omitempty"`
+	Data      map[string]interface{} `json:"data,omitempty"`
+}
+
+// PersonaState is a versioned snapshot of trait and motivation strengths
+type PersonaState struct {
+	PersonaID   string             `json:"personaId"`
+	Step        int                `json:"step"`
+	Traits      map[string]float64 `json:"traits"`
+	Motivations map[string]float64 `json:"motivations"`
+	Action      *PersonaAction     `json:"action,omitempty"`
+	Applied     []string           `json:"appliedRules,omitempty"`
+	Timestamp   time.Time          `json:"timestamp"`
+}
+
+// EvolutionRule adjusts strengths when an action of a matching type is applied
+type EvolutionRule struct {
+	Name             string             `json:"name"`
+	Action           string             `json:"action"`
+	RequireTraits    []string           `json:"requireTraits,omitempty"`
+	TraitDeltas      map[string]float64 `json:"traitDeltas,omitempty"`
+	MotivationDeltas map[string]float64 `json:"motivationDeltas,omitempty"`
+}
+
+// EvolutionConfig holds the rule set and the strength needed for a trait or
+// motivation to appear on the persona itself
+type EvolutionConfig struct {
+	Rules               []EvolutionRule `json:"rules"`
+	ActivationThreshold float64         `json:"activationThreshold"`
+}
+
+var defaultEvolutionConfig = EvolutionConfig{
+	ActivationThreshold: 0.5,
+	Rules: []EvolutionRule{
+		{
+			Name:             "collaboration-builds-teamwork",
+			Action:           "collaboration",
+			TraitDeltas:      map[string]float64{"collaborative": 0.2, "independent": -0.1},
+			MotivationDeltas: map[string]float64{"connection": 0.15, "community": 0.1},
+		},
+		{
+			Name:        "conflict-sharpens-directness",
+			Action:      "conflict",
+			TraitDeltas: map[string]float64{"direct": 0.15, "patient": -0.1, "diplomatic": -0.05},
+		},
+		{
+			Name:             "success-breeds-confidence",
+			Action:           "success",
+			TraitDeltas:      map[string]float64{"optimistic": 0.15, "risk-taking": 0.1, "cautious": -0.1},
+			MotivationDeltas: map[string]float64{"achievement": 0.15, "recognition": 0.1},
+		},
+		{
+			Name:             "failure-breeds-caution",
+			Action:           "failure",
+			TraitDeltas:      map[string]float64{"cautious": 0.15, "risk-taking": -0.15, "optimistic": -0.1},
+			MotivationDeltas: map[string]float64{"security": 0.15, "stability": 0.1},
+		},
+		{
+			Name:             "learning-deepens-curiosity",
+			Action:           "learning",
+			TraitDeltas:      map[string]float64{"analytical": 0.1},
+			MotivationDeltas: map[string]float64{"knowledge": 0.15, "discovery": 0.1},
+		},
+		{
+			Name:             "isolation-turns-inward",
+			Action:           "isolation",
+			TraitDeltas:      map[string]float64{"introverted": 0.15, "extroverted": -0.15},
+			MotivationDeltas: map[string]float64{"autonomy": 0.1, "belonging": -0.1},
+		},
+		{
+			Name:             "empathy-responds-to-support",
+			Action:           "interaction",
+			RequireTraits:    []string{"empathetic"},
+			MotivationDeltas: map[string]float64{"helping others": 0.1},
+		},
+	},
+}
+
+// PersonaEvolution tracks the action history of every persona that has evolved
+type PersonaEvolution struct {
+	mu      sync.RWMutex
+	config  EvolutionConfig
+	history map[string][]PersonaState
+}
+
+var personaEvolution = NewPersonaEvolution(defaultEvolutionConfig)
+
+func NewPersonaEvolution(config EvolutionConfig) *PersonaEvolution {
+	return &PersonaEvolution{config: config, history: make(map[string][]PersonaState)}
+}
+
+// loadEvolutionConfig reads rules from PERSONA_EVOLUTION_RULES, falling back to the defaults
+func loadEvolutionConfig() EvolutionConfig {
+	path := os.Getenv("PERSONA_EVOLUTION_RULES")
+	if path == "" {
+		return defaultEvolutionConfig
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Printf("⚠️ Failed to read persona evolution rules: %v", err)
+		return defaultEvolutionConfig
+	}
+	var config EvolutionConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		log.Printf("⚠️ Invalid persona evolution rules: %v", err)
+		return defaultEvolutionConfig
+	}
+	if err := config.validate(); err != nil {
+		log.Printf("⚠️ Invalid persona evolution rules: %v", err)
+		return defaultEvolutionConfig
+	}
+	return config
+}
+
+func (c *EvolutionConfig) validate() error {
+	if c.ActivationThreshold == 0 {
+		c.ActivationThreshold = defaultEvolutionConfig.ActivationThreshold
+	}
+	if c.ActivationThreshold < 0 || c.ActivationThreshold > 1 {
+		return fmt.Errorf("activationThreshold must be between 0 and 1")
+	}
+	for i, rule := range c.Rules {
+		if rule.Action == "" {
+			return fmt.Errorf("rule %d has no action", i)
+		}
+		if len(rule.TraitDeltas) == 0 && len(rule.MotivationDeltas) == 0 {
+			return fmt.Errorf("rule %d has no deltas", i)
+		}
+	}
+	return nil
+}
+
+// Config returns the active rule configuration
+func (e *PersonaEvolution) Config() EvolutionConfig {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.config
+}
+
+// SetConfig replaces the rule configuration; existing histories are kept
+func (e *PersonaEvolution) SetConfig(config EvolutionConfig) error {
+	if err := config.validate(); err != nil {
+		return err
+	}
+	e.mu.Lock()
+	e.config = config
+	e.mu.Unlock()
+	return nil
+}
+
+// Apply applies actions in order, updates the stored persona and returns the new states
+func (e *PersonaEvolution) Apply(persona Persona, actions []PersonaAction) (Persona, []PersonaState) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	history := e.history[persona.ID]
+	if len(history) == 0 {
+		history = append(history, initialPersonaState(persona))
+	}
+
+	states := make([]PersonaState, 0, len(actions))
+	for i := range actions {
+		action := actions[i]
+		if action.Intensity == 0 {
+			action.Intensity = 1
+		}
+		next := e.step(history[len(history)-1], action)
+		history = append(history, next)
+		states = append(states, next)
+	}
+	e.history[persona.ID] = history
+
+	current := history[len(history)-1]
+	persona.Traits = activeKeys(current.Traits, e.config.ActivationThreshold)
+	persona.Motivations = activeKeys(current.Motivations, e.config.ActivationThreshold)
+	// The metadata map is shared with the stored persona; write to a copy
+	metadata := make(map[string]interface{}, len(persona.Metadata)+1)
+	for k, v := range persona.Metadata {
+		metadata[k] = v
+	}
+	metadata["evolution_step"] = current.Step
+	persona.Metadata = metadata
+	return persona, states
+}
+
+// step derives the next state from the previous one by applying every matching rule
+func (e *PersonaEvolution) step(prev PersonaState, action PersonaAction) PersonaState {
+	next := PersonaState{
+		PersonaID:   prev.PersonaID,
+		Step:        prev.Step + 1,
+		Traits:      copyStrengths(prev.Traits),
+		Motivations: copyStrengths(prev.Motivations),
+		Action:      &action,
+		Timestamp:   time.Now(),
+	}
+
+	for _, rule := range e.config.Rules {
+		if rule.Action != action.Type && rule.Action != "*" {
+			continue
+		}
+		if !hasActiveTraits(prev.Traits, rule.RequireTraits, e.config.ActivationThreshold) {
+			continue
+		}
+		for trait, delta := range rule.TraitDeltas {
+			next.Traits[trait] = clampStrength(next.Traits[trait] + delta*action.Intensity)
+		}
+		for motivation, delta := range rule.MotivationDeltas {
+			next.Motivations[motivation] = clampStrength(next.Motivations[motivation] + delta*action.Intensity)
+		}
+		next.Applied = append(next.Applied, rule.Name)
+	}
+	return next
+}
+
+// History returns every recorded state for a persona, starting at step 0
+func (e *PersonaEvolution) History(persona Persona) []PersonaState {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	history := e.history[persona.ID]
+	if len(history) == 0 {
+		return []PersonaState{initialPersonaState(persona)}
+	}
+	return append([]PersonaState(nil), history...)
+}
+
+func initialPersonaState(persona Persona) PersonaState {
+	state := PersonaState{
+		PersonaID:   persona.ID,
+		Traits:      make(map[string]float64),
+		Motivations: make(map[string]float64),
+		Timestamp:   persona.Generated,
+	}
+	for _, t := range persona.Traits {
+		state.Traits[t] = 1
+	}
+	for _, m := range persona.Motivations {
+		state.Motivations[m] = 1
+	}
+	return state
+}
+
+func hasActiveTraits(traits map[string]float64, required []string, threshold float64) bool {
+	for _, t := range required {
+		if traits[t] < threshold {
+			return false
+		}
+	}
+	return true
+}
+
+// activeKeys lists keys at or above the threshold, strongest first
+func activeKeys(strengths map[string]float64, threshold float64) []string {
+	keys := make([]string, 0, len(strengths))
+	for k, v := range strengths {
+		if v >= threshold {
+			keys = append(keys, k)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if strengths[keys[i]] != strengths[keys[j]] {
+			return strengths[keys[i]] > strengths[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	return keys
+}
+
+func copyStrengths(src map[string]float64) map[string]float64 {
+	dst := make(map[string]float64, len(src))
+	for k, v := range src {
+		dst[k] = v
+	}
+	return dst
+}
+
+func clampStrength(v float64) float64 {
+	if v < 0 {
+		return 0
+	}
+	if v > 1 {
+		return 1
+	}
+	return v
+}
+
+// Persona action handler: applies one or more actions to a persona
+func personaActionHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	id := mux.Vars(r)["id"]
+	if _, ok := personaRegistry.Get(id); !ok {
+		http.Error(w, "Persona not found", http.StatusNotFound)
+		return
+	}
+
+	var request struct {
+		PersonaAction
+		Actions []PersonaAction `json:"actions"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	actions := request.Actions
+	if request.Type != "" {
+		actions = append([]PersonaAction{request.PersonaAction}, actions...)
+	}
+	if len(actions) == 0 {
+		http.Error(w, "No actions provided", http.StatusBadRequest)
+		return
+	}
+	for _, action := range actions {
+		if action.Type == "" {
+			http.Error(w, "Action type is required", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Read, evolve and save under the store lock so concurrent actions on
+	// one persona are applied in turn
+	var states []PersonaState
+	evolved, ok := personaRegistry.Update(id, func(persona Persona) Persona {
+		var evolved Persona
+		evolved, states = personaEvolution.Apply(persona, actions)
+		return evolved
+	})
+	if !ok {
+		http.Error(w, "Persona not found", http.StatusNotFound)
+		return
+	}
+
+	protocolEvent := Protocol{
+		ID:   fmt.Sprintf("persona-evolution-%d", time.Now().Unix()),
+		Type: "persona_evolution",
+		Data: map[string]interface{}{
+			"persona_id": evolved.ID,
+			"actions":    len(actions),
+			"step":       states[len(states)-1].Step,
+		},
+		Timestamp: time.Now(),
+		Status:    "completed",
+	}
+	broadcast <- protocolEvent
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"persona": evolved,
+		"states":  states,
+	})
+}
+
+// Persona history handler: returns the versioned state history
+func personaHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	persona, ok := personaRegistry.Get(mux.Vars(r)["id"])
+	if !ok {
+		http.Error(w, "Persona not found", http.StatusNotFound)
+		return
+	}
+	history := personaEvolution.History(persona)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"personaId": persona.ID,
+		"steps":     len(history) - 1,
+		"history":   history,
+	})
+}
+
+// Persona state handler: returns the state at a given action step (latest by default)
+func personaStateHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	persona, ok := personaRegistry.Get(mux.Vars(r)["id"])
+	if !ok {
+		http.Error(w, "Persona not found", http.StatusNotFound)
+		return
+	}
+	history := personaEvolution.History(persona)
+
+	step := len(history) - 1
+	if s := r.URL.Query().Get("step"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 || n >= len(history) {
+			http.Error(w, fmt.Sprintf("step must be between 0 and %d", len(history)-1), http.StatusBadRequest)
+			return
+		}
+		step = n
+	}
+	json.NewEncoder(w).Encode(history[step])
+}
+
+// Evolution rules handler: reads or replaces the evolution rule set
+func personaEvolutionRulesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method == "PUT" {
+		var config EvolutionConfig
+		if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		if err := personaEvolution.SetConfig(config); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	json.NewEncoder(w).Encode(personaEvolution.Config())
+}
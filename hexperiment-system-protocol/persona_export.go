@@ -0,0 +1,520 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Supported persona serialization formats
+const (
+	personaFormatJSON   = "json"
+	personaFormatCSV    = "csv"
+	personaFormatNDJSON = "ndjson"
+	personaFormatCard   = "card"
+)
+
+const maxPersonaImportBytes = 10 << 20
+
+var personaFormatMediaTypes = map[string]string{
+	personaFormatJSON:   "application/json",
+	personaFormatCSV:    "text/csv",
+	personaFormatNDJSON: "application/x-ndjson",
+	personaFormatCard:   "application/vnd.hexperiment.character-card+json",
+}
+
+// CharacterCard is a chara_card_v2 style card that chat frontends can import
+type CharacterCard struct {
+	Spec        string            `json:"spec"`
+	SpecVersion string            `json:"spec_version"`
+	Data        CharacterCardData `json:"data"`
+}
+
+type CharacterCardData struct {
+	Name                    string                 `json:"name"`
+	Description             string                 `json:"description"`
+	Personality             string                 `json:"personality"`
+	Scenario                string                 `json:"scenario"`
+	FirstMes                string                 `json:"first_mes"`
+	MesExample              string                 `json:"mes_example"`
+	CreatorNotes            string                 `json:"creator_notes"`
+	SystemPrompt            string                 `json:"system_prompt"`
+	PostHistoryInstructions string                 `json:"post_history_instructions"`
+	AlternateGreetings      []string               `json:"alternate_greetings"`
+	Tags                    []string               `json:"tags"`
+	Creator                 string                 `json:"creator"`
+	CharacterVersion        string                 `json:"character_version"`
+	Extensions              map[string]interface{} `json:"extensions"`
+}
+
+// negotiatePersonaFormat picks a format from an explicit name or the Accept header
+func negotiatePersonaFormat(r *http.Request, explicit string) (string, error) {
+	if explicit == "" {
+		explicit = r.URL.Query().Get("format")
+	}
+	if explicit != "" {
+		format := strings.ToLower(explicit)
+		if _, ok := personaFormatMediaTypes[format]; !ok {
+			return "", fmt.Errorf("unsupported format: %s", explicit)
+		}
+		return format, nil
+	}
+
+	// The most preferred supported type wins, earlier on ties; q=0 means
+	// "not acceptable"
+	best, bestQ := personaFormatJSON, 0.0
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		format := personaFormatForMediaType(part)
+		if format == "" {
+			continue
+		}
+		q := 1.0
+		if _, params, err := mime.ParseMediaType(strings.TrimSpace(part)); err == nil && params["q"] != "" {
+			if q, err = strconv.ParseFloat(params["q"], 64); err != nil {
+				continue
+			}
+		}
+		if q > bestQ {
+			best, bestQ = format, q
+		}
+	}
+	return best, nil
+}
+
+// personaFormatForMediaType maps a media type (parameters allowed) to a format name
+func personaFormatForMediaType(value string) string {
+	mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(value))
+	if err != nil {
+		return ""
+	}
+	switch mediaType {
+	case "text/csv":
+		return personaFormatCSV
+	case "application/x-ndjson", "application/ndjson", "application/jsonl":
+		return personaFormatNDJSON
+	case personaFormatMediaTypes[personaFormatCard]:
+		return personaFormatCard
+	case "application/json":
+		return personaFormatJSON
+	}
+	return ""
+}
+
+// writePersonas encodes personas in a non-envelope format
+func writePersonas(w http.ResponseWriter, format string, personas []Persona) error {
+	w.Header().Set("Content-Type", personaFormatMediaTypes[format])
+	switch format {
+	case personaFormatCSV:
+		return writePersonasCSV(w, personas)
+	case personaFormatNDJSON:
+		encoder := json.NewEncoder(w)
+		for _, p := range personas {
+			if err := encoder.Encode(p); err != nil {
+				return err
+			}
+		}
+		return nil
+	case personaFormatCard:
+		// Chat frontends import one card per file
+		if len(personas) == 1 {
+			return json.NewEncoder(w).Encode(personaToCard(personas[0]))
+		}
+		w.Header().Set("Content-Type", "application/zip")
+		return writePersonaCardsZip(w, personas)
+	default:
+		return json.NewEncoder(w).Encode(personas)
+	}
+}
+
+// writePersonaCardsZip writes a zip holding one card file per persona
+func writePersonaCardsZip(w io.Writer, personas []Persona) error {
+	archive := zip.NewWriter(w)
+	for i, p := range personas {
+		file, err := archive.Create(fmt.Sprintf("%03d-%s.card.json", i+1, cardFileName(p.Name)))
+		if err != nil {
+			return err
+		}
+		if err := json.NewEncoder(file).Encode(personaToCard(p)); err != nil {
+			return err
+		}
+	}
+	return archive.Close()
+}
+
+// cardFileName reduces a name to characters safe in any file system
+func cardFileName(name string) string {
+	safe := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' {
+			return r
+		}
+		return '-'
+	}, strings.TrimSpace(name))
+	if safe == "" {
+		return "persona"
+	}
+	return safe
+}
+
+// readPersonaCardsZip reads every .json card in a zip, decompressing at most
+// limit bytes in total
+func readPersonaCardsZip(data []byte, limit int64) ([]CharacterCard, error) {
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid card archive: %v", err)
+	}
+	var cards []CharacterCard
+	for _, file := range archive.File {
+		if file.FileInfo().IsDir() || !strings.HasSuffix(strings.ToLower(file.Name), ".json") {
+			continue
+		}
+		rc, err := file.Open()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", file.Name, err)
+		}
+		content, err := io.ReadAll(io.LimitReader(rc, limit+1))
+		rc.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", file.Name, err)
+		}
+		if limit -= int64(len(content)); limit < 0 {
+			return nil, fmt.Errorf("card archive too large")
+		}
+		var card CharacterCard
+		if err := json.Unmarshal(content, &card); err != nil {
+			return nil, fmt.Errorf("%s: invalid character card: %v", file.Name, err)
+		}
+		cards = append(cards, card)
+	}
+	return cards, nil
+}
+
+// writePersonasCSV flattens traits and motivations into numbered columns
+func writePersonasCSV(w io.Writer, personas []Persona) error {
+	maxTraits, maxMotivations := 0, 0
+	for _, p := range personas {
+		if len(p.Traits) > maxTraits {
+			maxTraits = len(p.Traits)
+		}
+		if len(p.Motivations) > maxMotivations {
+			maxMotivations = len(p.Motivations)
+		}
+	}
+
+	header := []string{"id", "name", "socialSetting", "background", "communicationStyle", "generated"}
+	for i := 1; i <= maxTraits; i++ {
+		header = append(header, fmt.Sprintf("trait_%d", i))
+	}
+	for i := 1; i <= maxMotivations; i++ {
+		header = append(header, fmt.Sprintf("motivation_%d", i))
+	}
+	header = append(header, "metadata")
+
+	writer := csv.NewWriter(w)
+	if err := writer.Write(header); err != nil {
+		return err
+	}
+	for _, p := range personas {
+		metadata, err := json.Marshal(p.Metadata)
+		if err != nil {
+			return err
+		}
+		record := []string{p.ID, p.Name, p.SocialSetting, p.Background, p.CommunicationStyle, p.Generated.Format(time.RFC3339)}
+		record = append(record, padded(p.Traits, maxTraits)...)
+		record = append(record, padded(p.Motivations, maxMotivations)...)
+		record = append(record, string(metadata))
+		if err := writer.Write(record); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+func padded(values []string, length int) []string {
+	result := make([]string, length)
+	copy(result, values)
+	return result
+}
+
+// personaToCard converts a persona to a character card, keeping the original
+// fields in an extension so the card can be imported back losslessly
+func personaToCard(p Persona) CharacterCard {
+	tags := append([]string{p.SocialSetting}, p.Traits...)
+	return CharacterCard{
+		Spec:        "chara_card_v2",
+		SpecVersion: "2.0",
+		Data: CharacterCardData{
+			Name:        p.Name,
+			Description: p.Background,
+			Personality: strings.Join(p.Traits, ", "),
+			Scenario:    fmt.Sprintf("A %s setting.", p.SocialSetting),
+			SystemPrompt: fmt.Sprintf("You are %s. Motivations: %s. Communication style: %s.",
+				p.Name, strings.Join(p.Motivations, ", "), p.CommunicationStyle),
+			CreatorNotes:       "Generated by Hexperiment System Protocol",
+			AlternateGreetings: []string{},
+			Tags:               tags,
+			Creator:            "hexperiment-system-protocol",
+			CharacterVersion:   "2.0",
+			Extensions: map[string]interface{}{
+				"hexperiment": p,
+			},
+		},
+	}
+}
+
+// cardToPersona converts a character card back into a persona
+func cardToPersona(card CharacterCard) Persona {
+	if ext, ok := card.Data.Extensions["hexperiment"]; ok {
+		raw, err := json.Marshal(ext)
+		if err == nil {
+			var p Persona
+			if json.Unmarshal(raw, &p) == nil && p.Name != "" {
+				return p
+			}
+		}
+	}
+
+	var traits []string
+	for _, t := range strings.Split(card.Data.Personality, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			traits = append(traits, t)
+		}
+	}
+	return Persona{
+		Name:        card.Data.Name,
+		Background:  card.Data.Description,
+		Traits:      traits,
+		Motivations: []string{},
+		Metadata: map[string]interface{}{
+			"card_creator": card.Data.Creator,
+			"card_tags":    card.Data.Tags,
+		},
+	}
+}
+
+// readPersonas decodes personas in any supported format
+func readPersonas(format string, body io.Reader) ([]Persona, error) {
+	switch format {
+	case personaFormatCSV:
+		return readPersonasCSV(body)
+	case personaFormatNDJSON:
+		var personas []Persona
+		scanner := bufio.NewScanner(body)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		line := 0
+		for scanner.Scan() {
+			line++
+			text := bytes.TrimSpace(scanner.Bytes())
+			if len(text) == 0 {
+				continue
+			}
+			var p Persona
+			if err := json.Unmarshal(text, &p); err != nil {
+				return nil, fmt.Errorf("line %d: %v", line, err)
+			}
+			personas = append(personas, p)
+		}
+		return personas, scanner.Err()
+	case personaFormatCard:
+		data, err := io.ReadAll(body)
+		if err != nil {
+			return nil, err
+		}
+		var cards []CharacterCard
+		if bytes.HasPrefix(data, []byte("PK\x03\x04")) {
+			if cards, err = readPersonaCardsZip(data, maxPersonaImportBytes); err != nil {
+				return nil, err
+			}
+		} else if err := json.Unmarshal(data, &cards); err != nil {
+			var card CharacterCard
+			if err := json.Unmarshal(data, &card); err != nil {
+				return nil, fmt.Errorf("invalid character card: %v", err)
+			}
+			cards = []CharacterCard{card}
+		}
+		personas := make([]Persona, len(cards))
+		for i, card := range cards {
+			personas[i] = cardToPersona(card)
+		}
+		return personas, nil
+	default:
+		data, err := io.ReadAll(body)
+		if err != nil {
+			return nil, err
+		}
+		// Accept a bare array or the generation response envelope
+		var personas []Persona
+		if err := json.Unmarshal(data, &personas); err != nil {
+			var envelope struct {
+				Personas []Persona `json:"personas"`
+			}
+			if err := json.Unmarshal(data, &envelope); err != nil {
+				return nil, fmt.Errorf("invalid persona JSON: %v", err)
+			}
+			personas = envelope.Personas
+		}
+		return personas, nil
+	}
+}
+
+func readPersonasCSV(body io.Reader) ([]Persona, error) {
+	records, err := csv.NewReader(body).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, nil
+	}
+
+	header := records[0]
+	personas := make([]Persona, 0, len(records)-1)
+	for row, record := range records[1:] {
+		p := Persona{Traits: []string{}, Motivations: []string{}}
+		for i, column := range header {
+			if i >= len(record) {
+				break
+			}
+			value := record[i]
+			switch {
+			case column == "id":
+				p.ID = value
+			case column == "name":
+				p.Name = value
+			case column == "socialSetting":
+				p.SocialSetting = value
+			case column == "background":
+				p.Background = value
+			case column == "communicationStyle":
+				p.CommunicationStyle = value
+			case column == "generated":
+				if value != "" {
+					generated, err := time.Parse(time.RFC3339, value)
+					if err != nil {
+						return nil, fmt.Errorf("row %d: invalid generated time: %v", row+2, err)
+					}
+					p.Generated = generated
+				}
+			case strings.HasPrefix(column, "trait_"):
+				if value != "" {
+					p.Traits = append(p.Traits, value)
+				}
+			case strings.HasPrefix(column, "motivation_"):
+				if value != "" {
+					p.Motivations = append(p.Motivations, value)
+				}
+			case column == "metadata":
+				if value != "" {
+					if err := json.Unmarshal([]byte(value), &p.Metadata); err != nil {
+						return nil, fmt.Errorf("row %d: invalid metadata: %v", row+2, err)
+					}
+				}
+			}
+		}
+		personas = append(personas, p)
+	}
+	return personas, nil
+}
+
+// Persona export handler: serializes stored personas in the negotiated format
+func personaExportHandler(w http.ResponseWriter, r *http.Request) {
+	format, err := negotiatePersonaFormat(r, "")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	personas := personaRegistry.List()
+	if ids := r.URL.Query().Get("ids"); ids != "" {
+		personas = personas[:0:0]
+		for _, id := range strings.Split(ids, ",") {
+			if p, ok := personaRegistry.Get(strings.TrimSpace(id)); ok {
+				personas = append(personas, p)
+			}
+		}
+	}
+
+	extension := map[string]string{
+		personaFormatJSON:   "json",
+		personaFormatCSV:    "csv",
+		personaFormatNDJSON: "ndjson",
+		personaFormatCard:   "card.json",
+	}[format]
+	if format == personaFormatCard && len(personas) != 1 {
+		extension = "cards.zip"
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="personas.%s"`, extension))
+	writePersonas(w, format, personas)
+}
+
+// Persona import handler: accepts any export format back into the store
+func personaImportHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	format := strings.ToLower(r.URL.Query().Get("format"))
+	if format == "" {
+		format = personaFormatForMediaType(r.Header.Get("Content-Type"))
+		// Exports of several cards are zips
+		if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "application/zip" {
+			format = personaFormatCard
+		}
+	}
+	if format == "" {
+		format = personaFormatJSON
+	}
+	if _, ok := personaFormatMediaTypes[format]; !ok {
+		http.Error(w, "Unsupported format", http.StatusBadRequest)
+		return
+	}
+
+	imported, err := readPersonas(format, http.MaxBytesReader(w, r.Body, maxPersonaImportBytes))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	ids := make([]string, 0, len(imported))
+	for i := range imported {
+		p := &imported[i]
+		if strings.TrimSpace(p.Name) == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   fmt.Sprintf("persona %d has no name", i),
+			})
+			return
+		}
+		if p.ID == "" {
+			p.ID = fmt.Sprintf("persona-%d-%d", time.Now().UnixNano(), rand.Intn(1000))
+		}
+		if p.Generated.IsZero() {
+			p.Generated = time.Now()
+		}
+		if p.Metadata == nil {
+			p.Metadata = make(map[string]interface{})
+		}
+		p.Metadata["imported_from"] = format
+		ids = append(ids, p.ID)
+	}
+	personaRegistry.Save(imported...)
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"count":   len(imported),
+		"ids":     ids,
+		"format":  format,
+	})
+}
@@ -0,0 +1,80 @@
+package main
+
+import "sync"
+
+// PersonaStore keeps generated personas addressable by ID so later requests
+// (dialogues, exports) can refer to them
+type PersonaStore struct {
+	mu       sync.RWMutex
+	personas map[string]Persona
+	order    []string
+}
+
+// The store keeps at most this many personas, evicting the oldest
+const maxStoredPersonas = 1000
+
+var personaRegistry = NewPersonaStore()
+
+func NewPersonaStore() *PersonaStore {
+	return &PersonaStore{personas: make(map[string]Persona)}
+}
+
+// Save adds or replaces personas, keeping insertion order for listings and
+// evicting the oldest beyond maxStoredPersonas
+func (s *PersonaStore) Save(personas ...Persona) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, p := range personas {
+		if _, exists := s.personas[p.ID]; !exists {
+			s.order = append(s.order, p.ID)
+		}
+		s.personas[p.ID] = p
+	}
+	if excess := len(s.order) - maxStoredPersonas; excess > 0 {
+		for _, id := range s.order[:excess] {
+			delete(s.personas, id)
+		}
+		s.order = append([]string(nil), s.order[excess:]...)
+	}
+}
+
+// Update replaces a stored persona with fn's result, holding the lock
+// throughout so concurrent updates cannot overwrite one another. fn must not
+// call back into the store.
+func (s *PersonaStore) Update(id string, fn func(Persona) Persona) (Persona, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.personas[id]
+	if !ok {
+		return Persona{}, false
+	}
+	p = fn(p)
+	s.personas[id] = p
+	return p, true
+}
+
+// Get returns the persona with the given ID
+func (s *PersonaStore) Get(id string) (Persona, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	p, ok := s.personas[id]
+	return p, ok
+}
+
+// List returns all stored personas in insertion order
+func (s *PersonaStore) List() []Persona {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	result := make([]Persona, 0, len(s.order))
+	for _, id := range s.order {
+		result = append(result, s.personas[id])
+	}
+	return result
+}
+
+// Count returns the number of stored personas
+func (s *PersonaStore) Count() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.personas)
+}
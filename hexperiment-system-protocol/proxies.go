@@ -0,0 +1,152 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Read-only public endpoints; GITHUB_PROXY_PATHS replaces the list
+var defaultGitHubProxyPaths = []string{"/repos", "/users", "/orgs", "/search", "/rate_limit"}
+
+// Routes that predate /api/proxy/<name>; they share the upstream's limits
+var legacyUpstreamRoutes = map[string]string{
+	"github":      "/api/github",
+	"huggingface": "/api/huggingface",
+}
+
+const (
+	defaultProxyMaxRequestBytes  = 1 << 20
+	defaultProxyMaxResponseBytes = 10 << 20
+)
+
+// builtinUpstreams declares the GitHub and HuggingFace upstreams from their
+// environment: GITHUB_PROXY_PATHS (path prefixes) and HF_PROXY_MODELS (model
+// IDs, "org/*" for a whole org; none are allowed until it is set), and the
+// PROXY_MAX_REQUEST_BYTES / PROXY_MAX_RESPONSE_BYTES caps. GitHub responses
+// are cached in memory, or in GITHUB_CACHE_DIR, unless GITHUB_CACHE=off.
+func builtinUpstreams() []UpstreamConfig {
+	maxRequest, maxResponse := int64(defaultProxyMaxRequestBytes), int64(defaultProxyMaxResponseBytes)
+	for name, target := range map[string]*int64{
+		"PROXY_MAX_REQUEST_BYTES":  &maxRequest,
+		"PROXY_MAX_RESPONSE_BYTES": &maxResponse,
+	} {
+		if value := os.Getenv(name); value != "" {
+			if n, err := strconv.ParseInt(value, 10, 64); err == nil && n > 0 {
+				*target = n
+			} else {
+				log.Printf("⚠️ Ignoring invalid %s %q", name, value)
+			}
+		}
+	}
+
+	prefixes := splitList(os.Getenv("GITHUB_PROXY_PATHS"))
+	if prefixes == nil {
+		prefixes = defaultGitHubProxyPaths
+	}
+	githubPaths := make([]string, 0, len(prefixes))
+	for _, prefix := range prefixes {
+		githubPaths = append(githubPaths, "/"+strings.Trim(prefix, "/")+"/**")
+	}
+	var githubCache *UpstreamCacheConfig
+	if !strings.EqualFold(os.Getenv("GITHUB_CACHE"), "off") {
+		githubCache = &UpstreamCacheConfig{Dir: os.Getenv("GITHUB_CACHE_DIR")}
+		if value := os.Getenv("GITHUB_CACHE_MAX_ENTRIES"); value != "" {
+			if n, err := strconv.Atoi(value); err == nil && n > 0 {
+				githubCache.MaxEntries = n
+			} else {
+				log.Printf("⚠️ Ignoring invalid GITHUB_CACHE_MAX_ENTRIES %q", value)
+			}
+		}
+	}
+	var modelPaths []string
+	for _, model := range splitList(os.Getenv("HF_PROXY_MODELS")) {
+		modelPaths = append(modelPaths, "/models/"+strings.Trim(model, "/"))
+	}
+
+	return []UpstreamConfig{
+		{
+			Name:             "github",
+			BaseURL:          "https://api.github.com",
+			Scope:            scopeProxyGitHub,
+			Methods:          []string{"GET"},
+			Paths:            githubPaths,
+			Secret:           &UpstreamSecret{Header: "Authorization", Prefix: "Bearer ", Env: "GITHUB_TOKEN"},
+			Timeout:          "10s",
+			MaxResponseBytes: maxResponse,
+			ResponseHeaders:  append([]string{"Content-Type", "ETag", "Last-Modified", "Cache-Control", "Link"}, upstreamRateLimitHeaders...),
+			SetHeaders:       map[string]string{"Accept": "application/vnd.github+json"},
+			Cache:            githubCache,
+			// Shared by all callers of the server's token
+			RateLimit: &RouteLimit{
+				PerKey: &RateLimit{Requests: 60, Per: "1m", Burst: 20},
+				PerIP:  &RateLimit{Requests: 60, Per: "1m", Burst: 20},
+			},
+		},
+		{
+			Name:             "huggingface",
+			BaseURL:          "https://api-inference.huggingface.co",
+			Scope:            scopeProxyHuggingFace,
+			Methods:          []string{"POST"},
+			Paths:            modelPaths,
+			Secret:           &UpstreamSecret{Header: "Authorization", Prefix: "Bearer ", Env: "HUGGINGFACE_TOKEN"},
+			Timeout:          "30s",
+			MaxRequestBytes:  maxRequest,
+			MaxResponseBytes: maxResponse,
+			SetHeaders:       map[string]string{"Content-Type": "application/json"},
+			RateLimit: &RouteLimit{
+				PerKey: &RateLimit{Requests: 20, Per: "1m", Burst: 5},
+				PerIP:  &RateLimit{Requests: 20, Per: "1m", Burst: 5},
+			},
+		},
+	}
+}
+
+// legacyUpstream returns a built-in upstream, answering 503 if a config file
+// removed it
+func legacyUpstream(w http.ResponseWriter, name string) *UpstreamProxy {
+	p := upstreams[name]
+	if p == nil {
+		http.Error(w, "Upstream "+name+" not configured", http.StatusServiceUnavailable)
+	}
+	return p
+}
+
+// --- Minimal GitHub API proxy (secure, no secrets in code) ---
+// GET /api/github?path=/repos/...; the same as /api/proxy/github/repos/...
+func githubProxyHandler(w http.ResponseWriter, r *http.Request) {
+	p := legacyUpstream(w, "github")
+	if p == nil {
+		return
+	}
+	// The path may carry its own query string, but never a host
+	requested := r.URL.Query().Get("path")
+	if !strings.HasPrefix(requested, "/") || strings.HasPrefix(requested, "//") {
+		http.Error(w, "Invalid path: path must start with a single /", http.StatusForbidden)
+		return
+	}
+	u, err := url.Parse(requested)
+	if err != nil || u.Scheme != "" || u.Host != "" || u.User != nil {
+		http.Error(w, "Invalid path", http.StatusForbidden)
+		return
+	}
+	p.Forward(w, r, u.Path, u.Query())
+}
+
+// POST /api/huggingface?model=org/name; the same as
+// /api/proxy/huggingface/models/org/name
+func huggingfaceProxyHandler(w http.ResponseWriter, r *http.Request) {
+	p := legacyUpstream(w, "huggingface")
+	if p == nil {
+		return
+	}
+	model := r.URL.Query().Get("model")
+	if model == "" {
+		http.Error(w, "Invalid model", http.StatusBadRequest)
+		return
+	}
+	p.Forward(w, r, "/models/"+model, url.Values{})
+}
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// RateLimit is a token bucket: Requests per Per on average, with bursts of
+// up to Burst (default Requests). Zero requests disables the limit.
+type RateLimit struct {
+	Requests float64 `json:"requests"`
+	Per      string  `json:"per"`
+	Burst    float64 `json:"burst"`
+	period   time.Duration
+}
+
+// RouteLimit limits a route per caller (API key or token subject) and per
+// client IP. Unset limits fall back to the default route limit.
+type RouteLimit struct {
+	PerKey *RateLimit `json:"perKey"`
+	PerIP  *RateLimit `json:"perIP"`
+}
+
+// WebSocketLimits limits the messages of each connection. Expensive message
+// types, which start LM Studio calls, also draw from a second, slower bucket.
+type WebSocketLimits struct {
+	Messages       *RateLimit `json:"messages"`
+	Expensive      *RateLimit `json:"expensive"`
+	ExpensiveTypes []string   `json:"expensiveTypes"`
+}
+
+// RateLimitConfig is read from the JSON file named by RATE_LIMITS, on top of
+// the defaults. Routes are keyed by their path template, e.g.
+// "/api/persona/{id}/actions", or "upstream:<name>" for all routes of a proxy
+// upstream.
+type RateLimitConfig struct {
+	// TrustProxy takes the client IP from X-Forwarded-For; only enable it
+	// behind a proxy that sets the header. TrustedProxies is how many proxies
+	// append to it (default 1): the entry that many from the right is the
+	// client, as the ones further left are whatever the client sent.
+	TrustProxy     bool                  `json:"trustProxy"`
+	TrustedProxies int                   `json:"trustedProxies"`
+	Default        RouteLimit            `json:"default"`
+	Routes         map[string]RouteLimit `json:"routes"`
+	WebSocket      WebSocketLimits       `json:"websocket"`
+}
+
+var defaultRateLimitConfig = RateLimitConfig{
+	Default: RouteLimit{
+		PerKey: &RateLimit{Requests: 600, Per: "1m", Burst: 120},
+		PerIP:  &RateLimit{Requests: 600, Per: "1m", Burst: 120},
+	},
+	Routes: map[string]RouteLimit{
+		// Each call can hold an LM Studio request for up to 30s
+		"/api/lmstudio/chat": {
+			PerKey: &RateLimit{Requests: 20, Per: "1m", Burst: 5},
+			PerIP:  &RateLimit{Requests: 30, Per: "1m", Burst: 5},
+		},
+		"/api/persona/generate": {
+			PerKey: &RateLimit{Requests: 60, Per: "1m", Burst: 10},
+			PerIP:  &RateLimit{Requests: 60, Per: "1m", Burst: 10},
+		},
+		"/api/persona/dialogue": {
+			PerKey: &RateLimit{Requests: 10, Per: "1m", Burst: 3},
+			PerIP:  &RateLimit{Requests: 20, Per: "1m", Burst: 3},
+		},
+	},
+	WebSocket: WebSocketLimits{
+		Messages:       &RateLimit{Requests: 10, Per: "1s", Burst: 30},
+		Expensive:      &RateLimit{Requests: 10, Per: "1m", Burst: 3},
+		ExpensiveTypes: []string{"lmstudio_request", "persona_request", "persona_dialogue_request"},
+	},
+}
+
+// loadRateLimitConfig reads limits from RATE_LIMITS, falling back to the defaults
+func loadRateLimitConfig() RateLimitConfig {
+	path := os.Getenv("RATE_LIMITS")
+	if path == "" {
+		return defaultRateLimitConfig
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Printf("⚠️ Failed to read rate limits: %v", err)
+		return defaultRateLimitConfig
+	}
+	// The file overrides the defaults it mentions; "requests": 0 lifts a limit
+	config := defaultRateLimitConfig.clone()
+	if err := json.Unmarshal(data, &config); err != nil {
+		log.Printf("⚠️ Invalid rate limits: %v", err)
+		return defaultRateLimitConfig
+	}
+	if err := config.validate(); err != nil {
+		log.Printf("⚠️ Invalid rate limits: %v", err)
+		return defaultRateLimitConfig
+	}
+	return config
+}
+
+func (l *RateLimit) validate() error {
+	if l == nil || l.Requests == 0 {
+		return nil
+	}
+	if l.Requests < 0 || l.Burst < 0 {
+		return fmt.Errorf("requests and burst must not be negative")
+	}
+	if l.Per == "" {
+		l.Per = "1m"
+	}
+	period, err := time.ParseDuration(l.Per)
+	if err != nil || period <= 0 {
+		return fmt.Errorf("invalid period %q", l.Per)
+	}
+	l.period = period
+	if l.Burst == 0 {
+		l.Burst = l.Requests
+	}
+	if l.Burst < 1 {
+		l.Burst = 1
+	}
+	return nil
+}
+
+// rate is the refill rate in tokens per second
+func (l *RateLimit) rate() float64 {
+	return l.Requests / l.period.Seconds()
+}
+
+func (l *RateLimit) enabled() bool {
+	return l != nil && l.Requests > 0
+}
+
+// clone deep-copies the limits, so decoding or validating the copy never
+// writes to the shared defaults
+func (c RateLimitConfig) clone() RateLimitConfig {
+	c.Default = RouteLimit{PerKey: copyRateLimit(c.Default.PerKey), PerIP: copyRateLimit(c.Default.PerIP)}
+	routes := make(map[string]RouteLimit, len(c.Routes))
+	for route, limit := range c.Routes {
+		routes[route] = RouteLimit{PerKey: copyRateLimit(limit.PerKey), PerIP: copyRateLimit(limit.PerIP)}
+	}
+	c.Routes = routes
+	c.WebSocket.Messages = copyRateLimit(c.WebSocket.Messages)
+	c.WebSocket.Expensive = copyRateLimit(c.WebSocket.Expensive)
+	c.WebSocket.ExpensiveTypes = append([]string(nil), c.WebSocket.ExpensiveTypes...)
+	return c
+}
+
+func copyRateLimit(l *RateLimit) *RateLimit {
+	if l == nil {
+		return nil
+	}
+	copied := *l
+	return &copied
+}
+
+func (c *RateLimitConfig) validate() error {
+	check := func(name string, l *RateLimit) error {
+		if err := l.validate(); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		return nil
+	}
+	if err := check("default.perKey", c.Default.PerKey); err != nil {
+		return err
+	}
+	if err := check("default.perIP", c.Default.PerIP); err != nil {
+		return err
+	}
+	for route, limit := range c.Routes {
+		if err := check(route+".perKey", limit.PerKey); err != nil {
+			return err
+		}
+		if err := check(route+".perIP", limit.PerIP); err != nil {
+			return err
+		}
+	}
+	if err := check("websocket.messages", c.WebSocket.Messages); err != nil {
+		return err
+	}
+	return check("websocket.expensive", c.WebSocket.Expensive)
+}
+
+// tokenBucket holds the tokens left at the time of its last use
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take removes one token if available, or reports how long until one is
+func (b *tokenBucket) take(limit *RateLimit, now time.Time) (bool, time.Duration) {
+	if b.last.IsZero() {
+		b.tokens = limit.Burst
+	} else {
+		b.tokens = math.Min(limit.Burst, b.tokens+now.Sub(b.last).Seconds()*limit.rate())
+	}
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / limit.rate() * float64(time.Second))
+}
+
+// RateLimiter keeps the per-key and per-IP buckets of every route
+type RateLimiter struct {
+	mu      sync.Mutex
+	config  RateLimitConfig
+	buckets map[string]*tokenBucket
+	swept   time.Time
+	// groups maps route templates to a bucket group they share
+	groups map[string]string
+}
+
+var rateLimits = NewRateLimiter(defaultRateLimitConfig)
+
+func NewRateLimiter(config RateLimitConfig) *RateLimiter {
+	config = config.clone()
+	config.validate()
+	return &RateLimiter{config: config, buckets: make(map[string]*tokenBucket), swept: time.Now(), groups: make(map[string]string)}
+}
+
+// shareLimit makes routes draw from the buckets of one group, so a caller
+// cannot double its allowance by alternating between them. Limits set for
+// the group in RATE_LIMITS take precedence over the given ones. It must be
+// called before the server starts.
+func (l *RateLimiter) shareLimit(group string, limit RouteLimit, templates ...string) {
+	configured := l.config.Routes[group]
+	if configured.PerKey == nil {
+		configured.PerKey = copyRateLimit(limit.PerKey)
+	}
+	if configured.PerIP == nil {
+		configured.PerIP = copyRateLimit(limit.PerIP)
+	}
+	l.config.Routes[group] = configured
+	for _, template := range templates {
+		l.groups[template] = group
+	}
+}
+
+// Buckets idle this long are dropped; a recreated bucket starts full, which
+// only matters for limits that take longer than this to refill
+const rateLimitSweepInterval = time.Minute
+
+// take draws a token from a named bucket
+func (l *RateLimiter) take(name string, limit *RateLimit) (bool, time.Duration) {
+	if !limit.enabled() {
+		return true, 0
+	}
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.swept) > rateLimitSweepInterval {
+		for key, b := range l.buckets {
+			if now.Sub(b.last) > rateLimitSweepInterval {
+				delete(l.buckets, key)
+			}
+		}
+		l.swept = now
+	}
+	b, ok := l.buckets[name]
+	if !ok {
+		b = &tokenBucket{}
+		l.buckets[name] = b
+	}
+	return b.take(limit, now)
+}
+
+// route returns the route's bucket group and limits. Routes without their
+// own limits share one default group.
+func (l *RateLimiter) route(r *http.Request) (string, RouteLimit) {
+	limit := l.config.Default
+	if current := mux.CurrentRoute(r); current != nil {
+		if template, err := current.GetPathTemplate(); err == nil {
+			group := template
+			if shared, ok := l.groups[template]; ok {
+				group = shared
+			}
+			if custom, ok := l.config.Routes[group]; ok {
+				if custom.PerKey != nil {
+					limit.PerKey = custom.PerKey
+				}
+				if custom.PerIP != nil {
+					limit.PerIP = custom.PerIP
+				}
+				return group, limit
+			}
+		}
+	}
+	return "*", limit
+}
+
+// clientIP is the request's source address, or the X-Forwarded-For entry
+// added by the outermost trusted proxy
+func (l *RateLimiter) clientIP(r *http.Request) string {
+	if l.config.TrustProxy {
+		// Proxies may append to the header or add another one
+		entries := splitList(strings.Join(r.Header.Values("X-Forwarded-For"), ","))
+		if len(entries) > 0 {
+			hops := l.config.TrustedProxies
+			if hops < 1 {
+				hops = 1
+			}
+			if hops > len(entries) {
+				// Fewer entries than proxies means the client sent none, so
+				// even the leftmost was added by a proxy
+				hops = len(entries)
+			}
+			return entries[len(entries)-hops]
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// allowIP applies the route's per-IP limit, answering 429 when exceeded.
+// It runs before authentication, so it also slows down key guessing.
+func (l *RateLimiter) allowIP(w http.ResponseWriter, r *http.Request) bool {
+	group, limit := l.route(r)
+	ok, retry := l.take(group+"|ip|"+l.clientIP(r), limit.PerIP)
+	if !ok {
+		writeRateLimited(w, retry)
+	}
+	return ok
+}
+
+// allowKey applies the route's per-caller limit, answering 429 when exceeded.
+// Anonymous callers in open mode are only limited per IP.
+func (l *RateLimiter) allowKey(w http.ResponseWriter, r *http.Request, identity *Identity) bool {
+	if identity.Method == "none" {
+		return true
+	}
+	caller := identity.KeyID
+	if identity.Method != "api_key" || caller == "" {
+		caller = identity.Method + ":" + identity.Subject
+	}
+	group, limit := l.route(r)
+	ok, retry := l.take(group+"|key|"+caller, limit.PerKey)
+	if !ok {
+		writeRateLimited(w, retry)
+	}
+	return ok
+}
+
+// writeRateLimited answers 429 with the whole seconds until a retry can succeed
+func writeRateLimited(w http.ResponseWriter, retry time.Duration) {
+	seconds := int(math.Ceil(retry.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	w.WriteHeader(http.StatusTooManyRequests)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":      "Too Many Requests: rate limit exceeded",
+		"retryAfter": seconds,
+	})
+}
+
+// messageLimiter throttles the messages of one WebSocket connection. Only
+// the connection's read loop uses it, so it needs no locking.
+type messageLimiter struct {
+	limits    WebSocketLimits
+	messages  tokenBucket
+	expensive tokenBucket
+}
+
+func (l *RateLimiter) newMessageLimiter() *messageLimiter {
+	return &messageLimiter{limits: l.config.WebSocket}
+}
+
+// allow reports whether a message of the given type may be handled now, or
+// how long the client should wait
+func (m *messageLimiter) allow(messageType string) (bool, time.Duration) {
+	now := time.Now()
+	if m.limits.Messages.enabled() {
+		if ok, retry := m.messages.take(m.limits.Messages, now); !ok {
+			return false, retry
+		}
+	}
+	if m.limits.Expensive.enabled() && contains(m.limits.ExpensiveTypes, messageType) {
+		if ok, retry := m.expensive.take(m.limits.Expensive, now); !ok {
+			return false, retry
+		}
+	}
+	return true, 0
+}
+
+// throttleMessage reports whether the client is over its message rate, and
+// sends it a rate_limited frame if so
+func (c *Client) throttleMessage(protocol Protocol) bool {
+	ok, retry := c.limiter.allow(protocol.Type)
+	if ok {
+		return false
+	}
+	c.send(Protocol{
+		ID:   fmt.Sprintf("rate-limited-%d", time.Now().UnixNano()),
+		Type: "rate_limited",
+		Data: map[string]interface{}{
+			"message_type":   protocol.Type,
+			"request_id":     protocol.ID,
+			"retry_after_ms": retry.Milliseconds() + 1,
+		},
+		Timestamp: time.Now(),
+		Status:    "throttled",
+	})
+	return true
+}
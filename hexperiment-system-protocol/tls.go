@@ -0,0 +1,414 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultTLSReloadInterval = 30 * time.Second
+	devCertValidity          = 30 * 24 * time.Hour
+	// Development certificates are replaced this long before they expire
+	devCertRenewBefore   = 7 * 24 * time.Hour
+	devCertCheckInterval = time.Hour
+)
+
+// CertReloader serves the certificate and client CAs from files, picking up
+// changes (e.g. a renewed certificate) without a restart. A failed reload
+// keeps the previous certificate.
+type CertReloader struct {
+	certFile, keyFile, caFile string
+
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	modTimes  map[string]time.Time
+}
+
+// NewCertReloader loads a certificate and key, and the client CA bundle
+// when caFile is set
+func NewCertReloader(certFile, keyFile, caFile string) (*CertReloader, error) {
+	c := &CertReloader{certFile: certFile, keyFile: keyFile, caFile: caFile}
+	if _, err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *CertReloader) files() []string {
+	files := []string{c.certFile, c.keyFile}
+	if c.caFile != "" {
+		files = append(files, c.caFile)
+	}
+	return files
+}
+
+// reload reads the files again if any of them changed, reporting whether
+// it did
+func (c *CertReloader) reload() (bool, error) {
+	modTimes := make(map[string]time.Time)
+	changed := false
+	for _, file := range c.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			return false, err
+		}
+		modTimes[file] = info.ModTime()
+		c.mu.RLock()
+		changed = changed || !info.ModTime().Equal(c.modTimes[file])
+		c.mu.RUnlock()
+	}
+	if !changed {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return false, err
+	}
+	var clientCAs *x509.CertPool
+	if c.caFile != "" {
+		data, err := os.ReadFile(c.caFile)
+		if err != nil {
+			return false, err
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(data) {
+			return false, fmt.Errorf("no certificates in %s", c.caFile)
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cert = &cert
+	c.clientCAs = clientCAs
+	c.modTimes = modTimes
+	return true, nil
+}
+
+// watch polls the files for changes
+func (c *CertReloader) watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		if reloaded, err := c.reload(); err != nil {
+			log.Printf("⚠️ TLS reload failed, keeping the current certificate: %v", err)
+		} else if reloaded {
+			log.Printf("🔒 Reloaded TLS certificate from %s", c.certFile)
+		}
+	}
+}
+
+func (c *CertReloader) current() (*tls.Certificate, *x509.CertPool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, c.clientCAs
+}
+
+// TLSConfig builds a server config that asks for client certificates with
+// clientAuth when client CAs are configured. Each handshake sees the
+// latest certificate and CAs.
+func (c *CertReloader) TLSConfig(clientAuth tls.ClientAuthType) *tls.Config {
+	base := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: []string{"h2", "http/1.1"},
+	}
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		// Unused once GetConfigForClient answers, but older releases of
+		// net/http require a certificate source on the outer config
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			cert, _ := c.current()
+			return cert, nil
+		},
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cert, clientCAs := c.current()
+			config := base.Clone()
+			config.Certificates = []tls.Certificate{*cert}
+			if clientCAs != nil {
+				config.ClientAuth = clientAuth
+				config.ClientCAs = clientCAs
+			}
+			return config, nil
+		},
+	}
+}
+
+// generateDevCert creates a self-signed ECDSA leaf certificate for localhost
+// and any extra hosts, returned as PEM. It is not a CA, so accepting it in a
+// browser cannot extend to certificates for other sites.
+func generateDevCert(hosts []string) (certPEM, keyPEM []byte, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "hexperiment dev", Organization: []string{"Hexperiment development"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(devCertValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  false,
+	}
+	for _, host := range append([]string{"localhost", "127.0.0.1", "::1"}, hosts...) {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), nil
+}
+
+// ensureDevCert writes a self-signed certificate to certFile and keyFile
+// unless both exist and the certificate is not close to expiry, so a browser
+// exception for it survives restarts
+func ensureDevCert(certFile, keyFile string, hosts []string) error {
+	if _, err := os.Stat(keyFile); err == nil {
+		if expiry, err := certExpiry(certFile); err == nil && time.Until(expiry) > devCertRenewBefore {
+			return nil
+		}
+	}
+	certPEM, keyPEM, err := generateDevCert(hosts)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		return err
+	}
+	if err := os.WriteFile(certFile, certPEM, 0644); err != nil {
+		return err
+	}
+	log.Printf("🔒 Generated a self-signed development certificate in %s", certFile)
+	return nil
+}
+
+// certExpiry returns the NotAfter of the first certificate in a PEM file
+func certExpiry(certFile string) (time.Time, error) {
+	data, err := os.ReadFile(certFile)
+	if err != nil {
+		return time.Time{}, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return time.Time{}, fmt.Errorf("no certificate in %s", certFile)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return cert.NotAfter, nil
+}
+
+// renewDevCert keeps a development certificate valid while the server runs;
+// the reloader picks up the new files
+func renewDevCert(certFile, keyFile string, hosts []string) {
+	for range time.Tick(devCertCheckInterval) {
+		if err := ensureDevCert(certFile, keyFile, hosts); err != nil {
+			log.Printf("⚠️ Failed to renew development certificate: %v", err)
+		}
+	}
+}
+
+// ClientCertRule maps verified client certificates to an identity. Every
+// field that is set must match; a trailing "*" matches any suffix.
+type ClientCertRule struct {
+	CommonName         string `json:"commonName"`
+	Organization       string `json:"organization"`
+	OrganizationalUnit string `json:"organizationalUnit"`
+	DNSName            string `json:"dnsName"`
+	URI                string `json:"uri"`
+	// Subject of the identity; defaults to "cert:<common name>"
+	Subject string   `json:"subject"`
+	Scopes  []string `json:"scopes"`
+}
+
+// Rules from the JSON file named by TLS_CLIENT_IDENTITIES; the first match
+// wins. Without rules client certificates only gate the connection.
+var clientCertRules []ClientCertRule
+
+func matchCertField(pattern string, values ...string) bool {
+	if pattern == "" {
+		return true
+	}
+	for _, value := range values {
+		if value == pattern || (strings.HasSuffix(pattern, "*") && strings.HasPrefix(value, strings.TrimSuffix(pattern, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+func (rule ClientCertRule) matches(cert *x509.Certificate) bool {
+	uris := make([]string, len(cert.URIs))
+	for i, uri := range cert.URIs {
+		uris[i] = uri.String()
+	}
+	return matchCertField(rule.CommonName, cert.Subject.CommonName) &&
+		matchCertField(rule.Organization, cert.Subject.Organization...) &&
+		matchCertField(rule.OrganizationalUnit, cert.Subject.OrganizationalUnit...) &&
+		matchCertField(rule.DNSName, cert.DNSNames...) &&
+		matchCertField(rule.URI, uris...)
+}
+
+// hasClientCertificate reports whether the connection presented a client
+// certificate that chains to the configured CAs
+func hasClientCertificate(r *http.Request) bool {
+	return r.TLS != nil && len(r.TLS.VerifiedChains) > 0 && len(r.TLS.VerifiedChains[0]) > 0
+}
+
+// clientCertIdentity maps the verified client certificate to an identity.
+// Scopes are checked here rather than at load, as upstream scopes are
+// registered later.
+func clientCertIdentity(r *http.Request) (*Identity, bool) {
+	if !hasClientCertificate(r) {
+		return nil, false
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+	for _, rule := range clientCertRules {
+		if !rule.matches(cert) {
+			continue
+		}
+		subject := rule.Subject
+		if subject == "" {
+			subject = "cert:" + cert.Subject.CommonName
+		}
+		var scopes []string
+		for _, scope := range rule.Scopes {
+			if validScope(scope) {
+				scopes = append(scopes, scope)
+			}
+		}
+		sum := sha256.Sum256(cert.Raw)
+		return &Identity{Subject: subject, KeyID: hex.EncodeToString(sum[:8]), Method: "mtls", Scopes: scopes}, true
+	}
+	log.Printf("🔑 No identity for client certificate %q", cert.Subject.String())
+	return nil, false
+}
+
+// loadClientCertRules reads TLS_CLIENT_IDENTITIES
+func loadClientCertRules() {
+	file := os.Getenv("TLS_CLIENT_IDENTITIES")
+	if file == "" {
+		return
+	}
+	var config struct {
+		Clients []ClientCertRule `json:"clients"`
+	}
+	data, err := os.ReadFile(file)
+	if err == nil {
+		err = json.Unmarshal(data, &config)
+	}
+	if err != nil {
+		log.Printf("⚠️ Failed to load client identities from %s: %v", file, err)
+		return
+	}
+	clientCertRules = config.Clients
+}
+
+// loadTLSConfig reads the TLS settings. It returns nil to serve plain HTTP.
+//
+//	TLS_CERT_FILE, TLS_KEY_FILE  server certificate and key, reloaded on change
+//	TLS_DEV_CERT=true            generate a self-signed certificate for
+//	                             localhost (and TLS_DEV_HOSTS) into those files,
+//	                             or dev-cert.pem and dev-key.pem
+//	TLS_CLIENT_CA_FILE           CA bundle for client certificates (mTLS)
+//	TLS_CLIENT_AUTH              "optional" (default) or "require"
+//	TLS_CLIENT_IDENTITIES        JSON file of ClientCertRule under "clients"
+//	TLS_RELOAD_INTERVAL          how often files are checked (default 30s)
+func loadTLSConfig() *tls.Config {
+	certFile, keyFile := os.Getenv("TLS_CERT_FILE"), os.Getenv("TLS_KEY_FILE")
+	if strings.EqualFold(os.Getenv("TLS_DEV_CERT"), "true") {
+		if certFile == "" && keyFile == "" {
+			certFile, keyFile = "dev-cert.pem", "dev-key.pem"
+		}
+		hosts := splitList(os.Getenv("TLS_DEV_HOSTS"))
+		if err := ensureDevCert(certFile, keyFile, hosts); err != nil {
+			log.Fatal("❌ Failed to generate development certificate:", err)
+		}
+		go renewDevCert(certFile, keyFile, hosts)
+	}
+	// Client certificate settings that cannot be enforced stop the server
+	// rather than leave it running without the mTLS the operator expects
+	caFile := os.Getenv("TLS_CLIENT_CA_FILE")
+	clientAuth := tls.VerifyClientCertIfGiven
+	switch mode := strings.ToLower(os.Getenv("TLS_CLIENT_AUTH")); mode {
+	case "", "optional":
+	case "require":
+		clientAuth = tls.RequireAndVerifyClientCert
+		if caFile == "" {
+			log.Fatal("❌ TLS_CLIENT_AUTH=require needs TLS_CLIENT_CA_FILE")
+		}
+	default:
+		log.Fatalf("❌ Unknown TLS_CLIENT_AUTH %q; use optional or require", mode)
+	}
+	if certFile == "" && keyFile == "" {
+		if caFile != "" {
+			log.Fatal("❌ TLS_CLIENT_CA_FILE needs TLS_CERT_FILE and TLS_KEY_FILE, or TLS_DEV_CERT=true")
+		}
+		return nil
+	}
+
+	reloader, err := NewCertReloader(certFile, keyFile, caFile)
+	if err != nil {
+		// Falling back to plain HTTP would expose what TLS was meant to protect
+		log.Fatal("❌ Failed to load TLS certificate:", err)
+	}
+	interval := defaultTLSReloadInterval
+	if value := os.Getenv("TLS_RELOAD_INTERVAL"); value != "" {
+		if d, err := time.ParseDuration(value); err == nil && d > 0 {
+			interval = d
+		} else {
+			log.Printf("⚠️ Ignoring invalid TLS_RELOAD_INTERVAL %q", value)
+		}
+	}
+	go reloader.watch(interval)
+
+	if caFile != "" {
+		loadClientCertRules()
+		log.Printf("🔒 Client certificates verified against %s (%d identity rules)", caFile, len(clientCertRules))
+	} else if os.Getenv("TLS_CLIENT_IDENTITIES") != "" {
+		log.Println("⚠️ TLS_CLIENT_IDENTITIES needs TLS_CLIENT_CA_FILE; client certificates are not requested")
+	}
+	return reloader.TLSConfig(clientAuth)
+}
+
+// serve listens on addr, with TLS when config is set
+func serve(addr string, handler http.Handler, config *tls.Config) error {
+	server := &http.Server{Addr: addr, Handler: handler, TLSConfig: config}
+	if config == nil {
+		return server.ListenAndServe()
+	}
+	// The certificate comes from the config
+	return server.ListenAndServeTLS("", "")
+}
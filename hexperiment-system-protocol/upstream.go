@@ -0,0 +1,509 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// UpstreamConfig declares a service reachable at /api/proxy/{name}/...
+type UpstreamConfig struct {
+	Name    string `json:"name"`
+	BaseURL string `json:"baseUrl"`
+	// Scope callers need; defaults to "proxy:<name>"
+	Scope   string   `json:"scope"`
+	Methods []string `json:"methods"`
+	// Paths are allowed path patterns relative to the base URL: "*" matches
+	// one segment and a trailing "**" any number of segments. Without
+	// patterns nothing is allowed.
+	Paths            []string        `json:"paths"`
+	Secret           *UpstreamSecret `json:"secret"`
+	Timeout          string          `json:"timeout"`
+	MaxRequestBytes  int64           `json:"maxRequestBytes"`
+	MaxResponseBytes int64           `json:"maxResponseBytes"`
+	// RequestHeaders and ResponseHeaders are the headers passed through in
+	// each direction; everything else is dropped
+	RequestHeaders  []string          `json:"requestHeaders"`
+	ResponseHeaders []string          `json:"responseHeaders"`
+	SetHeaders      map[string]string `json:"setHeaders"`
+	// Cache enables response caching for GET requests
+	Cache *UpstreamCacheConfig `json:"cache"`
+	// RateLimit applies to all routes of the upstream together, as they
+	// spend the same upstream quota
+	RateLimit *RouteLimit `json:"rateLimit"`
+}
+
+// UpstreamSecret is a credential injected into every upstream request,
+// read from an environment variable or a file (e.g. a mounted secret) on
+// each request so rotations need no restart
+type UpstreamSecret struct {
+	Header string `json:"header"`
+	Prefix string `json:"prefix"`
+	Env    string `json:"env"`
+	File   string `json:"file"`
+}
+
+const defaultUpstreamTimeout = 10 * time.Second
+
+var (
+	defaultUpstreamRequestHeaders  = []string{"Accept", "Content-Type"}
+	defaultUpstreamResponseHeaders = []string{"Content-Type"}
+	defaultUpstreamRateLimit       = RouteLimit{
+		PerKey: &RateLimit{Requests: 60, Per: "1m", Burst: 20},
+		PerIP:  &RateLimit{Requests: 60, Per: "1m", Burst: 20},
+	}
+)
+
+// Headers that are never forwarded, whatever the config says: the caller's
+// own credentials must not reach upstreams, and upstream cookies must not
+// reach callers
+var blockedUpstreamHeaders = []string{
+	"Authorization", "Proxy-Authorization", "X-API-Key", "Cookie", "Set-Cookie",
+	"Connection", "Keep-Alive", "Transfer-Encoding", "Upgrade", "Te", "Trailer",
+}
+
+// Query parameters that carry the caller's credentials
+var credentialQueryParams = []string{"api_key", "access_token"}
+
+var upstreamNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+// UpstreamProxy forwards requests to one upstream
+type UpstreamProxy struct {
+	config   UpstreamConfig
+	base     *url.URL
+	patterns [][]string
+	client   *http.Client
+	cache    *ResponseCache
+
+	// Latest quota headers the upstream reported
+	mu            sync.Mutex
+	rateLimit     map[string]string
+	rateLimitSeen time.Time
+}
+
+// NewUpstreamProxy validates a config and fills its defaults
+func NewUpstreamProxy(config UpstreamConfig) (*UpstreamProxy, error) {
+	if !upstreamNamePattern.MatchString(config.Name) {
+		return nil, fmt.Errorf("upstream name %q must be lowercase letters, digits and dashes", config.Name)
+	}
+	base, err := url.Parse(config.BaseURL)
+	if err != nil || (base.Scheme != "http" && base.Scheme != "https") || base.Host == "" || base.RawQuery != "" || base.User != nil {
+		return nil, fmt.Errorf("upstream %s: baseUrl must be an http(s) URL without query or credentials", config.Name)
+	}
+	base.Path = strings.TrimSuffix(base.Path, "/")
+	if config.Scope == "" {
+		config.Scope = "proxy:" + config.Name
+	}
+	if len(config.Methods) == 0 {
+		config.Methods = []string{"GET"}
+	}
+	for i, method := range config.Methods {
+		config.Methods[i] = strings.ToUpper(method)
+	}
+	if config.Secret != nil && (config.Secret.Header == "" || (config.Secret.Env == "") == (config.Secret.File == "")) {
+		return nil, fmt.Errorf("upstream %s: secret needs a header and exactly one of env or file", config.Name)
+	}
+	timeout := defaultUpstreamTimeout
+	if config.Timeout != "" {
+		if timeout, err = time.ParseDuration(config.Timeout); err != nil || timeout <= 0 {
+			return nil, fmt.Errorf("upstream %s: invalid timeout %q", config.Name, config.Timeout)
+		}
+	}
+	if config.MaxRequestBytes <= 0 {
+		config.MaxRequestBytes = defaultProxyMaxRequestBytes
+	}
+	if config.MaxResponseBytes <= 0 {
+		config.MaxResponseBytes = defaultProxyMaxResponseBytes
+	}
+	if config.RequestHeaders == nil {
+		config.RequestHeaders = defaultUpstreamRequestHeaders
+	}
+	if config.ResponseHeaders == nil {
+		config.ResponseHeaders = defaultUpstreamResponseHeaders
+	}
+	limit := defaultUpstreamRateLimit
+	if config.RateLimit != nil {
+		limit = *config.RateLimit
+		if limit.PerKey == nil {
+			limit.PerKey = defaultUpstreamRateLimit.PerKey
+		}
+		if limit.PerIP == nil {
+			limit.PerIP = defaultUpstreamRateLimit.PerIP
+		}
+	}
+	limit = RouteLimit{PerKey: copyRateLimit(limit.PerKey), PerIP: copyRateLimit(limit.PerIP)}
+	for _, l := range []*RateLimit{limit.PerKey, limit.PerIP} {
+		if err := l.validate(); err != nil {
+			return nil, fmt.Errorf("upstream %s: rateLimit: %v", config.Name, err)
+		}
+	}
+	config.RateLimit = &limit
+
+	p := &UpstreamProxy{
+		config: config,
+		base:   base,
+		client: &http.Client{
+			Timeout: timeout,
+			// Redirects are relayed, not followed, so the secret only ever
+			// goes to the configured host
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		},
+	}
+	for _, pattern := range config.Paths {
+		p.patterns = append(p.patterns, pathSegments(pattern))
+	}
+	if config.Cache != nil {
+		if p.cache, err = NewResponseCache(*config.Cache); err != nil {
+			log.Printf("⚠️ Upstream %s cache: %v", config.Name, err)
+		}
+	}
+	return p, nil
+}
+
+func pathSegments(p string) []string {
+	return strings.Split(strings.Trim(p, "/"), "/")
+}
+
+// allowsPath matches a cleaned path against the path patterns
+func (p *UpstreamProxy) allowsPath(requested string) bool {
+	segments := pathSegments(requested)
+	for _, pattern := range p.patterns {
+		if matchPathSegments(pattern, segments) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchPathSegments(pattern, segments []string) bool {
+	for i, want := range pattern {
+		if want == "**" && i == len(pattern)-1 {
+			return true
+		}
+		if i >= len(segments) || (want != "*" && want != segments[i]) {
+			return false
+		}
+	}
+	return len(pattern) == len(segments)
+}
+
+// secret resolves the injected credential, or reports which source is missing
+func (p *UpstreamProxy) secret() (string, error) {
+	s := p.config.Secret
+	if s.Env != "" {
+		if value := os.Getenv(s.Env); value != "" {
+			return value, nil
+		}
+		return "", fmt.Errorf("%s not set", s.Env)
+	}
+	data, err := os.ReadFile(s.File)
+	if err != nil || strings.TrimSpace(string(data)) == "" {
+		return "", fmt.Errorf("secret file for upstream %s not readable", p.config.Name)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// ServeHTTP forwards /api/proxy/{name}/<path>?<query>
+func (p *UpstreamProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.Forward(w, r, "/"+mux.Vars(r)["path"], r.URL.Query())
+}
+
+// Forward sends a request for an upstream path with the given query, after
+// checking the method, path and body size, and relays the response
+func (p *UpstreamProxy) Forward(w http.ResponseWriter, r *http.Request, upstreamPath string, query url.Values) {
+	if !containsFold(p.config.Methods, r.Method) {
+		w.Header().Set("Allow", strings.Join(p.config.Methods, ", "))
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if cleaned := path.Clean("/" + upstreamPath); cleaned != upstreamPath && cleaned+"/" != upstreamPath {
+		http.Error(w, "Invalid path: path must not contain . or .. segments or double slashes", http.StatusForbidden)
+		return
+	}
+	if !p.allowsPath(upstreamPath) {
+		http.Error(w, fmt.Sprintf("Invalid path: path %s is not allowed", upstreamPath), http.StatusForbidden)
+		return
+	}
+
+	var secret string
+	if p.config.Secret != nil {
+		var err error
+		if secret, err = p.secret(); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+	}
+
+	var body io.Reader
+	if r.Body != nil && r.Method != "GET" && r.Method != "HEAD" {
+		data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, p.config.MaxRequestBytes))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Request body over %d bytes", p.config.MaxRequestBytes), http.StatusRequestEntityTooLarge)
+			return
+		}
+		body = bytes.NewReader(data)
+	}
+
+	query = cloneValues(query)
+	for _, name := range credentialQueryParams {
+		query.Del(name)
+	}
+	upstream := *p.base
+	upstream.Path = p.base.Path + upstreamPath
+	upstream.RawQuery = query.Encode()
+
+	// Only GETs are cached; a caller's "Cache-Control: no-store" skips the
+	// cache and "no-cache" forces revalidation
+	var key string
+	var entry *cachedResponse
+	if p.cache != nil && r.Method == "GET" {
+		directives := parseCacheControl(r.Header.Get("Cache-Control"))
+		if _, noStore := directives["no-store"]; noStore {
+			p.cache.count("BYPASS")
+		} else {
+			key = cacheKey(r, upstreamPath, upstream.RawQuery)
+			if entry = p.cache.get(key); entry != nil {
+				_, noCache := directives["no-cache"]
+				if entry.fresh(time.Now()) && !noCache {
+					p.cache.count("HIT")
+					serveCached(w, r, entry, "HIT", p.rateLimitHeader())
+					return
+				}
+			}
+		}
+	}
+
+	req, err := http.NewRequestWithContext(r.Context(), r.Method, upstream.String(), body)
+	if err != nil {
+		http.Error(w, "Request error", http.StatusInternalServerError)
+		return
+	}
+	copyAllowedHeaders(req.Header, r.Header, p.config.RequestHeaders)
+	for name, value := range p.config.SetHeaders {
+		req.Header.Set(name, value)
+	}
+	if p.config.Secret != nil {
+		req.Header.Set(p.config.Secret.Header, p.config.Secret.Prefix+secret)
+	}
+	if entry != nil {
+		if entry.ETag != "" {
+			req.Header.Set("If-None-Match", entry.ETag)
+		}
+		if entry.LastModified != "" {
+			req.Header.Set("If-Modified-Since", entry.LastModified)
+		}
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		log.Printf("⚠️ Upstream %s request failed: %v", p.config.Name, err)
+		http.Error(w, fmt.Sprintf("Upstream %s error", p.config.Name), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	p.noteRateLimit(resp.Header)
+
+	if entry != nil && resp.StatusCode == http.StatusNotModified {
+		p.cache.count("REVALIDATED")
+		update := http.Header{}
+		copyAllowedHeaders(update, resp.Header, p.config.ResponseHeaders)
+		serveCached(w, r, p.cache.refresh(entry, resp.Header), "REVALIDATED", update)
+		return
+	}
+
+	// Refuse bodies over the response cap rather than truncating them
+	data, err := io.ReadAll(io.LimitReader(resp.Body, p.config.MaxResponseBytes+1))
+	if err != nil {
+		http.Error(w, "Upstream read error", http.StatusBadGateway)
+		return
+	}
+	if int64(len(data)) > p.config.MaxResponseBytes {
+		http.Error(w, "Upstream response too large", http.StatusBadGateway)
+		return
+	}
+	header := http.Header{}
+	copyAllowedHeaders(header, resp.Header, p.config.ResponseHeaders)
+	if key != "" {
+		p.cache.count("MISS")
+		p.cache.store(key, resp.StatusCode, resp.Header, header, data)
+		w.Header().Set("X-Cache", "MISS")
+	}
+	for name, values := range header {
+		w.Header()[name] = values
+	}
+	w.WriteHeader(resp.StatusCode)
+	w.Write(data)
+}
+
+// noteRateLimit keeps the quota headers of the latest upstream response
+func (p *UpstreamProxy) noteRateLimit(header http.Header) {
+	seen := make(map[string]string)
+	for _, name := range upstreamRateLimitHeaders {
+		if value := header.Get(name); value != "" {
+			seen[name] = value
+		}
+	}
+	if len(seen) == 0 {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.rateLimit = seen
+	p.rateLimitSeen = time.Now()
+}
+
+// rateLimitHeader returns the latest quota headers the caller may see
+func (p *UpstreamProxy) rateLimitHeader() http.Header {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	header := http.Header{}
+	for name, value := range p.rateLimit {
+		if containsFold(p.config.ResponseHeaders, name) {
+			header.Set(name, value)
+		}
+	}
+	return header
+}
+
+// Status reports the upstream's latest quota and its cache statistics
+func (p *UpstreamProxy) Status() map[string]interface{} {
+	status := map[string]interface{}{}
+	p.mu.Lock()
+	if p.rateLimit != nil {
+		rateLimit := map[string]interface{}{"updated": p.rateLimitSeen.UTC().Format(time.RFC3339)}
+		for name, value := range p.rateLimit {
+			field := strings.ToLower(strings.TrimPrefix(name, "X-RateLimit-"))
+			if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+				rateLimit[field] = n
+			} else {
+				rateLimit[field] = value
+			}
+		}
+		status["rate_limit"] = rateLimit
+	}
+	p.mu.Unlock()
+	if p.cache != nil {
+		status["cache"] = p.cache.Stats()
+	}
+	return status
+}
+
+// upstreamStatus reports every upstream with a known quota or a cache
+func upstreamStatus() map[string]interface{} {
+	status := map[string]interface{}{}
+	for name, p := range upstreams {
+		if s := p.Status(); len(s) > 0 {
+			status[name] = s
+		}
+	}
+	return status
+}
+
+// copyAllowedHeaders copies allowlisted headers, never blocked ones
+func copyAllowedHeaders(dst, src http.Header, allowed []string) {
+	for _, name := range allowed {
+		if containsFold(blockedUpstreamHeaders, name) {
+			continue
+		}
+		for _, value := range src.Values(name) {
+			dst.Add(name, value)
+		}
+	}
+}
+
+func cloneValues(values url.Values) url.Values {
+	cloned := make(url.Values, len(values))
+	for key, list := range values {
+		cloned[key] = append([]string(nil), list...)
+	}
+	return cloned
+}
+
+// Upstreams by name, built from the built-in proxies and UPSTREAMS_FILE
+var upstreams = map[string]*UpstreamProxy{}
+
+// loadUpstreams registers the built-in GitHub and HuggingFace upstreams and
+// those declared in the JSON file named by UPSTREAMS_FILE
+// ({"upstreams": [...]}), which may also redefine the built-in ones
+func loadUpstreams() {
+	configs := builtinUpstreams()
+	if file := os.Getenv("UPSTREAMS_FILE"); file != "" {
+		var declared struct {
+			Upstreams []UpstreamConfig `json:"upstreams"`
+		}
+		data, err := os.ReadFile(file)
+		if err == nil {
+			err = json.Unmarshal(data, &declared)
+		}
+		if err != nil {
+			log.Printf("⚠️ Failed to load upstreams from %s: %v", file, err)
+		}
+		configs = append(configs, declared.Upstreams...)
+	}
+
+	loaded := make(map[string]*UpstreamProxy, len(configs))
+	for _, config := range configs {
+		p, err := NewUpstreamProxy(config)
+		if err != nil {
+			log.Printf("⚠️ Skipping upstream: %v", err)
+			continue
+		}
+		loaded[config.Name] = p
+		if !contains(knownScopes, p.config.Scope) {
+			knownScopes = append(knownScopes, p.config.Scope)
+		}
+	}
+	upstreams = loaded
+}
+
+// registerUpstreamRoutes mounts every upstream behind its scope
+func registerUpstreamRoutes(r *mux.Router) {
+	names := make([]string, 0, len(upstreams))
+	for name := range upstreams {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		p := upstreams[name]
+		template := "/api/proxy/" + name + "/{path:.*}"
+		r.Handle(template, requireScope(p.config.Scope, p))
+		templates := []string{template}
+		if legacy, ok := legacyUpstreamRoutes[name]; ok {
+			templates = append(templates, legacy)
+		}
+		rateLimits.shareLimit("upstream:"+name, *p.config.RateLimit, templates...)
+	}
+}
+
+// Upstream list handler: the configured upstreams without their secrets
+func upstreamListHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	list := make([]map[string]interface{}, 0, len(upstreams))
+	for _, p := range upstreams {
+		list = append(list, map[string]interface{}{
+			"name":      p.config.Name,
+			"baseUrl":   p.base.String(),
+			"scope":     p.config.Scope,
+			"methods":   p.config.Methods,
+			"paths":     p.config.Paths,
+			"rateLimit": p.config.RateLimit,
+			"route":     "/api/proxy/" + p.config.Name + "/",
+		})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i]["name"].(string) < list[j]["name"].(string) })
+	json.NewEncoder(w).Encode(map[string]interface{}{"upstreams": list})
+}
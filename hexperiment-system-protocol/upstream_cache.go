@@ -0,0 +1,362 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// UpstreamCacheConfig enables caching of an upstream's GET responses. Entries
+// are kept per caller, follow the upstream's Cache-Control, and once stale
+// are revalidated with If-None-Match / If-Modified-Since.
+type UpstreamCacheConfig struct {
+	MaxEntries int   `json:"maxEntries"`
+	MaxBytes   int64 `json:"maxBytes"`
+	// Dir persists entries across restarts when set
+	Dir string `json:"dir"`
+}
+
+const (
+	defaultUpstreamCacheEntries = 500
+	defaultUpstreamCacheBytes   = 64 << 20
+)
+
+// Quota headers reported by upstreams such as GitHub. Cached copies go stale,
+// so cached responses carry the latest values seen instead.
+var upstreamRateLimitHeaders = []string{
+	"X-RateLimit-Limit", "X-RateLimit-Remaining", "X-RateLimit-Reset", "X-RateLimit-Used", "X-RateLimit-Resource",
+}
+
+type cachedResponse struct {
+	Key          string      `json:"key"`
+	Status       int         `json:"status"`
+	Header       http.Header `json:"header"`
+	Body         []byte      `json:"body"`
+	ETag         string      `json:"etag,omitempty"`
+	LastModified string      `json:"lastModified,omitempty"`
+	StoredAt     time.Time   `json:"storedAt"`
+	Expires      time.Time   `json:"expires"`
+	used         time.Time
+}
+
+func (e *cachedResponse) fresh(now time.Time) bool {
+	return now.Before(e.Expires)
+}
+
+func (e *cachedResponse) revalidatable() bool {
+	return e.ETag != "" || e.LastModified != ""
+}
+
+// ResponseCache is an LRU of upstream responses, optionally mirrored to a
+// directory of JSON files
+type ResponseCache struct {
+	mu         sync.Mutex
+	dir        string
+	maxEntries int
+	maxBytes   int64
+	size       int64
+	entries    map[string]*cachedResponse
+
+	hits, revalidated, misses, bypassed, evictions int64
+}
+
+// NewResponseCache creates a cache, loading entries persisted in Dir. A
+// cache is returned even when some entries could not be read.
+func NewResponseCache(config UpstreamCacheConfig) (*ResponseCache, error) {
+	c := &ResponseCache{
+		dir:        config.Dir,
+		maxEntries: config.MaxEntries,
+		maxBytes:   config.MaxBytes,
+		entries:    make(map[string]*cachedResponse),
+	}
+	if c.maxEntries <= 0 {
+		c.maxEntries = defaultUpstreamCacheEntries
+	}
+	if c.maxBytes <= 0 {
+		c.maxBytes = defaultUpstreamCacheBytes
+	}
+	if c.dir == "" {
+		return c, nil
+	}
+	if err := os.MkdirAll(c.dir, 0700); err != nil {
+		return c, err
+	}
+	files, err := filepath.Glob(filepath.Join(c.dir, "*.json"))
+	if err != nil {
+		return c, err
+	}
+	var problems []string
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		var entry cachedResponse
+		if err == nil {
+			err = json.Unmarshal(data, &entry)
+		}
+		if err != nil || entry.Key == "" {
+			problems = append(problems, filepath.Base(file))
+			os.Remove(file)
+			continue
+		}
+		entry.used = entry.StoredAt
+		c.entries[entry.Key] = &entry
+		c.size += int64(len(entry.Body))
+	}
+	c.evict()
+	if len(problems) > 0 {
+		return c, fmt.Errorf("dropped unreadable entries: %s", strings.Join(problems, ", "))
+	}
+	return c, nil
+}
+
+// get returns the entry for a key, dropping it if it is stale and cannot be
+// revalidated
+func (c *ResponseCache) get(key string) *cachedResponse {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry := c.entries[key]
+	if entry == nil {
+		return nil
+	}
+	now := time.Now()
+	if !entry.fresh(now) && !entry.revalidatable() {
+		c.remove(entry)
+		return nil
+	}
+	entry.used = now
+	return entry
+}
+
+// store caches a 200 response unless its Cache-Control forbids it or it
+// could never be reused. Caching is decided from the upstream's own headers;
+// header is the filtered set served to callers.
+func (c *ResponseCache) store(key string, status int, upstream, header http.Header, body []byte) {
+	if status != http.StatusOK || int64(len(body)) > c.maxBytes {
+		return
+	}
+	directives := parseCacheControl(upstream.Get("Cache-Control"))
+	if _, noStore := directives["no-store"]; noStore {
+		return
+	}
+	now := time.Now()
+	entry := &cachedResponse{
+		Key:          key,
+		Status:       status,
+		Header:       header,
+		Body:         body,
+		ETag:         upstream.Get("ETag"),
+		LastModified: upstream.Get("Last-Modified"),
+		StoredAt:     now,
+		Expires:      cacheExpiry(now, directives, upstream),
+		used:         now,
+	}
+	if !entry.fresh(now) && !entry.revalidatable() {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if old := c.entries[key]; old != nil {
+		c.remove(old)
+	}
+	c.entries[key] = entry
+	c.size += int64(len(body))
+	c.persist(entry)
+	c.evict()
+}
+
+// refresh replaces an entry after the upstream answered 304 Not Modified.
+// Entries are never changed in place, as they may be being served.
+func (c *ResponseCache) refresh(entry *cachedResponse, header http.Header) *cachedResponse {
+	now := time.Now()
+	updated := *entry
+	updated.Header = entry.Header.Clone()
+	// Served headers are only updated where they were passed through
+	if etag := header.Get("ETag"); etag != "" {
+		updated.ETag = etag
+		if updated.Header.Get("ETag") != "" {
+			updated.Header.Set("ETag", etag)
+		}
+	}
+	cacheControl := header.Get("Cache-Control")
+	if cacheControl == "" {
+		cacheControl = updated.Header.Get("Cache-Control")
+	} else if updated.Header.Get("Cache-Control") != "" {
+		updated.Header.Set("Cache-Control", cacheControl)
+	}
+	updated.StoredAt = now
+	updated.Expires = cacheExpiry(now, parseCacheControl(cacheControl), header)
+	updated.used = now
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries[entry.Key] == entry {
+		c.entries[entry.Key] = &updated
+		c.persist(&updated)
+	}
+	return &updated
+}
+
+// count records how a cacheable request was answered
+func (c *ResponseCache) count(outcome string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch outcome {
+	case "HIT":
+		c.hits++
+	case "REVALIDATED":
+		c.revalidated++
+	case "MISS":
+		c.misses++
+	case "BYPASS":
+		c.bypassed++
+	}
+}
+
+// Stats reports the cache's size and how often it saved an upstream call
+// (hits) or a full upstream response (revalidations)
+func (c *ResponseCache) Stats() map[string]interface{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	lookups := c.hits + c.revalidated + c.misses
+	ratio := 0.0
+	if lookups > 0 {
+		ratio = float64(c.hits+c.revalidated) / float64(lookups)
+	}
+	return map[string]interface{}{
+		"entries":     len(c.entries),
+		"bytes":       c.size,
+		"hits":        c.hits,
+		"revalidated": c.revalidated,
+		"misses":      c.misses,
+		"bypassed":    c.bypassed,
+		"evictions":   c.evictions,
+		"hit_ratio":   ratio,
+		"persistent":  c.dir != "",
+	}
+}
+
+// evict drops least recently used entries until the cache is within its
+// limits. Callers hold the lock.
+func (c *ResponseCache) evict() {
+	for len(c.entries) > c.maxEntries || c.size > c.maxBytes {
+		var oldest *cachedResponse
+		for _, entry := range c.entries {
+			if oldest == nil || entry.used.Before(oldest.used) {
+				oldest = entry
+			}
+		}
+		c.remove(oldest)
+		c.evictions++
+	}
+}
+
+func (c *ResponseCache) remove(entry *cachedResponse) {
+	delete(c.entries, entry.Key)
+	c.size -= int64(len(entry.Body))
+	if c.dir != "" {
+		os.Remove(c.file(entry.Key))
+	}
+}
+
+func (c *ResponseCache) persist(entry *cachedResponse) {
+	if c.dir == "" {
+		return
+	}
+	data, err := json.Marshal(entry)
+	if err == nil {
+		// Entries can hold private upstream data
+		err = os.WriteFile(c.file(entry.Key), data, 0600)
+	}
+	if err != nil {
+		log.Printf("⚠️ Failed to persist cache entry: %v", err)
+	}
+}
+
+func (c *ResponseCache) file(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:])+".json")
+}
+
+// cacheKey separates entries by caller as well as by request, so one
+// caller's cached responses are never served to another
+func cacheKey(r *http.Request, upstreamPath, query string) string {
+	subject := ""
+	if identity, ok := identityFromContext(r.Context()); ok {
+		subject = identity.Subject
+	}
+	return strings.Join([]string{subject, upstreamPath + "?" + query, r.Header.Get("Accept")}, "\n")
+}
+
+// parseCacheControl splits a Cache-Control header into lowercase directives
+func parseCacheControl(header string) map[string]string {
+	directives := make(map[string]string)
+	for _, part := range strings.Split(header, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+			directives[name] = strings.Trim(strings.TrimSpace(value), `"`)
+		}
+	}
+	return directives
+}
+
+// cacheExpiry is when a response stops being fresh: max-age less any Age
+// the upstream reports. Without max-age, or with no-cache, it is stale at
+// once and only reused after revalidation.
+func cacheExpiry(now time.Time, directives map[string]string, header http.Header) time.Time {
+	if _, noCache := directives["no-cache"]; noCache {
+		return now
+	}
+	maxAge, err := strconv.Atoi(directives["max-age"])
+	if err != nil || maxAge <= 0 {
+		return now
+	}
+	if age, err := strconv.Atoi(header.Get("Age")); err == nil && age > 0 {
+		maxAge -= age
+	}
+	return now.Add(time.Duration(maxAge) * time.Second)
+}
+
+// serveCached writes a cached response, answering 304 when the caller
+// already holds it. Headers in update replace the stored ones.
+func serveCached(w http.ResponseWriter, r *http.Request, entry *cachedResponse, outcome string, update http.Header) {
+	for name, values := range entry.Header {
+		if !containsFold(upstreamRateLimitHeaders, name) {
+			w.Header()[name] = append([]string(nil), values...)
+		}
+	}
+	for name, values := range update {
+		w.Header()[name] = values
+	}
+	w.Header().Set("X-Cache", outcome)
+	w.Header().Set("Age", strconv.Itoa(int(time.Since(entry.StoredAt).Seconds())))
+	if etagMatches(r.Header.Values("If-None-Match"), entry.ETag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.WriteHeader(entry.Status)
+	w.Write(entry.Body)
+}
+
+// etagMatches reports whether If-None-Match values, each a list of ETags or
+// "*", match etag. The comparison is weak, ignoring W/ prefixes, as the
+// header calls for.
+func etagMatches(ifNoneMatch []string, etag string) bool {
+	if etag == "" {
+		return false
+	}
+	for _, candidate := range splitList(strings.Join(ifNoneMatch, ",")) {
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,470 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+const testUpstreamSecret = "upstream-secret"
+
+// testUpstream records what reaches a local upstream
+type testUpstream struct {
+	*httptest.Server
+	mu       sync.Mutex
+	requests []*http.Request
+}
+
+func (u *testUpstream) received() []*http.Request {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return append([]*http.Request(nil), u.requests...)
+}
+
+func newTestUpstream(t *testing.T, handler http.HandlerFunc) *testUpstream {
+	t.Helper()
+	u := &testUpstream{}
+	u.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u.mu.Lock()
+		u.requests = append(u.requests, r)
+		u.mu.Unlock()
+		handler(w, r)
+	}))
+	t.Cleanup(u.Close)
+	return u
+}
+
+func newTestUpstreamProxy(t *testing.T, config UpstreamConfig) *UpstreamProxy {
+	t.Helper()
+	t.Setenv("TEST_UPSTREAM_SECRET", testUpstreamSecret)
+	config.Name = "test"
+	if config.Secret == nil {
+		config.Secret = &UpstreamSecret{Header: "X-Service-Key", Prefix: "Key ", Env: "TEST_UPSTREAM_SECRET"}
+	}
+	p, err := NewUpstreamProxy(config)
+	if err != nil {
+		t.Fatalf("NewUpstreamProxy: %v", err)
+	}
+	return p
+}
+
+// newTestProxy mounts an upstream at /api/proxy/test/ as
+// registerUpstreamRoutes does, without authentication
+func newTestProxy(t *testing.T, config UpstreamConfig) http.Handler {
+	t.Helper()
+	r := mux.NewRouter()
+	r.Handle("/api/proxy/test/{path:.*}", newTestUpstreamProxy(t, config))
+	return r
+}
+
+func proxyRequest(handler http.Handler, r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w
+}
+
+func TestUpstreamPathAllowlist(t *testing.T) {
+	upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	proxy := newTestProxy(t, UpstreamConfig{
+		BaseURL: upstream.URL + "/base",
+		Paths:   []string{"/items/*", "/docs/**"},
+	})
+
+	allowed := []string{"/items/1", "/docs/a", "/docs/a/b/c"}
+	for _, path := range allowed {
+		if w := proxyRequest(proxy, httptest.NewRequest("GET", "/api/proxy/test"+path, nil)); w.Code != http.StatusOK {
+			t.Errorf("GET %s = %d, want 200", path, w.Code)
+		}
+	}
+
+	denied := []string{
+		"/items",
+		"/items/1/2",
+		"/secret",
+		"/docs/../secret",
+		"/items/../../secret",
+		"/docs/%2e%2e/secret",
+		"/docs/%2E%2E/%2e%2e/secret",
+		"/docs/a/..",
+		"//items/1",
+		"/items//1",
+		"/docs/./a",
+	}
+	for _, path := range denied {
+		w := proxyRequest(proxy, httptest.NewRequest("GET", "/api/proxy/test"+path, nil))
+		if w.Code == http.StatusOK {
+			t.Errorf("GET %s = 200, want it refused", path)
+		}
+	}
+
+	for _, r := range upstream.received() {
+		if !strings.HasPrefix(r.URL.Path, "/base/items/") && !strings.HasPrefix(r.URL.Path, "/base/docs/") {
+			t.Errorf("upstream received %s", r.URL.Path)
+		}
+	}
+	if got := len(upstream.received()); got != len(allowed) {
+		t.Errorf("upstream received %d requests, want %d", got, len(allowed))
+	}
+}
+
+// Forward must refuse unclean paths itself: callers such as the legacy
+// /api/github handler pass paths the router never cleaned
+func TestUpstreamForwardRejectsUncleanPaths(t *testing.T) {
+	upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {})
+	p := newTestUpstreamProxy(t, UpstreamConfig{BaseURL: upstream.URL + "/base", Paths: []string{"/**"}})
+
+	for _, path := range []string{"/a/../../secret", "/..", "//evil.test/a", "/a//b", "/./a", "/a/.", "a/b", ""} {
+		w := httptest.NewRecorder()
+		p.Forward(w, httptest.NewRequest("GET", "/", nil), path, url.Values{})
+		if w.Code != http.StatusForbidden {
+			t.Errorf("Forward(%q) = %d, want 403", path, w.Code)
+		}
+	}
+	if len(upstream.received()) != 0 {
+		t.Errorf("upstream received %d requests for unclean paths", len(upstream.received()))
+	}
+}
+
+func TestUpstreamMethods(t *testing.T) {
+	upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {})
+	proxy := newTestProxy(t, UpstreamConfig{BaseURL: upstream.URL, Paths: []string{"/**"}})
+
+	w := proxyRequest(proxy, httptest.NewRequest("DELETE", "/api/proxy/test/items/1", nil))
+	if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != "GET" {
+		t.Errorf("DELETE = %d (Allow %q), want 405 (Allow GET)", w.Code, w.Header().Get("Allow"))
+	}
+	if len(upstream.received()) != 0 {
+		t.Error("refused method reached the upstream")
+	}
+}
+
+func TestUpstreamHeaderAndCredentialFiltering(t *testing.T) {
+	upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Set-Cookie", "session=upstream")
+		w.Header().Set("X-Internal", "hidden")
+		w.Write([]byte("{}"))
+	})
+	proxy := newTestProxy(t, UpstreamConfig{
+		BaseURL:    upstream.URL,
+		Paths:      []string{"/items/*"},
+		SetHeaders: map[string]string{"X-From": "hexperiment"},
+	})
+
+	r := httptest.NewRequest("GET", "/api/proxy/test/items/1?q=a&api_key=caller-key&access_token=caller-token", nil)
+	r.Header.Set("Authorization", "Bearer caller-token")
+	r.Header.Set("X-API-Key", "caller-key")
+	r.Header.Set("Cookie", "session=caller")
+	r.Header.Set("X-Service-Key", "forged")
+	r.Header.Set("X-Custom", "dropped")
+	r.Header.Set("Accept", "application/json")
+	w := proxyRequest(proxy, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET = %d, want 200", w.Code)
+	}
+
+	received := upstream.received()
+	if len(received) != 1 {
+		t.Fatalf("upstream received %d requests, want 1", len(received))
+	}
+	got := received[0]
+	if key := got.Header.Get("X-Service-Key"); key != "Key "+testUpstreamSecret {
+		t.Errorf("secret header = %q, want the configured secret", key)
+	}
+	for _, name := range []string{"Authorization", "X-API-Key", "Cookie", "X-Custom"} {
+		if value := got.Header.Get(name); value != "" {
+			t.Errorf("upstream received %s: %q", name, value)
+		}
+	}
+	if got.Header.Get("Accept") != "application/json" || got.Header.Get("X-From") != "hexperiment" {
+		t.Errorf("allowed and set headers missing: %v", got.Header)
+	}
+	query := got.URL.Query()
+	if query.Has("api_key") || query.Has("access_token") || query.Get("q") != "a" {
+		t.Errorf("upstream query = %q, want only q=a", got.URL.RawQuery)
+	}
+
+	if w.Header().Get("Set-Cookie") != "" || w.Header().Get("X-Internal") != "" {
+		t.Errorf("upstream-only response headers relayed: %v", w.Header())
+	}
+	if w.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("Content-Type = %q", w.Header().Get("Content-Type"))
+	}
+}
+
+func TestUpstreamMissingSecret(t *testing.T) {
+	upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {})
+	proxy := newTestProxy(t, UpstreamConfig{
+		BaseURL: upstream.URL,
+		Paths:   []string{"/**"},
+		Secret:  &UpstreamSecret{Header: "X-Service-Key", Env: "TEST_UPSTREAM_UNSET"},
+	})
+	if w := proxyRequest(proxy, httptest.NewRequest("GET", "/api/proxy/test/a", nil)); w.Code != http.StatusForbidden {
+		t.Errorf("GET without secret = %d, want 403", w.Code)
+	}
+	if len(upstream.received()) != 0 {
+		t.Error("request without its secret reached the upstream")
+	}
+}
+
+func TestUpstreamSizeCaps(t *testing.T) {
+	upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/big" {
+			w.Write([]byte(strings.Repeat("x", 64)))
+			return
+		}
+		w.Write([]byte("small"))
+	})
+	proxy := newTestProxy(t, UpstreamConfig{
+		BaseURL:          upstream.URL,
+		Methods:          []string{"GET", "POST"},
+		Paths:            []string{"/**"},
+		MaxRequestBytes:  16,
+		MaxResponseBytes: 32,
+	})
+
+	if w := proxyRequest(proxy, httptest.NewRequest("POST", "/api/proxy/test/echo", strings.NewReader(strings.Repeat("y", 17)))); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized request = %d, want 413", w.Code)
+	}
+	if len(upstream.received()) != 0 {
+		t.Error("oversized request reached the upstream")
+	}
+	if w := proxyRequest(proxy, httptest.NewRequest("POST", "/api/proxy/test/echo", strings.NewReader(strings.Repeat("y", 16)))); w.Code != http.StatusOK {
+		t.Errorf("request at the cap = %d, want 200", w.Code)
+	}
+
+	w := proxyRequest(proxy, httptest.NewRequest("GET", "/api/proxy/test/big", nil))
+	if w.Code != http.StatusBadGateway || strings.Contains(w.Body.String(), "xxx") {
+		t.Errorf("oversized response = %d %q, want 502 without the body", w.Code, w.Body.String())
+	}
+}
+
+func TestUpstreamRedirectsAreNotFollowed(t *testing.T) {
+	elsewhere := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {})
+	upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, elsewhere.URL+"/steal", http.StatusFound)
+	})
+	proxy := newTestProxy(t, UpstreamConfig{BaseURL: upstream.URL, Paths: []string{"/**"}})
+
+	w := proxyRequest(proxy, httptest.NewRequest("GET", "/api/proxy/test/moved", nil))
+	if w.Code != http.StatusFound {
+		t.Errorf("redirect = %d, want 302 relayed", w.Code)
+	}
+	if location := w.Header().Get("Location"); location != "" {
+		t.Errorf("Location relayed: %q", location)
+	}
+	if len(elsewhere.received()) != 0 {
+		t.Error("redirect was followed, sending the secret to another host")
+	}
+}
+
+// newCachingTestProxy mounts a caching upstream that passes through its
+// caching and quota headers
+func newCachingTestProxy(t *testing.T, upstream *testUpstream) (*UpstreamProxy, http.Handler) {
+	t.Helper()
+	p := newTestUpstreamProxy(t, UpstreamConfig{
+		BaseURL:         upstream.URL,
+		Paths:           []string{"/**"},
+		ResponseHeaders: append([]string{"Content-Type", "ETag", "Cache-Control"}, upstreamRateLimitHeaders...),
+		Cache:           &UpstreamCacheConfig{},
+	})
+	r := mux.NewRouter()
+	r.Handle("/api/proxy/test/{path:.*}", p)
+	return p, r
+}
+
+// cacheRequest builds a GET made by subject
+func cacheRequest(path, subject string) *http.Request {
+	r := httptest.NewRequest("GET", "/api/proxy/test"+path, nil)
+	return r.WithContext(context.WithValue(r.Context(), identityContextKey{}, &Identity{Subject: subject}))
+}
+
+func TestUpstreamCacheIsPerIdentity(t *testing.T) {
+	upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("private"))
+	})
+	_, proxy := newCachingTestProxy(t, upstream)
+
+	for _, step := range []struct{ subject, cache string }{
+		{"alice", "MISS"},
+		{"alice", "HIT"},
+		{"bob", "MISS"},
+		{"bob", "HIT"},
+	} {
+		w := proxyRequest(proxy, cacheRequest("/items/1", step.subject))
+		if got := w.Header().Get("X-Cache"); got != step.cache {
+			t.Errorf("%s: X-Cache = %q, want %s", step.subject, got, step.cache)
+		}
+	}
+	if got := len(upstream.received()); got != 2 {
+		t.Errorf("upstream received %d requests, want one per identity", got)
+	}
+}
+
+func TestUpstreamCacheControl(t *testing.T) {
+	upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/fresh":
+			w.Header().Set("Cache-Control", "max-age=60")
+		case "/no-store":
+			w.Header().Set("Cache-Control", "no-store")
+		case "/stale":
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Set("Age", "120")
+		}
+		w.Write([]byte(r.URL.Path))
+	})
+	_, proxy := newCachingTestProxy(t, upstream)
+
+	tests := []struct {
+		path     string
+		requests int
+	}{
+		{"/fresh", 1},
+		{"/no-store", 2},
+		{"/stale", 2},
+	}
+	for _, tt := range tests {
+		before := len(upstream.received())
+		for i := 0; i < 2; i++ {
+			if w := proxyRequest(proxy, cacheRequest(tt.path, "alice")); w.Body.String() != tt.path {
+				t.Errorf("GET %s = %q", tt.path, w.Body.String())
+			}
+		}
+		if got := len(upstream.received()) - before; got != tt.requests {
+			t.Errorf("GET %s twice reached the upstream %d times, want %d", tt.path, got, tt.requests)
+		}
+	}
+
+	// A caller's own no-store bypasses even a fresh entry
+	r := cacheRequest("/fresh", "alice")
+	r.Header.Set("Cache-Control", "no-store")
+	if w := proxyRequest(proxy, r); w.Header().Get("X-Cache") == "HIT" {
+		t.Error("Cache-Control: no-store request answered from the cache")
+	}
+}
+
+func TestUpstreamCacheRevalidation(t *testing.T) {
+	upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Cache-Control", "no-cache")
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write([]byte("body"))
+	})
+	_, proxy := newCachingTestProxy(t, upstream)
+
+	if w := proxyRequest(proxy, cacheRequest("/doc", "alice")); w.Header().Get("X-Cache") != "MISS" {
+		t.Fatalf("first GET X-Cache = %q, want MISS", w.Header().Get("X-Cache"))
+	}
+
+	// Stale entries are revalidated with the stored ETag and served from
+	// the cache on 304
+	w := proxyRequest(proxy, cacheRequest("/doc", "alice"))
+	if w.Code != http.StatusOK || w.Body.String() != "body" || w.Header().Get("X-Cache") != "REVALIDATED" {
+		t.Errorf("revalidated GET = %d %q (X-Cache %q), want 200 body REVALIDATED", w.Code, w.Body.String(), w.Header().Get("X-Cache"))
+	}
+	received := upstream.received()
+	if got := received[len(received)-1].Header.Get("If-None-Match"); got != `"v1"` {
+		t.Errorf("upstream If-None-Match = %q, want the stored ETag", got)
+	}
+
+	// Callers holding the ETag get 304, whether alone, in a list or as *
+	for _, ifNoneMatch := range []string{`"v1"`, `"v0", "v1"`, `W/"v1"`, `*`} {
+		r := cacheRequest("/doc", "alice")
+		r.Header.Set("If-None-Match", ifNoneMatch)
+		if w := proxyRequest(proxy, r); w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+			t.Errorf("If-None-Match %s = %d, want 304", ifNoneMatch, w.Code)
+		}
+	}
+	r := cacheRequest("/doc", "alice")
+	r.Header.Set("If-None-Match", `"v0"`)
+	if w := proxyRequest(proxy, r); w.Code != http.StatusOK {
+		t.Errorf("If-None-Match for another ETag = %d, want 200", w.Code)
+	}
+}
+
+func TestUpstreamRateLimitHeaders(t *testing.T) {
+	var remaining = 42
+	var mu sync.Mutex
+	upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		w.Header().Set("X-RateLimit-Limit", "60")
+		w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+		remaining--
+		mu.Unlock()
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("{}"))
+	})
+	p, proxy := newCachingTestProxy(t, upstream)
+
+	proxyRequest(proxy, cacheRequest("/a", "alice"))
+	proxyRequest(proxy, cacheRequest("/b", "alice"))
+	// A cached response carries the latest quota, not the one stored with it
+	w := proxyRequest(proxy, cacheRequest("/a", "alice"))
+	if w.Header().Get("X-Cache") != "HIT" || w.Header().Get("X-RateLimit-Remaining") != "41" {
+		t.Errorf("cached GET X-Cache %q, X-RateLimit-Remaining %q, want HIT and 41",
+			w.Header().Get("X-Cache"), w.Header().Get("X-RateLimit-Remaining"))
+	}
+
+	saved := upstreams
+	upstreams = map[string]*UpstreamProxy{"test": p}
+	t.Cleanup(func() { upstreams = saved })
+	offline := httptest.NewServer(http.NotFoundHandler())
+	offline.Close()
+	t.Setenv("LMSTUDIO_URL", offline.URL)
+
+	status := httptest.NewRecorder()
+	realtimeStatusHandler(status, httptest.NewRequest("GET", "/api/realtime/status", nil))
+	var body struct {
+		Upstreams map[string]struct {
+			RateLimit map[string]interface{} `json:"rate_limit"`
+			Cache     map[string]interface{} `json:"cache"`
+		} `json:"upstreams"`
+	}
+	if err := json.Unmarshal(status.Body.Bytes(), &body); err != nil {
+		t.Fatalf("status: %v", err)
+	}
+	got := body.Upstreams["test"]
+	if got.RateLimit["remaining"] != 41.0 || got.RateLimit["limit"] != 60.0 {
+		t.Errorf("status rate_limit = %v, want remaining 41 and limit 60", got.RateLimit)
+	}
+	if got.Cache["hits"] != 1.0 || got.Cache["misses"] != 2.0 {
+		t.Errorf("status cache = %v, want 1 hit and 2 misses", got.Cache)
+	}
+}
+
+func TestUpstreamCacheReadsUnforwardedHeaders(t *testing.T) {
+	upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte("body"))
+	})
+	proxy := newTestProxy(t, UpstreamConfig{
+		BaseURL: upstream.URL,
+		Paths:   []string{"/**"},
+		Cache:   &UpstreamCacheConfig{},
+	})
+
+	proxyRequest(proxy, cacheRequest("/doc", "alice"))
+	w := proxyRequest(proxy, cacheRequest("/doc", "alice"))
+	if w.Header().Get("X-Cache") != "HIT" {
+		t.Errorf("X-Cache = %q, want HIT from headers that are not passed through", w.Header().Get("X-Cache"))
+	}
+	if w.Header().Get("ETag") != "" || w.Header().Get("Cache-Control") != "" {
+		t.Errorf("unlisted headers served from the cache: %v", w.Header())
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Browsers cannot set headers on a WebSocket handshake, so a credential may
+// also be offered as a subprotocol "hxp-auth.<key or token>" next to a real
+// one such as "hexperiment-v2". Only the real subprotocol is echoed back.
+const wsAuthSubprotocolPrefix = "hxp-auth."
+
+// A client that connects without credentials must send an "auth" message
+// this soon; it receives no broadcasts until then
+const wsAuthTimeout = 10 * time.Second
+
+// wsMessageScopes is the scope each client message type requires. Any other
+// type is broadcast to all clients and needs protocol:broadcast; heartbeats
+// only need a connection.
+var wsMessageScopes = map[string]string{
+	"persona_request":          scopePersonaWrite,
+	"persona_dialogue_request": scopePersonaWrite,
+	"lmstudio_request":         scopeLMStudioChat,
+	"heartbeat":                "",
+}
+
+// wsMessageScope returns the scope required to send a message type
+func wsMessageScope(messageType string) string {
+	if scope, ok := wsMessageScopes[messageType]; ok {
+		return scope
+	}
+	return scopeProtocolBroadcast
+}
+
+// wsSubprotocolCredential returns a credential offered as a subprotocol
+func wsSubprotocolCredential(r *http.Request) string {
+	for _, protocol := range websocket.Subprotocols(r) {
+		if strings.HasPrefix(protocol, wsAuthSubprotocolPrefix) {
+			return strings.TrimPrefix(protocol, wsAuthSubprotocolPrefix)
+		}
+	}
+	return ""
+}
+
+// authenticateWebSocket checks the credentials of a handshake: headers or
+// query parameters as for REST routes, a subprotocol credential, or a client
+// certificate. It returns a nil identity and status 0 when none were
+// presented, leaving authentication to the first message.
+func authenticateWebSocket(r *http.Request) (*Identity, int) {
+	var identity *Identity
+	switch {
+	case authOpen(), presentedBearerToken(r) != "", presentedAPIKey(r) != "":
+		var ok bool
+		if identity, ok = authenticate(r); !ok {
+			return nil, http.StatusUnauthorized
+		}
+	case wsSubprotocolCredential(r) != "":
+		var ok bool
+		if identity, ok = authenticateCredential(wsSubprotocolCredential(r)); !ok {
+			return nil, http.StatusUnauthorized
+		}
+	case hasClientCertificate(r):
+		var ok bool
+		if identity, ok = clientCertIdentity(r); !ok {
+			return nil, http.StatusUnauthorized
+		}
+	default:
+		return nil, 0
+	}
+	if !identity.hasScope(scopeProtocolRead) {
+		return nil, http.StatusForbidden
+	}
+	return identity, 0
+}
+
+// awaitWebSocketAuth reads the first message of an unauthenticated client,
+// which must be {"type":"auth","data":{"token":"..."}} (or "api_key")
+func awaitWebSocketAuth(conn *websocket.Conn) (*Identity, error) {
+	conn.SetReadDeadline(time.Now().Add(wsAuthTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	var protocol Protocol
+	if err := conn.ReadJSON(&protocol); err != nil {
+		return nil, fmt.Errorf("no auth message: %v", err)
+	}
+	if protocol.Type != "auth" {
+		return nil, fmt.Errorf("expected an auth message, got %q", protocol.Type)
+	}
+	credential, _ := protocol.Data["token"].(string)
+	if credential == "" {
+		credential, _ = protocol.Data["api_key"].(string)
+	}
+	identity, ok := authenticateCredential(credential)
+	if !ok {
+		return nil, fmt.Errorf("invalid credentials")
+	}
+	if !identity.hasScope(scopeProtocolRead) {
+		return nil, fmt.Errorf("missing scope %s", scopeProtocolRead)
+	}
+	return identity, nil
+}
+
+// rejectWebSocket tells a client why it is being disconnected and closes
+// the connection with a policy violation
+func rejectWebSocket(conn *websocket.Conn, reason string) {
+	conn.WriteJSON(Protocol{
+		ID:   fmt.Sprintf("auth-error-%d", time.Now().UnixNano()),
+		Type: "auth_error",
+		Data: map[string]interface{}{
+			"error": reason,
+		},
+		Timestamp: time.Now(),
+		Status:    "unauthorized",
+	})
+	conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.ClosePolicyViolation, reason), time.Now().Add(time.Second))
+}
+
+// identity returns the caller attached to the client at connect time
+func (c *Client) identity() *Identity {
+	identity, _ := c.metadata["identity"].(*Identity)
+	return identity
+}
+
+// authorizeMessage reports whether the client may send a message, and tells
+// it why not if it may not
+func (c *Client) authorizeMessage(protocol Protocol) bool {
+	scope := wsMessageScope(protocol.Type)
+	if scope == "" {
+		return true
+	}
+	if identity := c.identity(); identity != nil && identity.hasScope(scope) {
+		return true
+	}
+	c.send(Protocol{
+		ID:   fmt.Sprintf("forbidden-%d", time.Now().UnixNano()),
+		Type: "error",
+		Data: map[string]interface{}{
+			"error":        "Forbidden: missing scope " + scope,
+			"message_type": protocol.Type,
+			"request_id":   protocol.ID,
+		},
+		Timestamp: time.Now(),
+		Status:    "forbidden",
+	})
+	return false
+}